@@ -0,0 +1,121 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotConfirmed = errors.New("dangerous operation not confirmed")
+	ErrHolderAlive  = errors.New("lock holder is still active")
+)
+
+// ForceReleaseLock terminates every backend holding the advisory lock that
+// guards the upgrade to targetVersion and returns their PIDs.
+//
+// This is meant for incident recovery when a lock leaked from a session that
+// is dead but not yet reaped. Terminating a live migrator rolls back its open
+// transaction, so confirm must be true or ErrNotConfirmed is returned.
+func (m *Migrator) ForceReleaseLock(ctx context.Context, targetVersion int, confirm bool) ([]int, error) {
+	if !confirm {
+		return nil, ErrNotConfirmed
+	}
+
+	lockID, err := lockIDFor(m.cfg.LockBase, targetVersion)
+	if err != nil {
+		return nil, err
+	}
+	pids, err := m.advisoryLockHolders(ctx, lockID)
+	if err != nil {
+		return nil, err
+	}
+
+	var terminated []int
+	for _, pid := range pids {
+		var ok bool
+		if err := m.db.QueryRowContext(ctx, "SELECT pg_terminate_backend($1)", pid).Scan(&ok); err != nil {
+			return terminated, m.logErrorf("Failed to terminate backend %d: %w", pid, err)
+		}
+		if ok {
+			m.infof("Terminated backend %d holding advisory lock %d", pid, lockID)
+			terminated = append(terminated, pid)
+		}
+	}
+	return terminated, nil
+}
+
+// RecoverStuckMigration frees the lock guarding the upgrade to targetVersion
+// if its holder looks dead, so the next migrator can proceed, and returns the
+// PIDs it terminated. A holder counts as dead when its session hasn't run a
+// statement for longer than idleFor, whether it sits idle or idle in a
+// transaction; the latter is how a migrator whose process hung or lost its
+// network mid-step shows up. A holder running a statement, or quiet for
+// less than idleFor, is left alone and ErrHolderAlive is returned.
+//
+// A live migrator also goes quiet while Go code runs between its statements,
+// e.g. in a NoTx step, BackfillInBatches, WithLock or a batch hook, so
+// idleFor must be longer than any such pause. A wrong guess lets two
+// migrators run, so confirm must be true or ErrNotConfirmed is returned.
+func (m *Migrator) RecoverStuckMigration(ctx context.Context, targetVersion int, idleFor time.Duration, confirm bool) ([]int, error) {
+	if !confirm {
+		return nil, ErrNotConfirmed
+	}
+
+	lockID, err := lockIDFor(m.cfg.LockBase, targetVersion)
+	if err != nil {
+		return nil, err
+	}
+	pids, err := m.advisoryLockHolders(ctx, lockID)
+	if err != nil {
+		return nil, err
+	}
+
+	var terminated []int
+	for _, pid := range pids {
+		var ok bool
+		err := m.db.QueryRowContext(ctx, `
+			SELECT pg_terminate_backend(pid) FROM pg_stat_activity
+			WHERE pid = $1 AND state IN ('idle', 'idle in transaction', 'idle in transaction (aborted)')
+				AND state_change < now() - make_interval(secs => $2)
+		`, pid, idleFor.Seconds()).Scan(&ok)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return terminated, m.logErrorf("%w: backend %d holds advisory lock %d", ErrHolderAlive, pid, lockID)
+		case err != nil:
+			return terminated, m.logErrorf("Failed to terminate backend %d: %w", pid, err)
+		}
+		if ok {
+			m.infof("Terminated stuck backend %d holding advisory lock %d", pid, lockID)
+			terminated = append(terminated, pid)
+		}
+	}
+	return terminated, nil
+}
+
+func (m *Migrator) advisoryLockHolders(ctx context.Context, lockID int) ([]int, error) {
+	rows, err := m.db.QueryContext(ctx, `
+		SELECT pid FROM pg_locks
+		WHERE locktype = 'advisory' AND granted AND objsubid = 1
+			AND ((classid::bigint << 32) | objid::bigint) = $1
+			AND pid <> pg_backend_pid()
+	`, lockID)
+	if err != nil {
+		return nil, m.logErrorf("Failed to look up advisory lock holders: %w", err)
+	}
+	defer rows.Close()
+
+	var pids []int
+	for rows.Next() {
+		var pid int
+		if err := rows.Scan(&pid); err != nil {
+			return nil, m.logErrorf("Failed to read advisory lock holder: %w", err)
+		}
+		pids = append(pids, pid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, m.logErrorf("Failed to read advisory lock holders: %w", err)
+	}
+	return pids, nil
+}
@@ -0,0 +1,130 @@
+package dblock_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"dblock/dblock"
+	"dblock/dblock/dblocktest"
+)
+
+// holdLock takes the advisory lock key on a connection of its own and
+// returns the connection and its backend pid.
+func holdLock(t *testing.T, s *dblocktest.Sandbox, key int) (*sql.Conn, int) {
+	t.Helper()
+	ctx := context.Background()
+	conn, err := s.DB.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	var pid int
+	if err := conn.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", key); err != nil {
+		t.Fatal(err)
+	}
+	return conn, pid
+}
+
+func TestForceReleaseLockTerminatesHolder(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	_, pid := holdLock(t, s, s.Config.LockBase+4)
+
+	terminated, err := s.Migrator().ForceReleaseLock(ctx, 4, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(terminated) != 1 || terminated[0] != pid {
+		t.Errorf("terminated %v, want [%d]", terminated, pid)
+	}
+
+	// pg_terminate_backend only signals, give the backend a moment to exit.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var free bool
+		if err := s.DB.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1) AND pg_advisory_unlock($1)", s.Config.LockBase+4).Scan(&free); err != nil {
+			t.Fatal(err)
+		}
+		if free {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("lock still held after ForceReleaseLock")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestForceReleaseLockLeavesOtherVersions(t *testing.T) {
+	s := newSandbox(t)
+	holdLock(t, s, s.Config.LockBase+5)
+
+	terminated, err := s.Migrator().ForceReleaseLock(context.Background(), 4, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(terminated) != 0 {
+		t.Errorf("terminated %v for an unheld lock", terminated)
+	}
+}
+
+func TestRecoverStuckMigrationFreesHolderIdleInTransaction(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+
+	// A migrator that hung mid-step: lock taken, transaction left open.
+	conn, pid := holdLock(t, s, s.Config.LockBase+1)
+	if _, err := conn.ExecContext(ctx, "BEGIN"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	m := s.Migrator()
+	if _, err := m.RecoverStuckMigration(ctx, 1, time.Hour, true); !errors.Is(err, dblock.ErrHolderAlive) {
+		t.Fatalf("RecoverStuckMigration with a long idleFor error = %v, want ErrHolderAlive", err)
+	}
+	terminated, err := m.RecoverStuckMigration(ctx, 1, 100*time.Millisecond, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(terminated) != 1 || terminated[0] != pid {
+		t.Errorf("terminated %v, want [%d]", terminated, pid)
+	}
+	if _, err := m.Upgrade(ctx, 1, nil, time.Second); err != nil {
+		t.Errorf("Upgrade after recovery: %v", err)
+	}
+}
+
+func TestRecoverStuckMigrationLeavesActiveHolder(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+
+	conn, _ := holdLock(t, s, s.Config.LockBase+1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = conn.ExecContext(ctx, "SELECT pg_sleep(1)")
+	}()
+	defer func() { <-done }()
+	time.Sleep(300 * time.Millisecond)
+
+	if _, err := s.Migrator().RecoverStuckMigration(ctx, 1, 100*time.Millisecond, true); !errors.Is(err, dblock.ErrHolderAlive) {
+		t.Errorf("error = %v, want ErrHolderAlive", err)
+	}
+}
+
+func TestRecoverStuckMigrationNeedsConfirm(t *testing.T) {
+	m := dblock.New(nil, dblock.Config{Silent: true})
+	if _, err := m.RecoverStuckMigration(context.Background(), 1, time.Minute, false); !errors.Is(err, dblock.ErrNotConfirmed) {
+		t.Errorf("error = %v, want ErrNotConfirmed", err)
+	}
+	if _, err := m.ForceReleaseLock(context.Background(), 1, false); !errors.Is(err, dblock.ErrNotConfirmed) {
+		t.Errorf("ForceReleaseLock error = %v, want ErrNotConfirmed", err)
+	}
+}
@@ -0,0 +1,121 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+)
+
+// UpgradeAllOptions tunes UpgradeAll. The zero value migrates one database
+// at a time with a default Config and keeps going past failures.
+type UpgradeAllOptions struct {
+	// Config is used for every database.
+	Config Config
+
+	// Concurrency is how many databases are migrated at once, 1 if zero.
+	Concurrency int
+
+	// FailFast stops starting new databases after the first failure. Those
+	// never started report context.Canceled.
+	FailFast bool
+
+	// Names identifies each database for ordering, index-aligned with dbs.
+	// If nil, the server address, port and database name are queried.
+	Names []string
+}
+
+// UpgradeAll upgrades every database in dbs, e.g. one per tenant, and
+// returns their outcomes in the same order. Each database has its own
+// version table and lock.
+//
+// Databases are started in ascending order of their names, never in the
+// order of dbs, so every process calling UpgradeAll over the same set tries
+// their locks in the same sequence and can't deadlock on a lock shared
+// across them, such as Config.SharedLockKey. With a Concurrency of 1 each
+// lock is also acquired and released before the next is tried.
+// A database whose name can't be queried fails on its own and the others
+// still run.
+func UpgradeAll(ctx context.Context, dbs []*sql.DB, targetVersion int, upgradeFunc func(*sql.Tx) error, timeout time.Duration, opts UpgradeAllOptions) []AsyncResult {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	// Canceling stop only keeps new databases from starting, running
+	// upgrades are left to finish.
+	stop, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]AsyncResult, len(dbs))
+	order, errs, err := New(nil, opts.Config).lockOrder(ctx, dbs, opts.Names)
+	if err != nil {
+		for i := range results {
+			results[i].Err = err
+		}
+		return results
+	}
+	for i, err := range errs {
+		results[i].Err = err
+	}
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, i := range order {
+		db := dbs[i]
+		select {
+		case sem <- struct{}{}:
+		case <-stop.Done():
+			results[i].Err = stop.Err()
+			continue
+		}
+		if stop.Err() != nil {
+			<-sem
+			results[i].Err = stop.Err()
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, db *sql.DB) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			res, err := New(db, opts.Config).Upgrade(ctx, targetVersion, upgradeFunc, timeout)
+			results[i] = AsyncResult{Result: res, Err: err}
+			if err != nil && opts.FailFast {
+				cancel()
+			}
+		}(i, db)
+	}
+	wg.Wait()
+	return results
+}
+
+// lockOrder returns the indexes of dbs sorted by name, breaking ties by
+// index. A database whose name can't be queried is left out of the order
+// and its error is returned at its index in errs.
+func (m *Migrator) lockOrder(ctx context.Context, dbs []*sql.DB, names []string) ([]int, []error, error) {
+	errs := make([]error, len(dbs))
+	if names == nil {
+		names = make([]string, len(dbs))
+		for i, db := range dbs {
+			err := db.QueryRowContext(ctx, `
+				SELECT coalesce(host(inet_server_addr()), '') || ':' ||
+					coalesce(inet_server_port()::text, '') || '/' || current_database()
+			`).Scan(&names[i])
+			if err != nil {
+				errs[i] = m.logErrorf("Failed to identify database %d: %w", i, err)
+			}
+		}
+	} else if len(names) != len(dbs) {
+		return nil, nil, m.logErrorf("UpgradeAll got %d names for %d databases", len(names), len(dbs))
+	}
+
+	order := make([]int, 0, len(dbs))
+	for i := range dbs {
+		if errs[i] == nil {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool { return names[order[a]] < names[order[b]] })
+	return order, errs, nil
+}
@@ -0,0 +1,86 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// failingConnector refuses every connection with err.
+type failingConnector struct{ err error }
+
+func (c failingConnector) Connect(context.Context) (driver.Conn, error) { return nil, c.err }
+func (c failingConnector) Driver() driver.Driver                        { return nil }
+
+func TestLockOrderSortsByName(t *testing.T) {
+	dbs := make([]*sql.DB, 4)
+	order, errs, err := New(nil, Config{}).lockOrder(context.Background(), dbs, []string{"c", "a", "b", "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1, 3, 2, 0}; !reflect.DeepEqual(order, want) {
+		t.Errorf("order = %v, want %v", order, want)
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("errs[%d] = %v", i, err)
+		}
+	}
+}
+
+func TestLockOrderIsTheSameForEveryCaller(t *testing.T) {
+	a, b, c := &sql.DB{}, &sql.DB{}, &sql.DB{}
+	names := map[*sql.DB]string{a: "10.0.0.1:5432/a", b: "10.0.0.1:5432/b", c: "10.0.0.2:5432/a"}
+	var sequences [][]*sql.DB
+	for _, dbs := range [][]*sql.DB{{a, b, c}, {c, b, a}, {b, c, a}} {
+		dbNames := make([]string, len(dbs))
+		for i, db := range dbs {
+			dbNames[i] = names[db]
+		}
+		order, _, err := New(nil, Config{}).lockOrder(context.Background(), dbs, dbNames)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var seq []*sql.DB
+		for _, i := range order {
+			seq = append(seq, dbs[i])
+		}
+		sequences = append(sequences, seq)
+	}
+	for _, seq := range sequences[1:] {
+		if !reflect.DeepEqual(seq, sequences[0]) || seq[0] != a || seq[1] != b || seq[2] != c {
+			t.Fatalf("lock orders differ between callers: %v", sequences)
+		}
+	}
+}
+
+func TestLockOrderNameCountMismatch(t *testing.T) {
+	_, _, err := New(nil, Config{}).lockOrder(context.Background(), make([]*sql.DB, 2), []string{"a"})
+	if err == nil {
+		t.Fatal("no error for 1 name for 2 databases")
+	}
+}
+
+func TestUpgradeAllLookupErrorStaysWithItsDatabase(t *testing.T) {
+	errDown := errors.New("connection refused")
+	errOther := errors.New("no route to host")
+	dbs := []*sql.DB{
+		sql.OpenDB(failingConnector{errDown}),
+		sql.OpenDB(failingConnector{errOther}),
+	}
+	for _, db := range dbs {
+		defer db.Close()
+	}
+	cfg := Config{LogLevel: LogSilent}
+	results := UpgradeAll(context.Background(), dbs, 1, nil, time.Second, UpgradeAllOptions{Config: cfg})
+	if !errors.Is(results[0].Err, errDown) {
+		t.Errorf("results[0].Err = %v, want %v", results[0].Err, errDown)
+	}
+	if !errors.Is(results[1].Err, errOther) {
+		t.Errorf("results[1].Err = %v, want %v", results[1].Err, errOther)
+	}
+}
@@ -0,0 +1,31 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// AsyncResult is the outcome delivered by UpgradeAsync.
+type AsyncResult struct {
+	Result
+	Err error
+}
+
+func UpgradeAsync(ctx context.Context, db *sql.DB, targetVersion int, upgradeFunc func(*sql.Tx) error, timeout time.Duration) <-chan AsyncResult {
+	return New(db, Config{}).UpgradeAsync(ctx, targetVersion, upgradeFunc, timeout)
+}
+
+// UpgradeAsync runs Upgrade in the background. The returned channel receives
+// exactly one AsyncResult and is then closed. Canceling ctx aborts waiting
+// and any running statement; the lock connection is still cleaned up by the
+// goroutine before the result is delivered.
+func (m *Migrator) UpgradeAsync(ctx context.Context, targetVersion int, upgradeFunc func(*sql.Tx) error, timeout time.Duration) <-chan AsyncResult {
+	ch := make(chan AsyncResult, 1)
+	go func() {
+		defer close(ch)
+		res, err := m.Upgrade(ctx, targetVersion, upgradeFunc, timeout)
+		ch <- AsyncResult{Result: res, Err: err}
+	}()
+	return ch
+}
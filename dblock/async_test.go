@@ -0,0 +1,54 @@
+package dblock_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestUpgradeAsync(t *testing.T) {
+	s := newSandbox(t)
+	release := make(chan struct{})
+	ch := s.Migrator().UpgradeAsync(context.Background(), 1, func(*sql.Tx) error {
+		<-release
+		return nil
+	}, time.Minute)
+
+	select {
+	case r := <-ch:
+		t.Fatalf("result %+v delivered while Up was still running", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+
+	r, ok := <-ch
+	if !ok {
+		t.Fatal("channel closed without a result")
+	}
+	if r.Err != nil || !r.Upgraded || r.To != 1 {
+		t.Errorf("result %+v, want an upgrade to 1", r)
+	}
+	if _, ok := <-ch; ok {
+		t.Error("channel delivered a second result")
+	}
+}
+
+func TestUpgradeAsyncCanceled(t *testing.T) {
+	s := newSandbox(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := s.Migrator().UpgradeAsync(ctx, 1, func(tx *sql.Tx) error {
+		cancel()
+		_, err := tx.ExecContext(ctx, "SELECT pg_sleep(60)")
+		return err
+	}, time.Minute)
+
+	select {
+	case r := <-ch:
+		if r.Err == nil {
+			t.Errorf("result %+v after cancel, want an error", r)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("no result after cancel")
+	}
+}
@@ -0,0 +1,83 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// BackfillInBatches repeatedly runs query, each time in its own transaction,
+// until it affects no rows, and returns the total number of rows affected.
+//
+// query must take the batch size as $1 and only touch rows that still need
+// work, e.g.
+//
+//	UPDATE users SET email_lower = lower(email)
+//	WHERE id IN (SELECT id FROM users WHERE email_lower IS NULL LIMIT $1)
+//
+// onProgress, if not nil, is called after every committed batch with the
+// running total. Since every batch commits on its own, this is meant for
+// non-transactional data migrations rather than from inside upgradeFunc.
+func BackfillInBatches(ctx context.Context, db *sql.DB, query string, batchSize int, onProgress func(done int64)) (int64, error) {
+	if batchSize <= 0 {
+		return 0, fmt.Errorf("invalid batch size %d", batchSize)
+	}
+
+	var done int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return done, err
+		}
+
+		n, err := runBatch(ctx, db, query, batchSize)
+		if err != nil {
+			return done, fmt.Errorf("backfill failed after %d rows: %w", done, err)
+		}
+		if n == 0 {
+			return done, nil
+		}
+
+		done += n
+		if onProgress != nil {
+			onProgress(done)
+		}
+	}
+}
+
+func runBatch(ctx context.Context, db *sql.DB, query string, batchSize int) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.ExecContext(ctx, query, batchSize)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	return n, tx.Commit()
+}
+
+// DefaultProgressChannel is the channel NotifyProgress uses if none is given.
+const DefaultProgressChannel = "dblock_progress"
+
+// NotifyProgress returns an onProgress for BackfillInBatches that publishes
+// every tick with pg_notify, so anyone running LISTEN dblock_progress in psql
+// sees live updates. The payload is label followed by the row count, e.g.
+// "version=4 rows=500000". Failed notifications are ignored, as progress
+// reports mustn't fail the backfill.
+func NotifyProgress(ctx context.Context, db *sql.DB, channel, label string) func(done int64) {
+	if channel == "" {
+		channel = DefaultProgressChannel
+	}
+	return func(done int64) {
+		payload := fmt.Sprintf("%s rows=%d", label, done)
+		_, _ = db.ExecContext(ctx, "SELECT pg_notify($1, $2)", channel, payload)
+	}
+}
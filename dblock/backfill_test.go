@@ -0,0 +1,119 @@
+package dblock
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log"
+	"testing"
+)
+
+// captureLog collects what the standard logger prints until the test ends.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	out, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	t.Cleanup(func() {
+		log.SetOutput(out)
+		log.SetFlags(flags)
+	})
+	return &buf
+}
+
+func TestBackfillInBatches(t *testing.T) {
+	left := int64(250)
+	fake := &fakeDB{exec: func(string, []driver.NamedValue) (driver.Result, error) {
+		n := min(left, 100)
+		left -= n
+		return driver.RowsAffected(n), nil
+	}}
+	var ticks []int64
+	done, err := BackfillInBatches(context.Background(), fake.open(t), "UPDATE t SET x = 1 LIMIT $1", 100, func(done int64) {
+		ticks = append(ticks, done)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done != 250 {
+		t.Errorf("done = %d, want 250", done)
+	}
+	if len(ticks) != 3 || ticks[2] != 250 {
+		t.Errorf("progress ticks %v, want 100, 200, 250", ticks)
+	}
+}
+
+func TestBackfillAndNotifyDontLog(t *testing.T) {
+	buf := captureLog(t)
+	errBatch := errors.New("deadlock detected")
+	fake := &fakeDB{exec: func(string, []driver.NamedValue) (driver.Result, error) { return nil, errBatch }}
+	db := fake.open(t)
+
+	if _, err := BackfillInBatches(context.Background(), db, "UPDATE t SET x = 1", 10, nil); !errors.Is(err, errBatch) {
+		t.Errorf("BackfillInBatches error = %v, want %v", err, errBatch)
+	}
+	NotifyProgress(context.Background(), db, "", "version=4")(10)
+	if buf.Len() > 0 {
+		t.Errorf("logged %q", buf.String())
+	}
+}
+
+func TestLintDoesntLog(t *testing.T) {
+	buf := captureLog(t)
+	errStep := errors.New("syntax error")
+	migrations := Migrations{
+		{Version: 1, Up: func(*sql.Tx) error { return nil }},
+		{Version: 2, Up: func(*sql.Tx) error { return errStep }},
+	}
+	err := Lint(context.Background(), (&fakeDB{}).open(t), migrations)
+	var lintErr *LintError
+	if !errors.As(err, &lintErr) || lintErr.Version != 2 || !errors.Is(err, errStep) {
+		t.Errorf("Lint error = %v, want a LintError for version 2", err)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("logged %q", buf.String())
+	}
+}
+
+func TestBackfillInBatchesRejectsBadBatchSize(t *testing.T) {
+	if _, err := BackfillInBatches(context.Background(), (&fakeDB{}).open(t), "UPDATE t SET x = 1", 0, nil); err == nil {
+		t.Error("no error for a batch size of 0")
+	}
+}
+
+func TestBackfillInBatchesStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	batches := 0
+	fake := &fakeDB{exec: func(string, []driver.NamedValue) (driver.Result, error) {
+		batches++
+		return driver.RowsAffected(10), nil
+	}}
+	done, err := BackfillInBatches(ctx, fake.open(t), "UPDATE t SET x = 1", 10, func(done int64) {
+		if done == 30 {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, want context.Canceled", err)
+	}
+	if done != 30 || batches != 3 {
+		t.Errorf("done = %d after %d batches, want 30 after 3", done, batches)
+	}
+}
+
+func TestNotifyProgressPayload(t *testing.T) {
+	var args []driver.NamedValue
+	fake := &fakeDB{query: func(_ string, a []driver.NamedValue) (driver.Rows, error) {
+		args = a
+		return &fakeRows{}, nil
+	}, exec: func(_ string, a []driver.NamedValue) (driver.Result, error) {
+		args = a
+		return driver.RowsAffected(1), nil
+	}}
+	NotifyProgress(context.Background(), fake.open(t), "", "version=4")(500)
+	if len(args) != 2 || args[0].Value != DefaultProgressChannel || args[1].Value != "version=4 rows=500" {
+		t.Errorf("pg_notify args = %v, want %s and version=4 rows=500", args, DefaultProgressChannel)
+	}
+}
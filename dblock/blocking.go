@@ -0,0 +1,51 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrBlockingTransactionPresent = errors.New("long-running transaction holds a lock the migration needs")
+
+// checkBlockingTransactions fails if a transaction open longer than
+// Config.BlockingTxAge holds any lock on one of Config.BlockingTxTables. An
+// ALTER queued behind it would block every later query on the table.
+func (m *Migrator) checkBlockingTransactions(ctx context.Context, conn *sql.Conn, version int) error {
+	if m.cfg.BlockingTxAge <= 0 {
+		return nil
+	}
+
+	var blockers []string
+	for _, table := range m.cfg.BlockingTxTables {
+		rows, err := conn.QueryContext(ctx, `
+			SELECT DISTINCT a.pid FROM pg_locks l
+			JOIN pg_stat_activity a ON a.pid = l.pid
+			WHERE l.relation = to_regclass($1)
+				AND a.pid <> pg_backend_pid()
+				AND a.xact_start < now() - make_interval(secs => $2)
+		`, table, m.cfg.BlockingTxAge.Seconds())
+		if err != nil {
+			return m.logErrorf("Failed to check for transactions blocking %s: %w", table, err)
+		}
+		for rows.Next() {
+			var pid int
+			if err := rows.Scan(&pid); err != nil {
+				rows.Close()
+				return m.logErrorf("Failed to check for transactions blocking %s: %w", table, err)
+			}
+			blockers = append(blockers, fmt.Sprintf("pid %d on %s", pid, table))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return m.logErrorf("Failed to check for transactions blocking %s: %w", table, err)
+		}
+	}
+	if len(blockers) > 0 {
+		return m.logErrorf("%w: version %d: %s open longer than %v",
+			ErrBlockingTransactionPresent, version, strings.Join(blockers, ", "), m.cfg.BlockingTxAge)
+	}
+	return nil
+}
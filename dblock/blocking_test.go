@@ -0,0 +1,47 @@
+package dblock_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"dblock/dblock"
+)
+
+func TestBlockingTransactionPresent(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	if _, err := s.DB.Exec("CREATE TABLE users (id INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := s.DB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("SELECT * FROM users"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	cfg := s.Config
+	cfg.BlockingTxAge = time.Second
+	cfg.BlockingTxTables = []string{"users"}
+	m := dblock.New(s.DB, cfg)
+	alter := func(tx *sql.Tx) error {
+		_, err := tx.Exec("ALTER TABLE users ADD COLUMN name TEXT")
+		return err
+	}
+	if _, err := m.Upgrade(ctx, 1, alter, time.Minute); !errors.Is(err, dblock.ErrBlockingTransactionPresent) {
+		t.Fatalf("Upgrade with an old transaction on users = %v, want ErrBlockingTransactionPresent", err)
+	}
+
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Upgrade(ctx, 1, alter, time.Minute); err != nil {
+		t.Errorf("Upgrade once the transaction ended: %v", err)
+	}
+}
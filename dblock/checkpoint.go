@@ -0,0 +1,76 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// Long non-transactional steps such as backfills can save their progress in
+// the version table's _checkpoint table (schema_version_checkpoint by
+// default) as they go and pick up from there after a crash:
+//
+//	NoTx: func(ctx context.Context, conn *sql.Conn) error {
+//		lastID, _, err := m.LoadCheckpoint(ctx, conn, 7)
+//		// For every batch after lastID, in one transaction tx:
+//		//	update the batch, then m.SaveCheckpoint(ctx, tx, 7, batchLastID)
+//	}
+//
+// The checkpoint is removed once the step has committed. q may be a
+// *sql.DB, *sql.Tx or *sql.Conn; saving in the batch's own transaction keeps
+// the checkpoint exact.
+
+// checkpointDialect returns the StateDialect checkpoints are kept with.
+func (m *Migrator) checkpointDialect() (StateDialect, error) {
+	d, ok := m.stateDialect()
+	if !ok {
+		return nil, m.logErrorf("Checkpoints need a dialect implementing StateDialect, %T doesn't", m.sql.dialect)
+	}
+	return d, nil
+}
+
+// SaveCheckpoint stores checkpoint as the progress of the step for version,
+// replacing any earlier one.
+func (m *Migrator) SaveCheckpoint(ctx context.Context, q Queryer, version int, checkpoint string) error {
+	d, err := m.checkpointDialect()
+	if err != nil {
+		return err
+	}
+	if _, err := q.ExecContext(ctx, d.CreateCheckpointTableSQL(m.sql.checkpointTable)); err != nil {
+		return m.logErrorf("Failed to initialize %s table: %w", m.sql.checkpointTable, err)
+	}
+	if _, err := q.ExecContext(ctx, d.SaveCheckpointSQL(m.sql.checkpointTable), version, checkpoint); err != nil {
+		return m.logErrorf("Failed to save checkpoint for version %d: %w", version, err)
+	}
+	return nil
+}
+
+// LoadCheckpoint returns the checkpoint saved for version, with ok false if
+// the step starts from scratch.
+func (m *Migrator) LoadCheckpoint(ctx context.Context, q Queryer, version int) (checkpoint string, ok bool, err error) {
+	d, err := m.checkpointDialect()
+	if err != nil {
+		return "", false, err
+	}
+	err = q.QueryRowContext(ctx, d.SelectCheckpointSQL(m.sql.checkpointTable), version).Scan(&checkpoint)
+	switch {
+	case errors.Is(err, sql.ErrNoRows), isUndefinedTable(err):
+		return "", false, nil
+	case err != nil:
+		return "", false, m.logErrorf("Failed to load checkpoint for version %d: %w", version, err)
+	}
+	return checkpoint, true, nil
+}
+
+// clearCheckpoint drops the checkpoint of a committed step so a later
+// re-run, e.g. after a downgrade, starts over. It is best-effort.
+func (m *Migrator) clearCheckpoint(ctx context.Context, conn *sql.Conn, version int) {
+	d, ok := m.stateDialect()
+	if !ok {
+		return
+	}
+	_, err := conn.ExecContext(ctx, d.DeleteCheckpointSQL(m.sql.checkpointTable), version)
+	if err != nil && !isUndefinedTable(err) {
+		m.warnf("Failed to clear checkpoint for version %d: %v", version, err)
+	}
+}
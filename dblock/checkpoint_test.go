@@ -0,0 +1,131 @@
+package dblock_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"dblock/dblock"
+)
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	m := s.Migrator()
+
+	if _, ok, err := m.LoadCheckpoint(ctx, s.DB, 7); err != nil || ok {
+		t.Fatalf("LoadCheckpoint before any save = %v, %v, want not ok", ok, err)
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SaveCheckpoint(ctx, tx, 7, "1000"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := s.DB.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := m.SaveCheckpoint(ctx, conn, 7, "2000"); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint, ok, err := m.LoadCheckpoint(ctx, conn, 7)
+	if err != nil || !ok || checkpoint != "2000" {
+		t.Errorf("LoadCheckpoint = %q, %v, %v, want 2000", checkpoint, ok, err)
+	}
+}
+
+func TestBackfillResumesFromCheckpoint(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	if _, err := s.DB.ExecContext(ctx, "CREATE TABLE users (id INTEGER, visits INTEGER NOT NULL DEFAULT 0); INSERT INTO users SELECT generate_series(1, 100)"); err != nil {
+		t.Fatal(err)
+	}
+
+	m := s.Migrator()
+	errCrash := errors.New("killed")
+	crashAfter := 50
+	var resumedFrom []int
+	backfill := func(ctx context.Context, conn *sql.Conn) error {
+		last := 0
+		if checkpoint, ok, err := m.LoadCheckpoint(ctx, conn, 1); err != nil {
+			return err
+		} else if ok {
+			if last, err = strconv.Atoi(checkpoint); err != nil {
+				return err
+			}
+		}
+		resumedFrom = append(resumedFrom, last)
+		for ; last < 100; last += 10 {
+			if last == crashAfter {
+				return errCrash
+			}
+			tx, err := conn.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, "UPDATE users SET visits = visits + 1 WHERE id > $1 AND id <= $1 + 10", last); err != nil {
+				tx.Rollback()
+				return err
+			}
+			if err := m.SaveCheckpoint(ctx, tx, 1, strconv.Itoa(last+10)); err != nil {
+				tx.Rollback()
+				return err
+			}
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	steps := dblock.Migrations{{Version: 1, NoTx: backfill}}
+	if _, err := m.UpgradeSteps(ctx, steps, time.Minute); !errors.Is(err, errCrash) {
+		t.Fatalf("first attempt = %v, want %v", err, errCrash)
+	}
+	crashAfter = -1
+	if _, err := m.UpgradeSteps(ctx, steps, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(resumedFrom) != "[0 50]" {
+		t.Errorf("attempts started at %v, want [0 50]", resumedFrom)
+	}
+	var wrong int
+	if err := s.DB.QueryRowContext(ctx, "SELECT count(*) FROM users WHERE visits <> 1").Scan(&wrong); err != nil || wrong != 0 {
+		t.Errorf("%d rows not backfilled exactly once, %v", wrong, err)
+	}
+	if _, ok, err := m.LoadCheckpoint(ctx, s.DB, 1); err != nil || ok {
+		t.Errorf("checkpoint left after the step committed: %v, %v", ok, err)
+	}
+}
+
+func TestCheckpointsArePerVersionTable(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	cfg := s.Config
+	cfg.VersionTable = s.Schema + ".other_version"
+	other := dblock.New(s.DB, cfg)
+
+	if err := s.Migrator().SaveCheckpoint(ctx, s.DB, 1, "50"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := other.LoadCheckpoint(ctx, s.DB, 1); err != nil || ok {
+		t.Errorf("LoadCheckpoint of another version table = %v, %v, want not ok", ok, err)
+	}
+	var exists bool
+	err := s.DB.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", s.Schema+".schema_version_checkpoint").Scan(&exists)
+	if err != nil || !exists {
+		t.Errorf("checkpoint not kept next to the version table: %v, %v", exists, err)
+	}
+}
@@ -0,0 +1,34 @@
+package dblock
+
+import "fmt"
+
+// EnsureDatabase creates the database dbName if it doesn't exist yet, for
+// bootstrapping dev and CI environments, and reports whether it did.
+// adminDSN must point at a database that exists, such as postgres, as a
+// user allowed to CREATE DATABASE. This is never done implicitly: call it
+// before connecting to dbName.
+func EnsureDatabase(driverName, adminDSN, dbName string) (bool, error) {
+	db, err := Connect(driverName, adminDSN)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", dbName).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to look up database %s: %w", dbName, err)
+	}
+	if exists {
+		return false, nil
+	}
+
+	// CREATE DATABASE takes no parameters and can't run in a transaction.
+	if _, err := db.Exec("CREATE DATABASE " + quoteIdentifier(dbName)); err != nil {
+		if sqlState(err) == "42P04" {
+			// Created concurrently by someone else.
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to create database %s: %w", dbName, err)
+	}
+	return true, nil
+}
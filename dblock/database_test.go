@@ -0,0 +1,42 @@
+package dblock_test
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+
+	"dblock/dblock"
+)
+
+func TestEnsureDatabase(t *testing.T) {
+	dsn := os.Getenv("DBLOCK_TEST_DSN")
+	if dsn == "" {
+		t.Skip("DBLOCK_TEST_DSN not set")
+	}
+	name := fmt.Sprintf("dblock_test_%d", rand.Int63())
+	t.Cleanup(func() {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return
+		}
+		defer db.Close()
+		db.Exec(`DROP DATABASE IF EXISTS "` + name + `"`)
+	})
+
+	created, err := dblock.EnsureDatabase("postgres", dsn, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Fatal("created = false for a missing database")
+	}
+	created, err = dblock.EnsureDatabase("postgres", dsn, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Fatal("created = true for an existing database")
+	}
+}
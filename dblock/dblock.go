@@ -1,9 +1,14 @@
 package dblock
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"runtime/debug"
+	"sort"
 	"time"
 )
 
@@ -12,135 +17,1518 @@ const (
 	checkInterval = 5 * time.Second
 )
 
+type Config struct {
+	// CommentOnDatabase sets COMMENT ON DATABASE to 'schema_version=N' after
+	// every successful upgrade so the version is visible from psql's \l+.
+	CommentOnDatabase bool
+
+	// MigrationRole, if set, is assumed with SET ROLE on the lock connection
+	// for the duration of the upgrade transaction and reset afterwards, so
+	// objects created by upgradeFunc are owned by it. The role needs UPDATE
+	// on schema_version.
+	MigrationRole string
+
+	// InitialVersion is the version schema_version is seeded with when it
+	// is first created, for adopting a database whose schema already matches
+	// that version. It never overrides an existing row.
+	InitialVersion int
+
+	// VersionZeroApplied is for schemes where version 0 is a real
+	// migration. A new version table is then seeded with Uninitialized
+	// instead of InitialVersion, so a step with Version 0 runs, and
+	// CurrentVersion reports Uninitialized until the first step is applied.
+	VersionZeroApplied bool
+
+	// OnBatchStart and OnBatchEnd run once around all steps of an upgrade,
+	// only on the instance that holds the lock and only if there is work to
+	// do, e.g. to put the application into maintenance mode. OnBatchEnd also
+	// runs if a step failed.
+	OnBatchStart func()
+	OnBatchEnd   func(result Result, err error)
+
+	// Isolation is the isolation level of the upgrade transactions.
+	Isolation sql.IsolationLevel
+
+	// MaxRetries is how often an upgrade transaction is re-run from the
+	// start, upgradeFunc included, after a serialization failure (40001) or
+	// deadlock (40P01). Other errors are never retried.
+	MaxRetries int
+
+	// SkipPostLockCheck skips re-reading the version after taking the lock.
+	// WARNING: this is only safe if something outside dblock guarantees that
+	// a single migrator ever runs, e.g. a unique Job. Otherwise an instance
+	// that lost the race re-applies an upgrade that has already committed.
+	SkipPostLockCheck bool
+
+	// RequireEmptyOnInit refuses to create schema_version in a schema that
+	// already has other tables, to catch pointing dblock at the wrong
+	// database. It fails with ErrNotEmpty.
+	RequireEmptyOnInit bool
+
+	// VersionTable and VersionColumn name the table holding the schema
+	// version and its column. VersionTable may be schema-qualified. They
+	// default to schema_version and version.
+	VersionTable  string
+	VersionColumn string
+
+	// Dialect builds the version table SQL, and that of the tables next to
+	// it if it implements StateDialect. It defaults to Postgres.
+	Dialect Dialect
+
+	// LockBase is added to the target version to form the advisory lock key.
+	// All instances sharing a version table must agree on it, and separate
+	// version tables in one database need bases far enough apart not to
+	// overlap. It defaults to 6877.
+	LockBase int
+
+	// ErrorOnNoOp makes an upgrade fail with ErrNoMigrationNeeded if the
+	// schema is already at or past the target, for callers that expect to
+	// always migrate. Upgrades completed by another instance still succeed.
+	ErrorOnNoOp bool
+
+	// ErrorOnSchemaAhead makes an upgrade fail with ErrSchemaAhead if, once
+	// it holds the lock, it finds that another instance took the schema
+	// past the target, meaning this instance's code is older than the
+	// schema. Otherwise that is only a warning.
+	ErrorOnSchemaAhead bool
+
+	// LogLevel is the minimum level logged, LogInfo by default. At LogError
+	// steady-state messages like "No upgrade needed" are suppressed.
+	LogLevel LogLevel
+
+	// Silent turns off all logging, as LogLevel LogSilent does, for
+	// embedders that rely on Events and returned errors instead.
+	Silent bool
+
+	// Logger receives the log lines, slog.Default() if nil. During an
+	// upgrade every line carries target_version, lock_key and instance.
+	Logger *slog.Logger
+
+	// LockFirst takes the advisory lock before reading the version, so that
+	// creating the version table and every read happen under the lock. This
+	// avoids a cold-start stampede of unlocked DDL at the cost of a lock
+	// round trip on every start.
+	LockFirst bool
+
+	// SessionSetup runs on the lock connection before any step, e.g. to
+	// SET maintenance_work_mem for index builds. The connection is closed
+	// afterwards so the settings don't outlive the upgrade.
+	SessionSetup func(ctx context.Context, conn *sql.Conn) error
+
+	// History records every applied step in <VersionTable>_history, in the
+	// same transaction as the version bump. Upgrades then refuse to run with
+	// ErrInconsistentState if the version and the history disagree.
+	// UpgradeGraph has no versions and records the instance and Metadata
+	// with each node in <VersionTable>_applied instead.
+	History bool
+
+	// StrictHistory makes failing to write the history fatal. By default a
+	// missing or unwritable history table only logs a warning, as the
+	// history is supplementary to the version, and a history left behind
+	// the version that way isn't taken for ErrInconsistentState.
+	StrictHistory bool
+
+	// Metadata is stored with every history entry, e.g. the git SHA and
+	// deploy ID, to tie migrations to deploys.
+	Metadata map[string]string
+
+	// Events, if set, receives an Event for every stage of an upgrade, for
+	// progress UIs. Sends never block; events that don't fit in the buffer
+	// are dropped, so give the channel room.
+	Events chan<- Event
+
+	// InstanceID names this process in the history table and in the
+	// default ApplicationName, so it is easy to see which pod ran or is
+	// running a migration. It defaults to "<hostname>-<pid>".
+	InstanceID func() string
+
+	// ApplicationName is set as application_name on the lock connection
+	// while dblock uses it. It defaults to "dblock-migrator <InstanceID>".
+	ApplicationName string
+
+	// ShouldUpgrade, if set, replaces the current < target rule for
+	// whether an upgrade runs, e.g. to always re-run a repeatable step. It is
+	// asked before and after taking the lock. Invalid versions are rejected
+	// before it is called.
+	ShouldUpgrade func(current, target int) (bool, error)
+
+	// OnNotice receives the notices the server sends while steps run, such
+	// as RAISE NOTICE output. It needs a Dialect implementing
+	// NoticeCapturer; Postgres does for lib/pq.
+	OnNotice func(notice string)
+
+	// PostStepVerify checks a step's post-conditions, e.g. that a new
+	// column is populated, in the step's transaction after Up and before the
+	// commit. An error rolls the whole step back.
+	PostStepVerify func(tx *sql.Tx, version int) error
+
+	// RunToken identifies one logical run, e.g. a deploy job, across
+	// retries. Versions applied under it are recorded in the version table's
+	// _run table, and a later call with the same token that finds the target
+	// reached reports Result.SameRun instead of treating it as a no-op.
+	RunToken string
+
+	// ProbeAdvisoryLocks checks that advisory locks work before every
+	// upgrade, see Migrator.ProbeAdvisoryLocks.
+	ProbeAdvisoryLocks bool
+
+	// SkipEngineCheck skips asserting that the server is PostgreSQL before
+	// an upgrade when using the Postgres dialect.
+	SkipEngineCheck bool
+
+	// AllowedWindow, if set, is asked before any step runs; when it returns
+	// false the upgrade fails with ErrOutsideMaintenanceWindow. See
+	// DailyWindow.
+	AllowedWindow func(now time.Time) bool
+
+	// Now is the clock for AllowedWindow and for timing waits, time.Now by
+	// default.
+	Now func() time.Time
+
+	// OnWait is called on every poll while waiting for another instance,
+	// e.g. to touch a liveness file proving the migrator isn't hung.
+	OnWait func(elapsed, remaining time.Duration)
+
+	// AutoAnalyze runs ANALYZE on AnalyzeTables, or the whole database if
+	// there are none, after an upgrade applied steps, while still holding
+	// the lock, so query plans don't degrade until autovacuum gets to it.
+	AutoAnalyze   bool
+	AnalyzeTables []string
+
+	// OnFirstInit is called when this instance seeded a new version table,
+	// e.g. to emit a "fresh database" event. It runs at most once per
+	// database, unless the version table is emptied.
+	OnFirstInit func()
+
+	// EnableFlag is called, still under the lock, after a step with a Flag
+	// committed, so the flag is never on before its schema exists. If it
+	// fails the upgrade fails, but the step stays applied.
+	EnableFlag func(ctx context.Context, flag string) error
+
+	// BeginTx, if set, starts the transactions steps run in instead of
+	// conn.BeginTx, e.g. for instrumented drivers. The transaction must be
+	// on conn, which holds the advisory lock.
+	BeginTx func(ctx context.Context, conn *sql.Conn, opts *sql.TxOptions) (*sql.Tx, error)
+
+	// BlockingTxAge, if set, makes every step fail with
+	// ErrBlockingTransactionPresent instead of queueing behind a transaction
+	// older than this that holds a lock on one of BlockingTxTables.
+	BlockingTxAge    time.Duration
+	BlockingTxTables []string
+
+	// MaxKnownVersion, if set, is the highest version this binary has
+	// migrations for, usually Migrations.Latest(). Upgrades to a higher
+	// target fail with ErrUnknownTargetVersion.
+	MaxKnownVersion int
+
+	// ExactVersion turns upgrades into a check for the app side of a
+	// migrator/app split: nothing is locked or applied, and the upgrade
+	// fails with ErrVersionMismatch unless the schema is exactly at the
+	// target version.
+	ExactVersion bool
+
+	// ReadyTimeout, if set, is how long an upgrade keeps retrying with
+	// backoff while the database refuses connections or is still starting
+	// up, before it first reads the version.
+	ReadyTimeout time.Duration
+
+	// LockPriority favors designated migrators when instances contend
+	// for the lock. PriorityHeadStart is how long PriorityLow holds back
+	// and PriorityHigh keeps retrying, 2s by default.
+	LockPriority      LockPriority
+	PriorityHeadStart time.Duration
+
+	// SmokeQuery, if set, is run after a successful upgrade, still under
+	// the lock but on a pool connection without MigrationRole and
+	// SessionSetup, to check that the application can use the new schema,
+	// e.g. "SELECT id FROM users LIMIT 1". If it fails the upgrade returns
+	// ErrPostMigrationSmokeFailed; the steps stay committed.
+	SmokeQuery string
+
+	// NonTransactionalInit creates and seeds the version table with two
+	// separate statements instead of in one transaction. Dialects without
+	// transactional DDL, like MySQL, where CREATE TABLE commits implicitly,
+	// always do.
+	NonTransactionalInit bool
+
+	// DesiredColumn is the column UpgradeToDesired reads the target from,
+	// "version" by default.
+	DesiredColumn string
+
+	// ExplainDML runs steps whose SQL is a single INSERT, UPDATE, DELETE
+	// or MERGE under EXPLAIN (ANALYZE, BUFFERS) and logs the plan, also
+	// sending it as a StepExplained event. ANALYZE still executes the
+	// statement, but the extra work and output are meant for staging.
+	ExplainDML bool
+
+	// ConnAcquireTimeout bounds waiting for the dedicated connection when
+	// the pool is exhausted, failing with ErrConnAcquireTimeout. Zero waits
+	// as long as the context allows.
+	ConnAcquireTimeout time.Duration
+
+	// NoLock skips locking and waiting altogether, for deployments that
+	// already guarantee a single migrator, such as a Kubernetes Job with
+	// parallelism 1. Keeping concurrent migrators out is then entirely up to
+	// the caller.
+	NoLock bool
+
+	// SharedLockKey, if non-zero, is an advisory lock key taken in addition
+	// to dblock's own, e.g. the one another migration tool uses, so that
+	// both tools serialize against each other during a transition. It is
+	// not used with a Locker.
+	SharedLockKey int
+
+	// Locker, if set, replaces the advisory lock with external
+	// coordination. The key passed to it is the advisory lock key.
+	Locker Locker
+
+	// LockGranularity selects how UpgradeSteps locks, LockBatch by default.
+	LockGranularity LockGranularity
+}
+
+type LockGranularity int
+
+const (
+	// LockBatch holds the lock for the final target version across all
+	// pending steps. A long catch-up blocks every other instance until it
+	// is done, but nobody else sees the schema half-way.
+	LockBatch LockGranularity = iota
+
+	// LockPerStep takes the lock for each step's own version and releases
+	// it between steps. Instances waiting for an early version can go on as
+	// soon as it is reached, and another instance may pick up later steps,
+	// but each step pays a lock round trip and a version re-check.
+	LockPerStep
+)
+
+// Queryer is what *sql.DB, *sql.Tx and *sql.Conn have in common.
+type Queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type Migrator struct {
+	db         *sql.DB
+	cfg        Config
+	sql        versionSQL
+	instanceID string
+	logger     *slog.Logger
+
+	// report, if set, collects events for UpgradeStepsReport.
+	report *Report
+}
+
+func New(db *sql.DB, cfg Config) *Migrator {
+	if cfg.LockBase == 0 {
+		cfg.LockBase = baseLockID
+	}
+	if cfg.Silent {
+		cfg.LogLevel = LogSilent
+	}
+	if cfg.VersionZeroApplied {
+		cfg.InitialVersion = Uninitialized
+	}
+	if cfg.InstanceID == nil {
+		cfg.InstanceID = defaultInstanceID
+	}
+	instanceID := cfg.InstanceID()
+	if cfg.ApplicationName == "" {
+		cfg.ApplicationName = "dblock-migrator " + instanceID
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Migrator{db: db, cfg: cfg, sql: newVersionSQL(cfg), instanceID: instanceID, logger: logger}
+}
+
+// UpgradeIfNeeded upgrades the schema to targetVersion with upgradeFunc unless
+// it is already there. A nil upgradeFunc only bumps the version.
+//
+// upgradeFunc runs at most once per database and target version, across
+// crashes and retries: it runs under the advisory lock only after re-reading
+// the version, and in the same transaction as the version bump, so either
+// both commit or neither does. A caller that crashed or lost the connection
+// after the commit can simply call again and gets a no-op. The guarantee
+// covers only what upgradeFunc does through its transaction; side effects
+// outside it, NoTx steps and Config.NoLock are at-least-once.
 func UpgradeIfNeeded(db *sql.DB, targetVersion int, upgradeFunc func(*sql.Tx) error, timeout time.Duration) error {
-	currentVersion, err := getSchemaVersion(db)
+	_, err := New(db, Config{}).Upgrade(context.Background(), targetVersion, upgradeFunc, timeout)
+	return err
+}
+
+func WaitForSchemaVersion(db *sql.DB, targetVersion int, timeout time.Duration) error {
+	return New(db, Config{}).WaitForSchemaVersion(context.Background(), targetVersion, timeout)
+}
+
+func UpgradeIfNeededSteps(db *sql.DB, migrations Migrations, timeout time.Duration) error {
+	_, err := New(db, Config{}).UpgradeSteps(context.Background(), migrations, timeout)
+	return err
+}
+
+// UpgradeToLatest applies all pending migrations, taking the target from the
+// migrations themselves (migrations.Latest()) so it can't drift from them.
+func UpgradeToLatest(db *sql.DB, migrations Migrations, timeout time.Duration) error {
+	return UpgradeIfNeededSteps(db, migrations, timeout)
+}
+
+// Result describes the outcome of an upgrade call.
+type Result struct {
+	// From is the version found before upgrading, To the version reached.
+	From, To int
+
+	// Upgraded is true if this instance applied at least one step, as
+	// opposed to finding the schema current or waiting for another instance.
+	Upgraded bool
+
+	// SameRun is true if nothing was left to do because an earlier call
+	// with the same RunToken already reached the target.
+	SameRun bool
+
+	// Applied, Skipped and Remaining account for every registered step of
+	// UpgradeSteps, by ascending version: applied by this call, not run by
+	// it and why, or not reached because the run stopped or failed.
+	Applied   []int
+	Skipped   []SkippedStep
+	Remaining []int
+}
+
+// SkippedStep is a step UpgradeSteps didn't run.
+type SkippedStep struct {
+	Version int
+	Reason  string
+}
+
+// Reasons for skipping a step.
+const (
+	SkipAlreadyApplied   = "already applied"
+	SkipAppliedElsewhere = "applied by another instance"
+	SkipDeclined         = "declined by ShouldUpgrade"
+)
+
+// account sorts mig into Applied, Skipped or Remaining given the versions
+// found (from) and reached (to) around it.
+func (r *Result) account(mig Migration, applied bool, from, to int) {
+	switch {
+	case applied:
+		r.Applied = append(r.Applied, mig.Version)
+	case mig.Version <= from:
+		r.Skipped = append(r.Skipped, SkippedStep{Version: mig.Version, Reason: SkipAlreadyApplied})
+	case mig.Version <= to:
+		r.Skipped = append(r.Skipped, SkippedStep{Version: mig.Version, Reason: SkipAppliedElsewhere})
+	default:
+		r.Remaining = append(r.Remaining, mig.Version)
+	}
+}
+
+func (m *Migrator) Upgrade(ctx context.Context, targetVersion int, upgradeFunc func(*sql.Tx) error, timeout time.Duration) (Result, error) {
+	m = m.withUpgradeAttrs(targetVersion)
+	return m.upgrade(ctx, targetVersion, timeout, func(conn *sql.Conn, currentVersion int) (int, error) {
+		m.infof("Upgrading schema to version %d...", targetVersion)
+		mig := Migration{Version: targetVersion, Up: upgradeFunc, rerun: currentVersion >= targetVersion}
+		err := m.applyStep(ctx, conn, mig)
+		if err != nil && !errors.Is(err, ErrStopMigration) && !errors.Is(err, errStepAlreadyApplied) {
+			return currentVersion, err
+		}
+		return max(currentVersion, targetVersion), nil
+	})
+}
+
+// UpgradeSteps upgrades the schema to the highest registered version, applying
+// every step above the current version in its own transaction.
+func (m *Migrator) UpgradeSteps(ctx context.Context, migrations Migrations, timeout time.Duration) (Result, error) {
+	sorted, err := migrations.sorted(m.minVersion())
 	if err != nil {
-		return err
+		return Result{}, err
+	}
+	if len(sorted) == 0 {
+		return Result{}, nil
 	}
 
-	if currentVersion >= targetVersion {
-		log.Printf("No upgrade needed. Current version: %d\n", currentVersion)
-		return nil
+	// ExactVersion checks once against the latest step, never per step, so
+	// it always takes the batch path.
+	if m.cfg.LockGranularity == LockPerStep && !m.cfg.ExactVersion {
+		return m.upgradePerStep(ctx, sorted, timeout)
+	}
+
+	targetVersion := sorted.Latest()
+	m = m.withUpgradeAttrs(targetVersion)
+	applied := make(map[int]bool)
+	res, err := m.upgrade(ctx, targetVersion, timeout, func(conn *sql.Conn, currentVersion int) (int, error) {
+		// At or past the target, ShouldUpgrade asked to re-run the last step.
+		rerun := currentVersion >= targetVersion
+		reached := currentVersion
+		for _, mig := range sorted {
+			if rerun && mig.Version == targetVersion {
+				mig.rerun = true
+			} else if mig.Version <= currentVersion {
+				continue
+			}
+			m.infof("Upgrading schema to version %d...", mig.Version)
+			err := m.applyStep(ctx, conn, mig)
+			switch {
+			case errors.Is(err, errStepAlreadyApplied):
+				reached = max(reached, mig.Version)
+				continue
+			case errors.Is(err, ErrStopMigration):
+				applied[mig.Version] = true
+				return max(reached, mig.Version), nil
+			case err != nil:
+				return reached, err
+			}
+			applied[mig.Version] = true
+			reached = max(reached, mig.Version)
+		}
+		return reached, nil
+	})
+	// Nothing done and no error while behind means ShouldUpgrade said no.
+	declined := (err == nil || errors.Is(err, ErrNoMigrationNeeded)) && !res.Upgraded && res.From == res.To
+	for _, mig := range sorted {
+		if declined && mig.Version > res.To {
+			res.Skipped = append(res.Skipped, SkippedStep{Version: mig.Version, Reason: SkipDeclined})
+			continue
+		}
+		res.account(mig, applied[mig.Version], res.From, res.To)
 	}
+	return res, err
+}
 
-	lockID := baseLockID + targetVersion
+func (m *Migrator) shouldUpgrade(current, target int) (bool, error) {
+	if current == Uninitialized && m.cfg.VersionZeroApplied {
+		// Validate target alone; anything is ahead of nothing.
+		if _, err := ShouldUpgrade(0, target); err != nil {
+			return false, err
+		}
+		if m.cfg.ShouldUpgrade == nil {
+			return true, nil
+		}
+		return m.cfg.ShouldUpgrade(current, target)
+	}
+	needed, err := ShouldUpgrade(current, target)
+	if err != nil || m.cfg.ShouldUpgrade == nil {
+		return needed, err
+	}
+	return m.cfg.ShouldUpgrade(current, target)
+}
 
-	if err := acquireAdvisoryLock(db, lockID); err != nil {
-		log.Println("Another instance is handling the upgrade.")
+func (m *Migrator) minVersion() int {
+	if m.cfg.VersionZeroApplied {
+		return 0
+	}
+	return 1
+}
 
-		if err := WaitForSchemaVersion(db, targetVersion, timeout); err != nil {
-			return err
+// withUpgradeAttrs returns a copy of m whose log lines are tagged with the
+// upgrade to targetVersion. Callers apply it before building the apply
+// closure, so the steps are logged with the tags too.
+func (m *Migrator) withUpgradeAttrs(targetVersion int) *Migrator {
+	mm := *m
+	mm.logger = m.logger.With("target_version", targetVersion, "instance", m.instanceID)
+	if lockID, err := lockIDFor(m.cfg.LockBase, targetVersion); err == nil {
+		mm.logger = mm.logger.With("lock_key", lockID)
+	}
+	return &mm
+}
+
+// upgradePerStep runs every step under the lock for its own version. The
+// batch hooks run around the steps this instance applies, the post-upgrade
+// actions and events once at the end.
+func (m *Migrator) upgradePerStep(ctx context.Context, sorted Migrations, timeout time.Duration) (Result, error) {
+	started := false
+	res, err := m.upgradeSteps(ctx, sorted, timeout, &started)
+	if started {
+		if m.cfg.OnBatchEnd != nil {
+			m.cfg.OnBatchEnd(res, err)
 		}
-		return nil
+		if err == nil {
+			err = m.withUpgradeAttrs(res.To).postUpgradeLocked(ctx, res, sorted.Latest())
+		}
+	}
+	m.finish(res, err)
+	return res, err
+}
+
+// upgradeSteps applies sorted one lock at a time. started is set once the
+// first step is about to be applied, right after OnBatchStart.
+func (m *Migrator) upgradeSteps(ctx context.Context, sorted Migrations, timeout time.Duration, started *bool) (Result, error) {
+	var (
+		total     Result
+		noOps     int
+		noOpError error
+	)
+	stopped := false
+	// remaining accounts for the steps after i once the run ends early.
+	remaining := func(i int) {
+		for _, mig := range sorted[i+1:] {
+			total.Remaining = append(total.Remaining, mig.Version)
+		}
+	}
+	for i, mig := range sorted {
+		m := m.withUpgradeAttrs(mig.Version)
+		applied := false
+		res, err := m.upgradeOnce(ctx, mig.Version, timeout, false, func(conn *sql.Conn, currentVersion int) (int, error) {
+			if !*started {
+				*started = true
+				if m.cfg.OnBatchStart != nil {
+					m.cfg.OnBatchStart()
+				}
+			}
+			m.infof("Upgrading schema to version %d...", mig.Version)
+			mig.rerun = currentVersion >= mig.Version
+			err := m.applyStep(ctx, conn, mig)
+			stopped = errors.Is(err, ErrStopMigration)
+			if errors.Is(err, errStepAlreadyApplied) {
+				return max(currentVersion, mig.Version), nil
+			}
+			if err != nil && !stopped {
+				return currentVersion, err
+			}
+			applied = true
+			return max(currentVersion, mig.Version), nil
+		})
+		if i == 0 {
+			total.From = res.From
+		}
+		total.To = res.To
+		total.Upgraded = total.Upgraded || res.Upgraded
+		if err == nil || errors.Is(err, ErrNoMigrationNeeded) {
+			if !applied && res.To < mig.Version {
+				total.Skipped = append(total.Skipped, SkippedStep{Version: mig.Version, Reason: SkipDeclined})
+			} else {
+				total.account(mig, applied, res.From, res.To)
+			}
+		}
+		switch {
+		case errors.Is(err, ErrNoMigrationNeeded):
+			noOps++
+			noOpError = err
+		case err != nil:
+			total.Remaining = append(total.Remaining, mig.Version)
+			remaining(i)
+			return total, err
+		}
+		if stopped {
+			remaining(i)
+			return total, nil
+		}
+	}
+	// With ErrorOnNoOp, only fail if there was nothing at all to do.
+	if noOps == len(sorted) {
+		return total, noOpError
+	}
+	return total, nil
+}
+
+// upgrade runs apply under the advisory lock for targetVersion once it is
+// sure the schema still needs upgrading. apply gets the lock connection and
+// the version read after taking the lock, and returns the version it reached.
+// The batch hooks and post-upgrade actions run around apply.
+func (m *Migrator) upgrade(ctx context.Context, targetVersion int, timeout time.Duration, apply func(conn *sql.Conn, currentVersion int) (int, error)) (Result, error) {
+	res, err := m.upgradeOnce(ctx, targetVersion, timeout, true, apply)
+	m.finish(res, err)
+	return res, err
+}
+
+// upgradeOnce is upgrade without reporting the outcome. whole is false for
+// the steps of a LockPerStep run, which runs the batch hooks and
+// post-upgrade actions once around all of them itself.
+func (m *Migrator) upgradeOnce(ctx context.Context, targetVersion int, timeout time.Duration, whole bool, apply func(conn *sql.Conn, currentVersion int) (int, error)) (Result, error) {
+	if m.cfg.MaxKnownVersion > 0 && targetVersion > m.cfg.MaxKnownVersion {
+		return Result{}, m.logErrorf("%w: target %d, latest known %d", ErrUnknownTargetVersion, targetVersion, m.cfg.MaxKnownVersion)
+	}
+	return m.runUpgrade(ctx, targetVersion, timeout, whole, apply)
+}
+
+// finish reports the outcome of an upgrade call, once per call.
+func (m *Migrator) finish(res Result, err error) {
+	recordExpvar(res, err)
+	if err != nil {
+		m.emit(Failed{Err: err})
+	} else {
+		m.emit(Completed{Result: res})
+	}
+}
+
+func (m *Migrator) runUpgrade(ctx context.Context, targetVersion int, timeout time.Duration, whole bool, apply func(conn *sql.Conn, currentVersion int) (int, error)) (Result, error) {
+	var res Result
+	if err := m.waitReady(ctx); err != nil {
+		return res, err
+	}
+	if err := m.checkEngine(ctx, m.db); err != nil {
+		return res, err
+	}
+	if m.cfg.ExactVersion {
+		return m.checkExactVersion(ctx, targetVersion)
+	}
+	if m.cfg.ProbeAdvisoryLocks && m.cfg.Locker == nil && !m.cfg.NoLock {
+		if err := m.ProbeAdvisoryLocks(ctx); err != nil {
+			return res, err
+		}
+	}
+	if !m.cfg.LockFirst {
+		currentVersion, err := m.getSchemaVersion(ctx, m.db)
+		if err != nil {
+			return res, err
+		}
+		res = Result{From: currentVersion, To: currentVersion}
+		if err := m.checkConsistency(ctx, m.db, currentVersion); err != nil {
+			return res, err
+		}
+
+		needed, err := m.shouldUpgrade(currentVersion, targetVersion)
+		if err != nil {
+			return res, &VersionError{Op: "upgrade", Current: currentVersion, Target: targetVersion, Err: err}
+		}
+		if !needed {
+			if res.SameRun = m.appliedByRun(ctx, m.db, targetVersion); res.SameRun {
+				return res, nil
+			}
+			m.infof("No upgrade needed. Current version: %d", currentVersion)
+			return res, m.noOp(currentVersion, targetVersion)
+		}
+	}
+
+	lockID, err := lockIDFor(m.cfg.LockBase, targetVersion)
+	if err != nil {
+		return res, err
 	}
+
+	m.checkPool()
+
+	// Session-level advisory locks belong to a single backend, so the lock,
+	// the upgrade and the unlock must all run on the same connection.
+	conn, err := m.conn(ctx)
+	if err != nil {
+		return res, err
+	}
+	defer conn.Close()
+	if err := m.setApplicationName(ctx, conn); err != nil {
+		return res, err
+	}
+
+	m.emit(LockAttempt{LockID: lockID})
+	tookOver := false
+	release, err := m.acquirePrioritized(ctx, conn, lockID)
+	if err != nil {
+		m.infof("Another instance is handling the upgrade.")
+
+		// Give the connection back, waiting polls through the pool.
+		m.resetApplicationName(ctx, conn)
+		_ = conn.Close()
+		locked, err := m.waitForSchemaVersion(ctx, targetVersion, timeout, lockID)
+		if err != nil {
+			return res, err
+		}
+		if locked == nil {
+			res.To = targetVersion
+			return res, nil
+		}
+		conn, release = locked.conn, locked.release
+		defer conn.Close()
+		tookOver = true
+	}
+	m.emit(LockAcquired{LockID: lockID})
 	defer func() {
-		_ = releaseAdvisoryLock(db, lockID)
+		err := release()
+		if err == nil {
+			m.resetApplicationName(ctx, conn)
+		}
+		if err == nil && m.cfg.SessionSetup != nil {
+			// Don't let SessionSetup's settings leak into the pool.
+			discardConn(conn)
+		}
 	}()
 
-	// Double-check version after acquiring lock
-	latestVersion, err := getSchemaVersion(db)
+	latestVersion := res.To
+	if m.cfg.LockFirst || !m.cfg.SkipPostLockCheck || tookOver {
+		// Double-check version after acquiring lock
+		latestVersion, err = m.getSchemaVersion(ctx, conn)
+		if err != nil {
+			return res, err
+		}
+		if m.cfg.LockFirst {
+			if err := m.checkConsistency(ctx, conn, latestVersion); err != nil {
+				return res, err
+			}
+			res.From = latestVersion
+		}
+		res.To = latestVersion
+
+		if needed, err := m.shouldUpgrade(latestVersion, targetVersion); err != nil {
+			return res, &VersionError{Op: "upgrade", Current: latestVersion, Target: targetVersion, Err: err}
+		} else if !needed {
+			if res.SameRun = m.appliedByRun(ctx, conn, targetVersion); res.SameRun {
+				return res, nil
+			}
+			if m.cfg.LockFirst {
+				m.infof("No upgrade needed. Current version: %d", latestVersion)
+				return res, m.noOp(latestVersion, targetVersion)
+			}
+			if latestVersion > targetVersion {
+				// A newer migrator got there while we waited for the lock.
+				m.warnf("Another instance upgraded the schema to %d, past our target %d.", latestVersion, targetVersion)
+				if m.cfg.ErrorOnSchemaAhead {
+					return res, &VersionError{Op: "upgrade", Current: latestVersion, Target: targetVersion, Err: ErrSchemaAhead}
+				}
+				return res, nil
+			}
+			m.infof("Another instance already upgraded the schema.")
+			return res, nil
+		}
+		res.From = latestVersion
+	}
+
+	if err := m.checkWindow(res.From, targetVersion); err != nil {
+		return res, err
+	}
+
+	if err := m.clearFailure(ctx, conn, targetVersion); err != nil {
+		return res, err
+	}
+	if err := m.checkIntent(ctx, conn); err != nil {
+		return res, err
+	}
+	if err := m.ensureRunTable(ctx, conn); err != nil {
+		return res, err
+	}
+
+	if m.cfg.History {
+		if err := m.ensureHistoryTable(ctx, conn); err != nil && (m.cfg.StrictHistory || !isHistoryUnavailable(err)) {
+			return res, err
+		}
+	}
+
+	if m.cfg.SessionSetup != nil {
+		if err := m.cfg.SessionSetup(ctx, conn); err != nil {
+			return res, m.logErrorf("Failed to set up session: %w", err)
+		}
+	}
+
+	defer m.captureNotices(conn)()
+
+	roleSet := false
+	if m.cfg.MigrationRole != "" {
+		if err := m.setRole(ctx, conn); err != nil {
+			return res, err
+		}
+		roleSet = true
+		defer func() {
+			if roleSet {
+				m.resetRole(ctx, conn)
+			}
+		}()
+	}
+
+	if whole && m.cfg.OnBatchStart != nil {
+		m.cfg.OnBatchStart()
+	}
+	// Reaching apply at or past the target means ShouldUpgrade forced a
+	// re-run, which counts as upgrading.
+	rerun := latestVersion >= targetVersion
+	res.To, err = apply(conn, latestVersion)
+	res.Upgraded = res.To > res.From || (rerun && err == nil)
+	if whole && m.cfg.OnBatchEnd != nil {
+		m.cfg.OnBatchEnd(res, err)
+	}
+	if err != nil {
+		m.recordFailure(ctx, conn, targetVersion, err)
+		return res, &VersionError{Op: "upgrade", Current: res.To, Target: targetVersion, Err: err}
+	}
+	if !whole {
+		return res, nil
+	}
+	// The post-upgrade actions run as the login role, not MigrationRole.
+	if roleSet {
+		m.resetRole(ctx, conn)
+		roleSet = false
+	}
+	return res, m.postUpgrade(ctx, conn, res, targetVersion)
+}
+
+// postUpgrade runs what follows a successful upgrade call on conn, which
+// holds the lock for res.To. The smoke query only runs once targetVersion
+// is reached, as it may use what the last steps create.
+func (m *Migrator) postUpgrade(ctx context.Context, conn *sql.Conn, res Result, targetVersion int) error {
+	switch {
+	case !res.Upgraded:
+	case res.To < targetVersion:
+		m.infof("Stopped at version %d before %d, not running the smoke query.", res.To, targetVersion)
+	default:
+		if err := m.smokeTest(ctx, conn, res.To); err != nil {
+			return err
+		}
+	}
+
+	m.infof("Upgrade complete.")
+	if m.cfg.AutoAnalyze && res.Upgraded {
+		m.analyze(ctx, conn)
+	}
+	if m.cfg.CommentOnDatabase {
+		m.commentOnDatabase(ctx, conn, res.To)
+	}
+	return nil
+}
+
+// postUpgradeLocked runs postUpgrade after a LockPerStep run, taking the
+// lock for the version reached again. If another instance holds it, that
+// instance is still upgrading and the actions are left to it.
+func (m *Migrator) postUpgradeLocked(ctx context.Context, res Result, targetVersion int) error {
+	lockID, err := lockIDFor(m.cfg.LockBase, res.To)
 	if err != nil {
 		return err
 	}
+	conn, err := m.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
 
-	if latestVersion >= targetVersion {
-		log.Println("Another instance already upgraded the schema.")
+	release, err := m.acquireLock(ctx, conn, lockID)
+	if errors.Is(err, ErrLockBusy) {
+		m.warnf("Lock %d is busy, skipping post-upgrade actions.", lockID)
 		return nil
 	}
-
-	log.Printf("Upgrading schema to version %d...\n", targetVersion)
-	if err := upgradeSchema(db, targetVersion, upgradeFunc); err != nil {
+	if err != nil {
 		return err
 	}
+	defer func() {
+		_ = release()
+	}()
+	return m.postUpgrade(ctx, conn, res, targetVersion)
+}
 
-	log.Println("Upgrade complete.")
+func (m *Migrator) noOp(currentVersion, targetVersion int) error {
+	if m.cfg.ErrorOnNoOp {
+		return &VersionError{Op: "upgrade", Current: currentVersion, Target: targetVersion, Err: ErrNoMigrationNeeded}
+	}
 	return nil
 }
 
-func getSchemaVersion(db *sql.DB) (int, error) {
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS schema_version (
-			version INTEGER NOT NULL DEFAULT 0
-		);
-		INSERT INTO schema_version (version) SELECT 0 WHERE NOT EXISTS (SELECT 1 FROM schema_version);
-	`)
+// EnsureVersionTable creates and seeds the version table if needed and
+// reports whether this call was the one that initialized it.
+func (m *Migrator) EnsureVersionTable(ctx context.Context) (created bool, err error) {
+	return m.ensureVersionTable(ctx, m.db)
+}
+
+// txBeginner is a *sql.DB or *sql.Conn, as opposed to a *sql.Tx.
+type txBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+func (m *Migrator) ensureVersionTable(ctx context.Context, q Queryer) (bool, error) {
+	var (
+		created bool
+		err     error
+	)
+	b, ok := q.(txBeginner)
+	if ok && m.transactionalDDL() && !m.cfg.NonTransactionalInit {
+		created, err = m.initVersionTableTx(ctx, b)
+	} else {
+		created, err = m.initVersionTable(ctx, q)
+	}
+	if err != nil || !created {
+		return false, err
+	}
+	m.infof("Initialized schema_version table at version %d", m.cfg.InitialVersion)
+	if m.cfg.OnFirstInit != nil {
+		m.cfg.OnFirstInit()
+	}
+	return true, nil
+}
+
+// initVersionTableTx creates and seeds the table in one transaction, so a
+// crash in between can't leave it empty.
+func (m *Migrator) initVersionTableTx(ctx context.Context, b txBeginner) (bool, error) {
+	tx, err := b.BeginTx(ctx, nil)
+	if err != nil {
+		return false, m.logErrorf("Failed to start transaction: %w", err)
+	}
+	created, err := m.initVersionTable(ctx, tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, m.logErrorf("Failed to commit schema_version initialization: %w", err)
+	}
+	return created, nil
+}
+
+func (m *Migrator) initVersionTable(ctx context.Context, q Queryer) (bool, error) {
+	if m.cfg.RequireEmptyOnInit {
+		if err := m.checkEmptyOnInit(ctx, q); err != nil {
+			return false, err
+		}
+	}
+
+	// Separate statements, as some drivers and protocol modes reject
+	// multi-statement strings.
+	if _, err := q.ExecContext(ctx, m.sql.createTable()); err != nil {
+		return false, m.logErrorf("Failed to create schema_version table: %w", err)
+	}
+	res, err := q.ExecContext(ctx, m.sql.seed())
 	if err != nil {
-		return 0, logErrorf("Failed to initialize schema_version table: %v", err)
+		return false, m.logErrorf("Failed to seed schema_version table: %w", err)
+	}
+	// The seed only inserts into an empty table.
+	n, err := res.RowsAffected()
+	return err == nil && n > 0, nil
+}
+
+func (m *Migrator) getSchemaVersion(ctx context.Context, q Queryer) (int, error) {
+	if _, err := m.ensureVersionTable(ctx, q); err != nil {
+		return 0, err
 	}
 
 	var version int
-	err = db.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	err := q.QueryRowContext(ctx, m.sql.selectVersion()).Scan(&version)
 	if err != nil {
-		return 0, logErrorf("Failed to get schema version: %v", err)
+		return 0, m.logErrorf("Failed to get schema version: %v", err)
+	}
+	m.debugf("Read schema version %d", version)
+
+	return version, nil
+}
+
+func (m *Migrator) applyStep(ctx context.Context, conn *sql.Conn, mig Migration) error {
+	m.emit(StepStarted{Version: mig.Version})
+	start := time.Now()
+
+	if err := m.checkPrerequisites(ctx, conn, mig); err != nil {
+		return err
+	}
+	if err := m.checkBlockingTransactions(ctx, conn, mig.Version); err != nil {
+		return err
+	}
+	if err := m.recordIntent(ctx, conn, mig.Version); err != nil {
+		return err
+	}
+	stop := false
+	if mig.ReadOnly && mig.Up != nil {
+		if err := m.runReadOnly(ctx, conn, mig); errors.Is(err, ErrStopMigration) {
+			stop = true
+		} else if err != nil {
+			m.recordFailedAttempt(ctx, conn, mig, err)
+			return err
+		}
+		mig.Up = nil
+	}
+	if mig.NoTx != nil {
+		if err := safeCall(func() error { return mig.NoTx(ctx, conn) }); errors.Is(err, ErrStopMigration) {
+			stop = true
+		} else if err != nil {
+			m.recordFailedAttempt(ctx, conn, mig, err)
+			return m.logErrorf("Failed to modify schema: %w", err)
+		}
 	}
+	if err := m.upgradeSchema(ctx, conn, mig); errors.Is(err, ErrStopMigration) {
+		stop = true
+	} else if errors.Is(err, errStepAlreadyApplied) {
+		if cerr := m.clearIntent(ctx, conn, mig.Version); cerr != nil {
+			return cerr
+		}
+		return err
+	} else if err != nil {
+		m.recordFailedAttempt(ctx, conn, mig, err)
+		return err
+	}
+	if err := m.clearIntent(ctx, conn, mig.Version); err != nil {
+		return err
+	}
+	if mig.NoTx != nil {
+		m.clearCheckpoint(ctx, conn, mig.Version)
+	}
+
+	m.emit(StepCommitted{Version: mig.Version, Duration: time.Since(start), NonTransactional: mig.NoTx != nil})
+	if mig.Flag != "" && m.cfg.EnableFlag != nil {
+		if err := m.cfg.EnableFlag(ctx, mig.Flag); err != nil {
+			return m.logErrorf("Version %d committed but enabling flag %s failed, enable it by hand: %w", mig.Version, mig.Flag, err)
+		}
+		m.infof("Enabled flag %s for version %d.", mig.Flag, mig.Version)
+	}
+	if stop {
+		m.infof("Version %d stopped the migration.", mig.Version)
+		return ErrStopMigration
+	}
+	return nil
+}
 
+// readSchemaVersion reads the version without creating the version table,
+// reporting InitialVersion, which it would be seeded with, while it doesn't
+// exist yet or is empty.
+func (m *Migrator) readSchemaVersion(ctx context.Context, q Queryer) (int, error) {
+	var version int
+	err := q.QueryRowContext(ctx, m.sql.selectVersion()).Scan(&version)
+	switch {
+	case isUndefinedTable(err), errors.Is(err, sql.ErrNoRows):
+		return m.cfg.InitialVersion, nil
+	case err != nil:
+		return 0, m.logErrorf("Failed to get schema version: %v", err)
+	}
+	m.debugf("Read schema version %d", version)
 	return version, nil
 }
 
-func upgradeSchema(db *sql.DB, newVersion int, upgradeFunc func(*sql.Tx) error) error {
-	tx, err := db.Begin()
+// upgradeSchema runs mig.Up, if any, and bumps the version in one
+// transaction.
+func (m *Migrator) upgradeSchema(ctx context.Context, conn *sql.Conn, mig Migration) error {
+	for attempt := 1; ; attempt++ {
+		err := m.upgradeSchemaOnce(ctx, conn, mig)
+		if err == nil || attempt > m.cfg.MaxRetries || !isRetryable(err) {
+			return err
+		}
+		m.infof("Retrying upgrade to version %d (attempt %d of %d)...", mig.Version, attempt, m.cfg.MaxRetries)
+	}
+}
+
+func (m *Migrator) beginTx(ctx context.Context, conn *sql.Conn, opts *sql.TxOptions) (*sql.Tx, error) {
+	if m.cfg.BeginTx != nil {
+		return m.cfg.BeginTx(ctx, conn, opts)
+	}
+	return conn.BeginTx(ctx, opts)
+}
+
+// runReadOnly runs a ReadOnly step's Up in a read-only transaction that is
+// always rolled back, since Up can't have changed anything anyway.
+func (m *Migrator) runReadOnly(ctx context.Context, conn *sql.Conn, mig Migration) error {
+	tx, err := m.beginTx(ctx, conn, &sql.TxOptions{Isolation: m.cfg.Isolation, ReadOnly: true})
+	if err != nil {
+		return m.logErrorf("Failed to start read-only transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if err := m.setDeferrable(ctx, tx, mig); err != nil {
+		return err
+	}
+	if err := m.setLocal(ctx, tx, mig.Settings); err != nil {
+		return err
+	}
+
+	err = safeCall(func() error { return mig.Up(tx) })
+	if err != nil && !errors.Is(err, ErrStopMigration) {
+		return m.logErrorf("Read-only step %d failed: %w", mig.Version, err)
+	}
+	return err
+}
+
+// setDeferrable must run before any other statement in tx.
+func (m *Migrator) setDeferrable(ctx context.Context, tx *sql.Tx, mig Migration) error {
+	if !mig.Deferrable {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, "SET TRANSACTION DEFERRABLE"); err != nil {
+		return m.logErrorf("Failed to make transaction deferrable: %w", err)
+	}
+	return nil
+}
+
+// setLocal applies settings for the rest of tx, in key order so failures
+// are reproducible.
+func (m *Migrator) setLocal(ctx context.Context, tx *sql.Tx, settings map[string]string) error {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := tx.ExecContext(ctx, "SELECT set_config($1, $2, true)", name, settings[name]); err != nil {
+			return m.logErrorf("Failed to set %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) upgradeSchemaOnce(ctx context.Context, conn *sql.Conn, mig Migration) error {
+	newVersion := mig.Version
+	tx, err := m.beginTx(ctx, conn, &sql.TxOptions{Isolation: m.cfg.Isolation})
 	if err != nil {
-		return logErrorf("Failed to start transaction: %w", err)
+		return m.logErrorf("Failed to start transaction: %w", err)
+	}
+	if err := m.setDeferrable(ctx, tx, mig); err != nil {
+		_ = tx.Rollback()
+		return err
 	}
 
-	if err := upgradeFunc(tx); err != nil {
+	// Last line of defense for at-most-once: if an earlier attempt committed
+	// but its caller never learned about it, don't run Up a second time.
+	if mig.Up != nil && !mig.rerun {
+		var version int
+		err := tx.QueryRowContext(ctx, m.sql.selectVersion()).Scan(&version)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			_ = tx.Rollback()
+			return m.logErrorf("Failed to get schema version: %w", err)
+		}
+		if err == nil && version >= newVersion {
+			_ = tx.Rollback()
+			m.infof("Schema is already at version %d, not applying version %d again.", version, newVersion)
+			return errStepAlreadyApplied
+		}
+	}
+
+	if err := m.setLocal(ctx, tx, mig.Settings); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	stop := false
+	if m.cfg.ExplainDML && isSingleDML(mig.SQL) && mig.Up != nil {
+		if err := m.explain(ctx, tx, mig); err != nil {
+			_ = tx.Rollback()
+			return m.logErrorf("Failed to modify schema: %w", err)
+		}
+		mig.Up = nil
+	}
+	if mig.Up != nil {
+		if err := safeCall(func() error { return mig.Up(tx) }); errors.Is(err, ErrStopMigration) {
+			stop = true
+		} else if err != nil {
+			_ = tx.Rollback()
+			return m.logErrorf("Failed to modify schema: %w", err)
+		}
+	}
+	if m.cfg.PostStepVerify != nil {
+		if err := safeCall(func() error { return m.cfg.PostStepVerify(tx, newVersion) }); err != nil {
+			_ = tx.Rollback()
+			return m.logErrorf("Verification of version %d failed: %w", newVersion, err)
+		}
+	}
+
+	// Up may have bumped the version itself; never move it backwards.
+	var version int
+	err = tx.QueryRowContext(ctx, m.sql.selectVersion()).Scan(&version)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		// The row vanished since we read it, e.g. the table was truncated.
+		// Committing without it would make the next run re-apply everything.
+		m.infof("schema_version is empty, inserting version %d.", newVersion)
+		if _, err := tx.ExecContext(ctx, m.sql.insertVersion(), newVersion); err != nil {
+			_ = tx.Rollback()
+			return m.logErrorf("Failed to insert schema version: %w", err)
+		}
+	case err != nil:
 		_ = tx.Rollback()
-		return logErrorf("Failed to modify schema: %w", err)
+		return m.logErrorf("Failed to get schema version: %w", err)
+	case version >= newVersion:
+		m.infof("Upgrade function already set version to %d, not updating it.", version)
+	default:
+		res, err := tx.ExecContext(ctx, m.sql.updateVersion(), newVersion)
+		if err != nil {
+			_ = tx.Rollback()
+			return m.logErrorf("Failed to update schema version: %w", err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			_ = tx.Rollback()
+			return m.logErrorf("Failed to update schema version: no rows in schema_version")
+		}
 	}
 
-	if _, err := tx.Exec("UPDATE schema_version SET version = $1", newVersion); err != nil {
+	if m.cfg.History {
+		if err := m.recordStepHistory(ctx, tx, mig); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	if err := m.recordRun(ctx, tx, newVersion); err != nil {
 		_ = tx.Rollback()
-		return logErrorf("Failed to update schema version: %w", err)
+		return err
 	}
 
 	if err := tx.Commit(); err != nil {
-		return logErrorf("Failed to commit transaction: %w", err)
+		return m.logErrorf("Failed to commit transaction: %w", err)
 	}
 
+	if stop {
+		return ErrStopMigration
+	}
 	return nil
 }
 
-func acquireAdvisoryLock(db *sql.DB, lockID int) error {
+// acquireLock takes the upgrade lock through the Locker, or as an advisory
+// lock on conn if there is none. With NoLock, or if ctx comes from WithLock
+// for the same lock, it takes nothing.
+func (m *Migrator) acquireLock(ctx context.Context, conn *sql.Conn, lockID int) (func() error, error) {
+	if m.holdsLock(ctx, lockID) {
+		m.debugf("Lock %d is already held through WithLock", lockID)
+		return func() error { return nil }, nil
+	}
+	if m.cfg.NoLock {
+		m.warnf("NoLock is set, upgrading without a lock. Running more than one migrator at a time can corrupt the schema.")
+		return func() error { return nil }, nil
+	}
+	if m.cfg.Locker == nil {
+		if err := m.acquireAdvisoryLock(ctx, conn, lockID); err != nil {
+			return nil, err
+		}
+		if m.cfg.SharedLockKey != 0 {
+			if err := m.acquireAdvisoryLock(ctx, conn, m.cfg.SharedLockKey); err != nil {
+				_ = m.releaseAdvisoryLock(ctx, conn, lockID)
+				return nil, err
+			}
+		}
+		return m.advisoryRelease(ctx, conn, lockID), nil
+	}
+
+	release, err := m.cfg.Locker.Acquire(ctx, lockID)
+	if err != nil {
+		if errors.Is(err, ErrLockBusy) {
+			expvarLockContention.Add(1)
+			m.infof("%v", err)
+			return nil, err
+		}
+		return nil, m.logErrorf("Failed to acquire lock %d: %w", lockID, err)
+	}
+	return m.lockerRelease(lockID, release), nil
+}
+
+func (m *Migrator) lockerRelease(lockID int, release func()) func() error {
+	m.debugf("Acquired lock %d", lockID)
+	return func() error {
+		release()
+		m.debugf("Released lock %d", lockID)
+		return nil
+	}
+}
+
+func (m *Migrator) acquireAdvisoryLock(ctx context.Context, conn *sql.Conn, lockID int) error {
 	var acquired bool
-	err := db.QueryRow("SELECT pg_try_advisory_lock($1)", lockID).Scan(&acquired)
+	err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", lockID).Scan(&acquired)
 	if err != nil {
-		return logErrorf("Failed to check advisory lock: %v", err)
+		return m.logErrorf("Failed to check advisory lock: %v", err)
 	}
 	if !acquired {
-		return logErrorf("Advisory lock is already held by another process!")
+		expvarLockContention.Add(1)
+		err := &LockBusyError{LockID: lockID, Holder: lockHolder(ctx, conn, lockID)}
+		m.infof("%v", err)
+		return err
 	}
+	m.debugf("Acquired advisory lock %d", lockID)
 	return nil
 }
 
-func releaseAdvisoryLock(db *sql.DB, lockID int) error {
-	_, err := db.Exec("SELECT pg_advisory_unlock($1)", lockID)
+// lockedConn is a connection to upgrade on and the lock guarding it.
+type lockedConn struct {
+	conn    *sql.Conn
+	release func() error
+}
+
+// tryTakeOver returns a connection and the lock for lockID, or nil if the
+// lock is still held elsewhere. Unlike acquireLock it stays quiet while
+// busy, as it runs on every poll.
+func (m *Migrator) tryTakeOver(ctx context.Context, lockID int) (*lockedConn, error) {
+	conn, err := m.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	release, err := m.tryLock(ctx, conn, lockID)
+	if err != nil || release == nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if err := m.setApplicationName(ctx, conn); err != nil {
+		_ = release()
+		_ = conn.Close()
+		return nil, err
+	}
+	return &lockedConn{conn: conn, release: release}, nil
+}
+
+// tryLock is like acquireLock but returns a nil release func instead of an
+// error while the lock is busy.
+func (m *Migrator) tryLock(ctx context.Context, conn *sql.Conn, lockID int) (func() error, error) {
+	if m.cfg.Locker != nil {
+		release, err := m.cfg.Locker.Acquire(ctx, lockID)
+		switch {
+		case errors.Is(err, ErrLockBusy):
+			return nil, nil
+		case err != nil:
+			return nil, m.logErrorf("Failed to acquire lock %d: %w", lockID, err)
+		}
+		return m.lockerRelease(lockID, release), nil
+	}
+
+	if acquired, err := m.tryAdvisoryLock(ctx, conn, lockID); err != nil || !acquired {
+		return nil, err
+	}
+	if m.cfg.SharedLockKey != 0 {
+		if acquired, err := m.tryAdvisoryLock(ctx, conn, m.cfg.SharedLockKey); err != nil || !acquired {
+			_ = m.releaseAdvisoryLock(ctx, conn, lockID)
+			return nil, err
+		}
+	}
+	return m.advisoryRelease(ctx, conn, lockID), nil
+}
+
+func (m *Migrator) tryAdvisoryLock(ctx context.Context, conn *sql.Conn, lockID int) (bool, error) {
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", lockID).Scan(&acquired); err != nil {
+		return false, m.logErrorf("Failed to check advisory lock: %w", err)
+	}
+	if acquired {
+		m.debugf("Acquired advisory lock %d", lockID)
+	}
+	return acquired, nil
+}
+
+// advisoryRelease returns a func releasing lockID and, if set, the shared
+// lock taken with it.
+func (m *Migrator) advisoryRelease(ctx context.Context, conn *sql.Conn, lockID int) func() error {
+	return func() error {
+		if m.cfg.SharedLockKey != 0 {
+			if err := m.releaseAdvisoryLock(ctx, conn, m.cfg.SharedLockKey); err != nil {
+				return err
+			}
+		}
+		return m.releaseAdvisoryLock(ctx, conn, lockID)
+	}
+}
+
+// releaseAdvisoryLock runs even if ctx was canceled. If the unlock fails the
+// connection is discarded so the lock dies with the session instead of
+// going back to the pool.
+func (m *Migrator) releaseAdvisoryLock(ctx context.Context, conn *sql.Conn, lockID int) error {
+	_, err := conn.ExecContext(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", lockID)
 	if err != nil {
-		return logErrorf("Failed to release advisory lock: %w", err)
+		discardConn(conn)
+		return m.logErrorf("Failed to release advisory lock: %w", err)
 	}
+	m.debugf("Released advisory lock %d", lockID)
 	return nil
 }
 
-func logErrorf(format string, v ...interface{}) error {
-	err := fmt.Errorf(format, v...)
-	log.Println(err)
+func (m *Migrator) setRole(ctx context.Context, conn *sql.Conn) error {
+	if _, err := conn.ExecContext(ctx, "SET ROLE "+quoteIdentifier(m.cfg.MigrationRole)); err != nil {
+		return m.logErrorf("Failed to set role %s: %w", m.cfg.MigrationRole, err)
+	}
+	return nil
+}
+
+func (m *Migrator) resetRole(ctx context.Context, conn *sql.Conn) {
+	if _, err := conn.ExecContext(context.WithoutCancel(ctx), "RESET ROLE"); err != nil {
+		_ = m.logErrorf("Failed to reset role: %w", err)
+		// Don't hand an elevated session back to the pool.
+		discardConn(conn)
+	}
+}
+
+// analyze refreshes planner statistics after an upgrade. The upgrade has
+// committed by now, so failures are only logged.
+func (m *Migrator) analyze(ctx context.Context, conn *sql.Conn) {
+	if len(m.cfg.AnalyzeTables) == 0 {
+		if _, err := conn.ExecContext(ctx, "ANALYZE"); err != nil {
+			m.warnf("ANALYZE failed: %v", err)
+		}
+		return
+	}
+	for _, table := range m.cfg.AnalyzeTables {
+		if _, err := conn.ExecContext(ctx, "ANALYZE "+quoteQualified(m.sql.dialect, table)); err != nil {
+			m.warnf("ANALYZE %s failed: %v", table, err)
+		}
+	}
+}
+
+func (m *Migrator) commentOnDatabase(ctx context.Context, conn *sql.Conn, version int) {
+	var name string
+	if err := conn.QueryRowContext(ctx, "SELECT current_database()").Scan(&name); err != nil {
+		_ = m.logErrorf("Failed to look up current database: %w", err)
+		return
+	}
+
+	comment := fmt.Sprintf("COMMENT ON DATABASE %s IS 'schema_version=%d'", quoteIdentifier(name), version)
+	if _, err := conn.ExecContext(ctx, comment); err != nil {
+		_ = m.logErrorf("Failed to set database comment: %w", err)
+	}
+}
+
+// discardConn makes database/sql close conn instead of returning it to the
+// pool once it is released.
+func discardConn(conn *sql.Conn) {
+	_ = conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+}
+
+// safeCall runs a user function, turning a panic into an error carrying the
+// stack, so the transaction is still rolled back and the lock released
+// instead of the process dying with both open.
+func safeCall(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v\n%s", ErrPanic, r, debug.Stack())
+		}
+	}()
+	return fn()
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (m *Migrator) WaitForSchemaVersion(ctx context.Context, targetVersion int, timeout time.Duration) error {
+	_, err := m.waitForSchemaVersion(ctx, targetVersion, timeout, 0)
 	return err
 }
 
-func WaitForSchemaVersion(db *sql.DB, targetVersion int, timeout time.Duration) error {
-	deadline := time.Now().Add(timeout)
-	for time.Now().Before(deadline) {
-		time.Sleep(checkInterval)
+// waitForSchemaVersion polls until targetVersion is reached. If lockID is
+// set it also retries the lock on every poll, so that when the holder dies
+// without finishing a waiter takes over: it then returns a connection and
+// the lock, which the caller must release and close.
+func (m *Migrator) waitForSchemaVersion(ctx context.Context, targetVersion int, timeout time.Duration, lockID int) (*lockedConn, error) {
+	start := m.now()
+	deadline := start.Add(timeout)
+	since := m.databaseNow(ctx)
+	latestVersion := -1
+	for m.now().Before(deadline) {
+		if err := sleep(ctx, checkInterval); err != nil {
+			return nil, err
+		}
+		now := m.now()
+		m.emit(Waiting{Elapsed: now.Sub(start)})
+		if m.cfg.OnWait != nil {
+			m.cfg.OnWait(now.Sub(start), max(deadline.Sub(now), 0))
+		}
 
-		latestVersion, err := getSchemaVersion(db)
+		var err error
+		latestVersion, err = m.readSchemaVersion(ctx, m.db)
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		if VersionReached(latestVersion, targetVersion) {
+			m.infof("Schema version is %d", latestVersion)
+			return nil, nil
+		}
+
+		if since.IsZero() {
+			// No cutoff known, so any failure found could be a stale one.
+			since = m.databaseNow(ctx)
+		} else if msg, failed := m.peerFailure(ctx, targetVersion, since); failed {
+			return nil, m.logErrorf("%w", &VersionError{
+				Op: "wait for upgrade", Current: latestVersion, Target: targetVersion,
+				Err: fmt.Errorf("%w: %s", ErrPeerMigrationFailed, msg),
+			})
 		}
 
-		if latestVersion == targetVersion {
-			log.Printf("Schema version is %d\n", latestVersion)
-			return nil
+		if lockID != 0 {
+			locked, err := m.tryTakeOver(ctx, lockID)
+			if err != nil {
+				return nil, err
+			}
+			if locked != nil {
+				m.infof("Lock holder went away at version %d, taking over the upgrade to %d.", latestVersion, targetVersion)
+				return locked, nil
+			}
 		}
 	}
 
-	return logErrorf("Timeout: waiting for schema version %d in %v", targetVersion, timeout)
+	return nil, m.logErrorf("%w", &VersionError{
+		Op: "wait for upgrade", Current: latestVersion, Target: targetVersion,
+		Err: fmt.Errorf("%w after %v", ErrTimeout, timeout),
+	})
 }
@@ -0,0 +1,971 @@
+package dblock_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4/source/file"
+
+	"dblock/dblock"
+)
+
+func TestUpgradeSkipsStepCommittedByEarlierAttempt(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	if _, err := s.Migrator().Upgrade(ctx, 1, func(*sql.Tx) error { return nil }, time.Minute); err != nil {
+		t.Fatalf("Upgrade(1): %v", err)
+	}
+
+	// An earlier attempt committed version 2 after this one read the
+	// version but before its transaction started.
+	cfg := s.Config
+	cfg.SkipPostLockCheck = true
+	events := make(chan dblock.Event, 32)
+	cfg.Events = events
+	cfg.BeginTx = func(ctx context.Context, conn *sql.Conn, opts *sql.TxOptions) (*sql.Tx, error) {
+		if _, err := s.DB.ExecContext(ctx, "UPDATE schema_version SET version = 2"); err != nil {
+			return nil, err
+		}
+		return conn.BeginTx(ctx, opts)
+	}
+	ran := false
+	res, err := dblock.New(s.DB, cfg).Upgrade(ctx, 2, func(*sql.Tx) error {
+		ran = true
+		return nil
+	}, time.Minute)
+	if err != nil {
+		t.Fatalf("Upgrade(2): %v", err)
+	}
+	if ran {
+		t.Error("Up ran again for a committed version")
+	}
+	if res.To != 2 {
+		t.Errorf("To = %d, want 2", res.To)
+	}
+	close(events)
+	for e := range events {
+		if c, ok := e.(dblock.StepCommitted); ok {
+			t.Errorf("got StepCommitted for version %d", c.Version)
+		}
+	}
+}
+
+func TestUpgradeForcedRerun(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	if _, err := s.Migrator().Upgrade(ctx, 1, func(*sql.Tx) error { return nil }, time.Minute); err != nil {
+		t.Fatalf("Upgrade(1): %v", err)
+	}
+
+	cfg := s.Config
+	cfg.ShouldUpgrade = func(current, target int) (bool, error) { return true, nil }
+	ran := false
+	res, err := dblock.New(s.DB, cfg).Upgrade(ctx, 1, func(*sql.Tx) error {
+		ran = true
+		return nil
+	}, time.Minute)
+	if err != nil {
+		t.Fatalf("Upgrade(1) again: %v", err)
+	}
+	if !ran {
+		t.Error("ShouldUpgrade forced a re-run but Up didn't run")
+	}
+	if !res.Upgraded {
+		t.Error("Upgraded = false after a forced re-run")
+	}
+}
+
+func TestUpgradeStepsForcedRerunAppliesLastStep(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	var ran []int
+	step := func(v int) dblock.Migration {
+		return dblock.Migration{Version: v, Up: func(*sql.Tx) error {
+			ran = append(ran, v)
+			return nil
+		}}
+	}
+	migrations := dblock.Migrations{step(1), step(2)}
+	if _, err := s.Migrator().UpgradeSteps(ctx, migrations, time.Minute); err != nil {
+		t.Fatalf("UpgradeSteps: %v", err)
+	}
+
+	ran = nil
+	cfg := s.Config
+	cfg.ShouldUpgrade = func(current, target int) (bool, error) { return true, nil }
+	res, err := dblock.New(s.DB, cfg).UpgradeSteps(ctx, migrations, time.Minute)
+	if err != nil {
+		t.Fatalf("UpgradeSteps again: %v", err)
+	}
+	if len(ran) != 1 || ran[0] != 2 {
+		t.Errorf("ran %v, want [2]", ran)
+	}
+	if len(res.Applied) != 1 || res.Applied[0] != 2 {
+		t.Errorf("Applied = %v, want [2]", res.Applied)
+	}
+}
+
+func TestCommentOnDatabase(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	cfg := s.Config
+	cfg.CommentOnDatabase = true
+	if _, err := dblock.New(s.DB, cfg).Upgrade(ctx, 3, nil, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	var comment string
+	err := s.DB.QueryRowContext(ctx, `
+		SELECT shobj_description(oid, 'pg_database') FROM pg_database WHERE datname = current_database()
+	`).Scan(&comment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comment != "schema_version=3" {
+		t.Errorf("comment = %q, want schema_version=3", comment)
+	}
+}
+
+func TestMigrationRoleOwnsCreatedObjects(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	if _, err := s.Migrator().Upgrade(ctx, 1, nil, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	role := s.Schema + "_owner"
+	if _, err := s.DB.ExecContext(ctx, "CREATE ROLE "+role+" NOLOGIN"); err != nil {
+		t.Skipf("can't create a role: %v", err)
+	}
+	t.Cleanup(func() {
+		_, _ = s.DB.Exec("DROP OWNED BY " + role)
+		_, _ = s.DB.Exec("DROP ROLE " + role)
+	})
+	for _, grant := range []string{
+		"GRANT " + role + " TO current_user",
+		"GRANT USAGE, CREATE ON SCHEMA " + s.Schema + " TO " + role,
+		"GRANT SELECT, UPDATE ON schema_version TO " + role,
+	} {
+		if _, err := s.DB.ExecContext(ctx, grant); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := s.Config
+	cfg.MigrationRole = role
+	_, err := dblock.New(s.DB, cfg).Upgrade(ctx, 2, func(tx *sql.Tx) error {
+		_, err := tx.Exec("CREATE TABLE owned (id INTEGER)")
+		return err
+	}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var owner string
+	if err := s.DB.QueryRowContext(ctx, "SELECT tableowner FROM pg_tables WHERE schemaname = $1 AND tablename = 'owned'", s.Schema).Scan(&owner); err != nil {
+		t.Fatal(err)
+	}
+	if owner != role {
+		t.Errorf("owner = %s, want %s", owner, role)
+	}
+}
+
+func TestUpgradeKeepsVersionBumpedByUp(t *testing.T) {
+	for _, bumpTo := range []int{2, 5} {
+		s := newSandbox(t)
+		ctx := context.Background()
+		res, err := s.Migrator().Upgrade(ctx, 2, func(tx *sql.Tx) error {
+			_, err := tx.Exec("UPDATE schema_version SET version = $1", bumpTo)
+			return err
+		}, time.Minute)
+		if err != nil {
+			t.Fatalf("Up bumping to %d: %v", bumpTo, err)
+		}
+		version, err := s.Migrator().CurrentVersion(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := max(bumpTo, 2); version != want {
+			t.Errorf("Up bumping to %d: version = %d, want %d", bumpTo, version, want)
+		}
+		if !res.Upgraded {
+			t.Errorf("Up bumping to %d: Upgraded = false", bumpTo)
+		}
+	}
+}
+
+func TestInitialVersionSeedsNewTableOnly(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	cfg := s.Config
+	cfg.InitialVersion = 5
+	m := dblock.New(s.DB, cfg)
+
+	version, err := m.CurrentVersion(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 5 {
+		t.Errorf("version of a new table = %d, want 5", version)
+	}
+	res, err := m.Upgrade(ctx, 3, func(*sql.Tx) error {
+		t.Error("Up ran for a version below InitialVersion")
+		return nil
+	}, time.Minute)
+	if err != nil || res.Upgraded {
+		t.Errorf("Upgrade(3) = %+v, %v, want a no-op", res, err)
+	}
+
+	cfg.InitialVersion = 9
+	if version, err := dblock.New(s.DB, cfg).CurrentVersion(ctx); err != nil || version != 5 {
+		t.Errorf("version with another InitialVersion = %d, %v, want 5", version, err)
+	}
+}
+
+func TestBatchHooksRunOnceAroundSteps(t *testing.T) {
+	for _, granularity := range []dblock.LockGranularity{dblock.LockBatch, dblock.LockPerStep} {
+		s := newSandbox(t)
+		ctx := context.Background()
+		var calls []string
+		cfg := s.Config
+		cfg.LockGranularity = granularity
+		cfg.OnBatchStart = func() { calls = append(calls, "start") }
+		cfg.OnBatchEnd = func(res dblock.Result, err error) {
+			calls = append(calls, "end")
+			if err != nil || res.To != 3 {
+				t.Errorf("granularity %d: OnBatchEnd(%+v, %v), want version 3", granularity, res, err)
+			}
+		}
+		step := func(v int) dblock.Migration {
+			return dblock.Migration{Version: v, Up: func(*sql.Tx) error {
+				calls = append(calls, "step")
+				return nil
+			}}
+		}
+		migrations := dblock.Migrations{step(1), step(2), step(3)}
+		if _, err := dblock.New(s.DB, cfg).UpgradeSteps(ctx, migrations, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := strings.Join(calls, ","), "start,step,step,step,end"; got != want {
+			t.Errorf("granularity %d: calls %s, want %s", granularity, got, want)
+		}
+
+		// Nothing to do, so no hooks.
+		calls = nil
+		if _, err := dblock.New(s.DB, cfg).UpgradeSteps(ctx, migrations, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if len(calls) != 0 {
+			t.Errorf("granularity %d: calls %v without work", granularity, calls)
+		}
+	}
+}
+
+func TestOnBatchEndSeesFailure(t *testing.T) {
+	s := newSandbox(t)
+	errStep := errors.New("step failed")
+	var endErr error
+	cfg := s.Config
+	cfg.OnBatchEnd = func(_ dblock.Result, err error) { endErr = err }
+	_, err := dblock.New(s.DB, cfg).Upgrade(context.Background(), 1, func(*sql.Tx) error { return errStep }, time.Minute)
+	if !errors.Is(err, errStep) {
+		t.Fatalf("error = %v, want %v", err, errStep)
+	}
+	if !errors.Is(endErr, errStep) {
+		t.Errorf("OnBatchEnd got %v, want %v", endErr, errStep)
+	}
+}
+
+func TestSkipPostLockCheck(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		s := newSandbox(t)
+		cfg := s.Config
+		cfg.SkipPostLockCheck = skip
+		checks := 0
+		cfg.ShouldUpgrade = func(current, target int) (bool, error) {
+			checks++
+			return dblock.ShouldUpgrade(current, target)
+		}
+		res, err := dblock.New(s.DB, cfg).Upgrade(context.Background(), 1, func(*sql.Tx) error { return nil }, time.Minute)
+		if err != nil {
+			t.Fatalf("SkipPostLockCheck=%v: %v", skip, err)
+		}
+		if !res.Upgraded || res.To != 1 {
+			t.Errorf("SkipPostLockCheck=%v: result %+v, want an upgrade to 1", skip, res)
+		}
+		want := 2
+		if skip {
+			want = 1
+		}
+		if checks != want {
+			t.Errorf("SkipPostLockCheck=%v: version checked %d times, want %d", skip, checks, want)
+		}
+	}
+}
+
+func TestErrorOnNoOp(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	up := func(*sql.Tx) error { return nil }
+	if _, err := s.Migrator().Upgrade(ctx, 2, up, time.Minute); err != nil {
+		t.Fatalf("Upgrade(2): %v", err)
+	}
+	if _, err := s.Migrator().Upgrade(ctx, 2, up, time.Minute); err != nil {
+		t.Errorf("no-op without ErrorOnNoOp: %v", err)
+	}
+
+	cfg := s.Config
+	cfg.ErrorOnNoOp = true
+	m := dblock.New(s.DB, cfg)
+	for _, target := range []int{1, 2} {
+		_, err := m.Upgrade(ctx, target, up, time.Minute)
+		if !errors.Is(err, dblock.ErrNoMigrationNeeded) {
+			t.Errorf("Upgrade(%d) error = %v, want ErrNoMigrationNeeded", target, err)
+		}
+		if !errors.Is(err, &dblock.VersionError{Current: 2, Target: target}) {
+			t.Errorf("Upgrade(%d) error = %v, want a VersionError from 2", target, err)
+		}
+	}
+
+	steps := dblock.Migrations{{Version: 1, Up: up}, {Version: 2, Up: up}}
+	if _, err := m.UpgradeSteps(ctx, steps, time.Minute); !errors.Is(err, dblock.ErrNoMigrationNeeded) {
+		t.Errorf("UpgradeSteps with nothing to do: error = %v, want ErrNoMigrationNeeded", err)
+	}
+	steps = append(steps, dblock.Migration{Version: 3, Up: up})
+	if _, err := m.UpgradeSteps(ctx, steps, time.Minute); err != nil {
+		t.Errorf("UpgradeSteps with a pending step: %v", err)
+	}
+}
+
+func TestLockFirst(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	locked := func(lockFirst bool, target int) bool {
+		cfg := s.Config
+		cfg.LockFirst = lockFirst
+		events := make(chan dblock.Event, 32)
+		cfg.Events = events
+		if _, err := dblock.New(s.DB, cfg).Upgrade(ctx, target, nil, time.Minute); err != nil {
+			t.Fatalf("LockFirst=%v, Upgrade(%d): %v", lockFirst, target, err)
+		}
+		close(events)
+		acquired := false
+		for e := range events {
+			_, ok := e.(dblock.LockAcquired)
+			acquired = acquired || ok
+		}
+		return acquired
+	}
+
+	// On a fresh database the version table is created under the lock.
+	if !locked(true, 1) {
+		t.Error("LockFirst upgrade didn't take the lock")
+	}
+	var version int
+	if err := s.DB.QueryRow("SELECT version FROM schema_version").Scan(&version); err != nil || version != 1 {
+		t.Errorf("version = %d, %v, want 1", version, err)
+	}
+	if !locked(true, 1) {
+		t.Error("LockFirst no-op didn't take the lock")
+	}
+	if locked(false, 1) {
+		t.Error("no-op without LockFirst took the lock")
+	}
+}
+
+func TestSessionSetup(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	cfg := s.Config
+	cfg.SessionSetup = func(ctx context.Context, conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, "SET maintenance_work_mem = '77MB'")
+		return err
+	}
+	var inUp string
+	_, err := dblock.New(s.DB, cfg).Upgrade(ctx, 1, func(tx *sql.Tx) error {
+		return tx.QueryRow("SHOW maintenance_work_mem").Scan(&inUp)
+	}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inUp != "77MB" {
+		t.Errorf("maintenance_work_mem in Up = %s, want 77MB", inUp)
+	}
+
+	// The lock connection isn't returned to the pool with the setting.
+	s.DB.SetMaxOpenConns(1)
+	var after string
+	if err := s.DB.QueryRow("SHOW maintenance_work_mem").Scan(&after); err != nil {
+		t.Fatal(err)
+	}
+	if after == "77MB" {
+		t.Error("SessionSetup's setting leaked into the pool")
+	}
+
+	errSetup := errors.New("setup failed")
+	cfg.SessionSetup = func(context.Context, *sql.Conn) error { return errSetup }
+	if _, err := dblock.New(s.DB, cfg).Upgrade(ctx, 2, nil, time.Minute); !errors.Is(err, errSetup) {
+		t.Errorf("error = %v, want %v", err, errSetup)
+	}
+}
+
+func TestBookkeepingStep(t *testing.T) {
+	s := newSandbox(t)
+	cfg := s.Config
+	cfg.History = true
+	steps := dblock.Migrations{{Version: 1}, {Version: 2}}
+	res, err := dblock.New(s.DB, cfg).UpgradeSteps(context.Background(), steps, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.To != 2 || len(res.Applied) != 2 {
+		t.Errorf("result %+v, want both steps applied", res)
+	}
+	var recorded int
+	if err := s.DB.QueryRow("SELECT count(DISTINCT version) FROM schema_version_history WHERE version IN (1, 2)").Scan(&recorded); err != nil {
+		t.Fatal(err)
+	}
+	if recorded != 2 {
+		t.Errorf("history has %d of the steps, want 2", recorded)
+	}
+}
+
+func TestUpgradeToLatest(t *testing.T) {
+	s := newSandbox(t)
+	var ran []int
+	step := func(v int) dblock.Migration {
+		return dblock.Migration{Version: v, Up: func(*sql.Tx) error {
+			ran = append(ran, v)
+			return nil
+		}}
+	}
+	if err := dblock.UpgradeToLatest(s.DB, dblock.Migrations{step(2), step(1), step(3)}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ran) != "[1 2 3]" {
+		t.Errorf("ran %v, want [1 2 3]", ran)
+	}
+	var version int
+	if err := s.DB.QueryRow("SELECT version FROM schema_version").Scan(&version); err != nil || version != 3 {
+		t.Errorf("version = %d, %v, want 3", version, err)
+	}
+}
+
+func TestUpgradeStepsTimestampVersions(t *testing.T) {
+	s := newSandbox(t)
+	var ran []int
+	step := func(v int) dblock.Migration {
+		return dblock.Migration{Version: v, Up: func(*sql.Tx) error {
+			ran = append(ran, v)
+			return nil
+		}}
+	}
+	ctx := context.Background()
+	migrations := dblock.Migrations{step(20240301), step(20240101), step(20240115)}
+	res, err := s.Migrator().UpgradeSteps(ctx, migrations[1:], time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.To != 20240115 {
+		t.Errorf("To = %d, want 20240115", res.To)
+	}
+	if _, err := s.Migrator().UpgradeSteps(ctx, migrations, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ran) != "[20240101 20240115 20240301]" {
+		t.Errorf("ran %v, want [20240101 20240115 20240301]", ran)
+	}
+}
+
+func TestUpgradeStepsFromMigrateSourceFile(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	src, err := (&file.File{}).Open("file://testdata/migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	migrations, err := dblock.FromMigrateSource(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := s.Migrator().UpgradeSteps(ctx, migrations, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.To != 3 {
+		t.Errorf("To = %d, want 3", res.To)
+	}
+	var email string
+	if err := s.DB.QueryRowContext(ctx, "SELECT email FROM users WHERE id = 1").Scan(&email); err != nil {
+		t.Fatalf("seeded row: %v", err)
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	for _, mig := range []dblock.Migration{migrations[1], migrations[0]} {
+		if err := mig.Down(tx); err != nil {
+			t.Fatalf("down %d: %v", mig.Version, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	var exists bool
+	if err := s.DB.QueryRowContext(ctx, "SELECT to_regclass('users') IS NOT NULL").Scan(&exists); err != nil || exists {
+		t.Errorf("users still there after the down migrations: %v, %v", exists, err)
+	}
+}
+
+func TestLockPerStep(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	events := make(chan dblock.Event, 32)
+	cfg := s.Config
+	cfg.LockGranularity = dblock.LockPerStep
+	cfg.Events = events
+	free := func(key int) bool {
+		var ok bool
+		if err := s.DB.QueryRow("SELECT pg_try_advisory_lock($1) AND pg_advisory_unlock($1)", key).Scan(&ok); err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	step := func(v int) dblock.Migration {
+		return dblock.Migration{Version: v, Up: func(*sql.Tx) error {
+			if free(s.Config.LockBase + v) {
+				t.Errorf("step %d ran without its lock", v)
+			}
+			if v > 1 && !free(s.Config.LockBase+v-1) {
+				t.Errorf("lock of step %d still held during step %d", v-1, v)
+			}
+			return nil
+		}}
+	}
+	if _, err := dblock.New(s.DB, cfg).UpgradeSteps(ctx, dblock.Migrations{step(1), step(2), step(3)}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	close(events)
+
+	var keys []int
+	for e := range events {
+		if e, ok := e.(dblock.LockAcquired); ok {
+			keys = append(keys, e.LockID-s.Config.LockBase)
+		}
+	}
+	if fmt.Sprint(keys) != "[1 2 3]" {
+		t.Errorf("locked versions %v, want [1 2 3]", keys)
+	}
+}
+
+// recordingHandler keeps every record with the attributes added through
+// With.
+type recordingHandler struct {
+	mu      *sync.Mutex
+	records *[]map[string]string
+	attrs   []slog.Attr
+}
+
+func (h recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := map[string]string{"msg": r.Message}
+	for _, a := range h.attrs {
+		attrs[a.Key] = a.Value.String()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	*h.records = append(*h.records, attrs)
+	return nil
+}
+
+func (h recordingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h.attrs = append(append([]slog.Attr(nil), h.attrs...), attrs...)
+	return h
+}
+
+func (h recordingHandler) WithGroup(string) slog.Handler { return h }
+
+func TestUpgradeLogAttributes(t *testing.T) {
+	for _, granularity := range []dblock.LockGranularity{dblock.LockBatch, dblock.LockPerStep} {
+		s := newSandbox(t)
+		var records []map[string]string
+		cfg := s.Config
+		cfg.LockGranularity = granularity
+		cfg.LogLevel = dblock.LogDebug
+		cfg.InstanceID = func() string { return "pod-7" }
+		cfg.Logger = slog.New(recordingHandler{mu: new(sync.Mutex), records: &records})
+		m := dblock.New(s.DB, cfg)
+		if _, err := m.Upgrade(context.Background(), 1, nil, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		steps := dblock.Migrations{{Version: 1}, {Version: 2}, {Version: 3}}
+		if _, err := m.UpgradeSteps(context.Background(), steps, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(records) == 0 {
+			t.Fatal("nothing logged")
+		}
+		for _, r := range records {
+			if r["instance"] != "pod-7" || r["target_version"] == "" || r["lock_key"] == "" {
+				t.Errorf("granularity %d: %q logged with %v", granularity, r["msg"], r)
+			}
+		}
+	}
+}
+
+func TestOnNotice(t *testing.T) {
+	s := newSandbox(t)
+	cfg := s.Config
+	var notices []string
+	cfg.OnNotice = func(notice string) { notices = append(notices, notice) }
+	_, err := dblock.New(s.DB, cfg).Upgrade(context.Background(), 1, func(tx *sql.Tx) error {
+		_, err := tx.Exec("DO $$ BEGIN RAISE NOTICE 'backfilled % rows', 42; END $$")
+		return err
+	}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(notices) != "[backfilled 42 rows]" {
+		t.Errorf("notices %q, want [backfilled 42 rows]", notices)
+	}
+}
+
+func TestPostStepVerifyRollsBack(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	cfg := s.Config
+	errVerify := errors.New("users table has no rows")
+	cfg.PostStepVerify = func(tx *sql.Tx, version int) error {
+		var n int
+		if err := tx.QueryRow("SELECT count(*) FROM users").Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			return errVerify
+		}
+		return nil
+	}
+	m := dblock.New(s.DB, cfg)
+	_, err := m.Upgrade(ctx, 1, func(tx *sql.Tx) error {
+		_, err := tx.Exec("CREATE TABLE users (id INTEGER)")
+		return err
+	}, time.Minute)
+	if !errors.Is(err, errVerify) {
+		t.Fatalf("error = %v, want %v", err, errVerify)
+	}
+	var exists bool
+	if err := s.DB.QueryRow("SELECT to_regclass('users') IS NOT NULL").Scan(&exists); err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Error("users table survived the failed verification")
+	}
+	var version int
+	if err := s.DB.QueryRow("SELECT version FROM schema_version").Scan(&version); err != nil || version != 0 {
+		t.Errorf("version = %d, %v, want 0", version, err)
+	}
+
+	if _, err := m.Upgrade(ctx, 1, func(tx *sql.Tx) error {
+		_, err := tx.Exec("CREATE TABLE users (id INTEGER); INSERT INTO users VALUES (1)")
+		return err
+	}, time.Minute); err != nil {
+		t.Errorf("Upgrade with a passing verification: %v", err)
+	}
+}
+
+func TestStopMigration(t *testing.T) {
+	s := newSandbox(t)
+	var ran []int
+	step := func(v int) dblock.Migration {
+		return dblock.Migration{Version: v, Up: func(tx *sql.Tx) error {
+			ran = append(ran, v)
+			if _, err := tx.Exec(fmt.Sprintf("CREATE TABLE t%d (id INTEGER)", v)); err != nil {
+				return err
+			}
+			if v == 3 {
+				return dblock.ErrStopMigration
+			}
+			return nil
+		}}
+	}
+	steps := dblock.Migrations{step(1), step(2), step(3), step(4), step(5)}
+	res, err := s.Migrator().UpgradeSteps(context.Background(), steps, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ran) != "[1 2 3]" {
+		t.Errorf("ran %v, want [1 2 3]", ran)
+	}
+	if res.To != 3 || fmt.Sprint(res.Applied) != "[1 2 3]" || fmt.Sprint(res.Remaining) != "[4 5]" {
+		t.Errorf("result %+v, want steps 1 to 3 applied and 4, 5 remaining", res)
+	}
+	var committed bool
+	if err := s.DB.QueryRow("SELECT to_regclass('t3') IS NOT NULL").Scan(&committed); err != nil {
+		t.Fatal(err)
+	}
+	if !committed {
+		t.Error("step 3 wasn't committed")
+	}
+}
+
+func TestUpgradeFuncPanic(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	_, err := s.Migrator().Upgrade(ctx, 1, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("CREATE TABLE users (id INTEGER)"); err != nil {
+			return err
+		}
+		var m map[string]int
+		m["boom"]++
+		return nil
+	}, time.Minute)
+	if !errors.Is(err, dblock.ErrPanic) {
+		t.Fatalf("error = %v, want ErrPanic", err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "assignment to entry in nil map") || !strings.Contains(msg, "goroutine") {
+		t.Errorf("error %q lacks the panic value and stack", msg)
+	}
+	var exists bool
+	if err := s.DB.QueryRow("SELECT to_regclass('users') IS NOT NULL").Scan(&exists); err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Error("panicking step wasn't rolled back")
+	}
+
+	// The lock was released, so the next attempt gets through.
+	if _, err := s.Migrator().Upgrade(ctx, 1, nil, time.Second); err != nil {
+		t.Errorf("Upgrade after the panic: %v", err)
+	}
+}
+
+func TestVersionZeroApplied(t *testing.T) {
+	ctx := context.Background()
+	var ran []int
+	step := func(v int) dblock.Migration {
+		return dblock.Migration{Version: v, Up: func(*sql.Tx) error {
+			ran = append(ran, v)
+			return nil
+		}}
+	}
+	steps := dblock.Migrations{step(0), step(1)}
+
+	s := newSandbox(t)
+	cfg := s.Config
+	cfg.VersionZeroApplied = true
+	m := dblock.New(s.DB, cfg)
+	if v, err := m.CurrentVersion(ctx); err != nil || v != dblock.Uninitialized {
+		t.Fatalf("CurrentVersion of a new database = %d, %v, want Uninitialized", v, err)
+	}
+	if _, err := m.UpgradeSteps(ctx, steps[:1], time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := m.CurrentVersion(ctx); err != nil || v != 0 {
+		t.Errorf("CurrentVersion after step 0 = %d, %v, want 0", v, err)
+	}
+	if _, err := m.UpgradeSteps(ctx, steps, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ran) != "[0 1]" {
+		t.Errorf("ran %v, want [0 1]", ran)
+	}
+
+	// By default version 0 is the empty schema, not a step.
+	if _, err := newSandbox(t).Migrator().UpgradeSteps(ctx, steps, time.Minute); !errors.Is(err, dblock.ErrInvalidVersion) {
+		t.Errorf("step 0 without VersionZeroApplied: %v, want ErrInvalidVersion", err)
+	}
+}
+
+func TestEnableFlagAfterCommit(t *testing.T) {
+	s := newSandbox(t)
+	var enabled []string
+	cfg := s.Config
+	cfg.EnableFlag = func(ctx context.Context, flag string) error {
+		// The step's table must be visible outside its transaction.
+		var exists bool
+		if err := s.DB.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", flag).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			t.Errorf("flag %s enabled before its step committed", flag)
+		}
+		enabled = append(enabled, flag)
+		return nil
+	}
+	errStep := errors.New("step 2 failed")
+	steps := dblock.Migrations{
+		{Version: 1, Flag: "t1", Up: func(tx *sql.Tx) error {
+			_, err := tx.Exec("CREATE TABLE t1 (id INTEGER)")
+			return err
+		}},
+		{Version: 2, Flag: "t2", Up: func(tx *sql.Tx) error {
+			if _, err := tx.Exec("CREATE TABLE t2 (id INTEGER)"); err != nil {
+				return err
+			}
+			return errStep
+		}},
+	}
+	_, err := dblock.New(s.DB, cfg).UpgradeSteps(context.Background(), steps, time.Minute)
+	if !errors.Is(err, errStep) {
+		t.Fatalf("error = %v, want %v", err, errStep)
+	}
+	if fmt.Sprint(enabled) != "[t1]" {
+		t.Errorf("enabled %v, want only t1", enabled)
+	}
+}
+
+func TestStepSettingsAreTransactionLocal(t *testing.T) {
+	s := newSandbox(t)
+	rowSecurity := func(tx *sql.Tx) (string, error) {
+		var v string
+		err := tx.QueryRow("SELECT current_setting('row_security')").Scan(&v)
+		return v, err
+	}
+	var during, after string
+	steps := dblock.Migrations{
+		{Version: 1, Settings: map[string]string{"row_security": "off"}, Up: func(tx *sql.Tx) (err error) {
+			during, err = rowSecurity(tx)
+			return err
+		}},
+		{Version: 2, Up: func(tx *sql.Tx) (err error) {
+			after, err = rowSecurity(tx)
+			return err
+		}},
+	}
+	if _, err := s.Migrator().UpgradeSteps(context.Background(), steps, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if during != "off" {
+		t.Errorf("row_security = %q during the step, want off", during)
+	}
+	if after != "on" {
+		t.Errorf("row_security = %q in the next step, want it reset to on", after)
+	}
+}
+
+func TestReadOnlyStepRejectsWrites(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	m := s.Migrator()
+	steps := dblock.Migrations{
+		{Version: 1, Up: func(tx *sql.Tx) error {
+			_, err := tx.Exec("CREATE TABLE users (id INTEGER)")
+			return err
+		}},
+		{Version: 2, ReadOnly: true, Up: func(tx *sql.Tx) error {
+			_, err := tx.Exec("INSERT INTO users VALUES (1)")
+			return err
+		}},
+	}
+	if _, err := m.UpgradeSteps(ctx, steps, time.Minute); err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Fatalf("error = %v, want a read-only transaction error", err)
+	}
+	var version, rows int
+	if err := s.DB.QueryRow("SELECT version FROM schema_version").Scan(&version); err != nil || version != 1 {
+		t.Errorf("version = %d, %v, want 1", version, err)
+	}
+	if err := s.DB.QueryRow("SELECT count(*) FROM users").Scan(&rows); err != nil || rows != 0 {
+		t.Errorf("users has %d rows, %v, want none", rows, err)
+	}
+
+	steps[1].Up = func(tx *sql.Tx) error {
+		return tx.QueryRow("SELECT count(*) FROM users").Scan(&rows)
+	}
+	if _, err := m.UpgradeSteps(ctx, steps, time.Minute); err != nil {
+		t.Errorf("read-only step that only reads: %v", err)
+	}
+}
+
+func TestResultAccountsForEveryStep(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	if _, err := s.Migrator().Upgrade(ctx, 2, nil, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	var steps dblock.Migrations
+	for v := 1; v <= 5; v++ {
+		steps = append(steps, dblock.Migration{Version: v, Up: func(*sql.Tx) error {
+			if v == 4 {
+				return dblock.ErrStopMigration
+			}
+			return nil
+		}})
+	}
+	res, err := s.Migrator().UpgradeSteps(ctx, steps, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(res.Applied) != "[3 4]" {
+		t.Errorf("Applied = %v, want [3 4]", res.Applied)
+	}
+	if fmt.Sprint(res.Skipped) != fmt.Sprint([]dblock.SkippedStep{
+		{Version: 1, Reason: dblock.SkipAlreadyApplied},
+		{Version: 2, Reason: dblock.SkipAlreadyApplied},
+	}) {
+		t.Errorf("Skipped = %v, want 1 and 2 already applied", res.Skipped)
+	}
+	if fmt.Sprint(res.Remaining) != "[5]" {
+		t.Errorf("Remaining = %v, want [5]", res.Remaining)
+	}
+
+	cfg := s.Config
+	cfg.ShouldUpgrade = func(current, target int) (bool, error) { return false, nil }
+	res, err = dblock.New(s.DB, cfg).UpgradeSteps(ctx, steps, time.Minute)
+	if err != nil && !errors.Is(err, dblock.ErrNoMigrationNeeded) {
+		t.Fatal(err)
+	}
+	if len(res.Applied) != 0 || len(res.Remaining) != 0 {
+		t.Errorf("declined run applied %v and left %v remaining", res.Applied, res.Remaining)
+	}
+	if n := len(res.Skipped); n == 0 || res.Skipped[n-1] != (dblock.SkippedStep{Version: 5, Reason: dblock.SkipDeclined}) {
+		t.Errorf("Skipped = %v, want 5 declined", res.Skipped)
+	}
+}
+
+func TestExplainDMLCapturesBackfillPlan(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	if _, err := s.DB.ExecContext(ctx, "CREATE TABLE users (id INTEGER, name TEXT); INSERT INTO users SELECT generate_series(1, 10)"); err != nil {
+		t.Fatal(err)
+	}
+	const backfill = "UPDATE users SET name = 'user ' || id"
+	events := make(chan dblock.Event, 100)
+	cfg := s.Config
+	cfg.ExplainDML = true
+	cfg.Events = events
+	steps := dblock.Migrations{{Version: 1, SQL: backfill, Up: func(tx *sql.Tx) error {
+		_, err := tx.Exec(backfill)
+		return err
+	}}}
+	if _, err := dblock.New(s.DB, cfg).UpgradeSteps(ctx, steps, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	close(events)
+
+	var plan string
+	for e := range events {
+		if e, ok := e.(dblock.StepExplained); ok && e.Version == 1 {
+			plan = e.Plan
+		}
+	}
+	if !strings.Contains(plan, "Update on users") || !strings.Contains(plan, "actual") {
+		t.Errorf("plan %q, want an analyzed plan of the UPDATE", plan)
+	}
+	var filled int
+	if err := s.DB.QueryRowContext(ctx, "SELECT count(*) FROM users WHERE name IS NOT NULL").Scan(&filled); err != nil || filled != 10 {
+		t.Errorf("backfilled %d rows, %v, want 10", filled, err)
+	}
+}
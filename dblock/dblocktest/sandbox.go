@@ -0,0 +1,107 @@
+// Package dblocktest helps running real dblock migrations in tests.
+package dblocktest
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"dblock/dblock"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Sandbox is a throwaway schema for running migrations in a test. Sandboxes
+// don't see each other, so tests using them can run in parallel against a
+// single database.
+type Sandbox struct {
+	// DB is a pool whose connections all have search_path set to Schema,
+	// so unqualified names in migrations land in the sandbox.
+	DB     *sql.DB
+	Schema string
+
+	// Config keeps dblock's tables in the sandbox and gives it advisory lock
+	// keys of its own. Use it, or a copy of it, with dblock.New(s.DB, ...).
+	Config dblock.Config
+}
+
+// NewSandbox creates a sandbox in the database at dsn. The schema and
+// everything in it are dropped when the test finishes.
+func NewSandbox(tb testing.TB, driverName, dsn string) *Sandbox {
+	tb.Helper()
+
+	admin, err := sql.Open(driverName, dsn)
+	if err != nil {
+		tb.Fatalf("dblocktest: open database: %v", err)
+	}
+
+	var suffix [8]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		tb.Fatalf("dblocktest: generate schema name: %v", err)
+	}
+	schema := "dblocktest_" + hex.EncodeToString(suffix[:])
+	if _, err := admin.Exec("CREATE SCHEMA " + quoteIdentifier(schema)); err != nil {
+		_ = admin.Close()
+		tb.Fatalf("dblocktest: create schema: %v", err)
+	}
+
+	db := sql.OpenDB(&searchPathConnector{driver: admin.Driver(), dsn: dsn, schema: schema})
+	tb.Cleanup(func() {
+		_ = db.Close()
+		if _, err := admin.Exec("DROP SCHEMA " + quoteIdentifier(schema) + " CASCADE"); err != nil {
+			tb.Errorf("dblocktest: drop schema %s: %v", schema, err)
+		}
+		_ = admin.Close()
+	})
+
+	return &Sandbox{
+		DB:     db,
+		Schema: schema,
+		Config: dblock.Config{
+			VersionTable: schema + ".schema_version",
+			// Far above the default so versions never collide with real
+			// migrators or other sandboxes.
+			LockBase: int(binary.BigEndian.Uint64(suffix[:])>>2) | 1<<40,
+		},
+	}
+}
+
+// Migrator returns a dblock.Migrator bound to the sandbox.
+func (s *Sandbox) Migrator() *dblock.Migrator {
+	return dblock.New(s.DB, s.Config)
+}
+
+type searchPathConnector struct {
+	driver driver.Driver
+	dsn    string
+	schema string
+}
+
+func (c *searchPathConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		_ = conn.Close()
+		return nil, errors.New("dblocktest: driver does not support ExecerContext")
+	}
+	if _, err := execer.ExecContext(ctx, "SET search_path TO "+quoteIdentifier(c.schema), nil); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *searchPathConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
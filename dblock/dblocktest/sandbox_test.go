@@ -0,0 +1,89 @@
+package dblocktest_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"dblock/dblock"
+	"dblock/dblock/dblocktest"
+
+	_ "github.com/lib/pq"
+)
+
+func newSandbox(t *testing.T) *dblocktest.Sandbox {
+	t.Helper()
+	dsn := os.Getenv("DBLOCK_TEST_DSN")
+	if dsn == "" {
+		t.Skip("DBLOCK_TEST_DSN not set")
+	}
+	return dblocktest.NewSandbox(t, "postgres", dsn)
+}
+
+// TestSandbox shows a migration test: the steps run for real, their tables
+// land in the sandbox schema and are gone once the test ends.
+func TestSandbox(t *testing.T) {
+	t.Parallel()
+	s := newSandbox(t)
+	ctx := context.Background()
+
+	migrations := dblock.Migrations{
+		{Version: 1, Up: func(tx *sql.Tx) error {
+			_, err := tx.Exec("CREATE TABLE users (id BIGINT PRIMARY KEY)")
+			return err
+		}},
+		{Version: 2, Up: func(tx *sql.Tx) error {
+			_, err := tx.Exec("ALTER TABLE users ADD COLUMN name TEXT")
+			return err
+		}},
+	}
+	if _, err := s.Migrator().UpgradeSteps(ctx, migrations, time.Minute); err != nil {
+		t.Fatalf("UpgradeSteps: %v", err)
+	}
+
+	version, err := s.Migrator().CurrentVersion(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 {
+		t.Errorf("version = %d, want 2", version)
+	}
+	var schema string
+	if err := s.DB.QueryRowContext(ctx, "SELECT table_schema FROM information_schema.tables WHERE table_name = 'users'").Scan(&schema); err != nil {
+		t.Fatal(err)
+	}
+	if schema != s.Schema {
+		t.Errorf("users created in %s, want %s", schema, s.Schema)
+	}
+}
+
+// TestSandboxForceReleaseLock checks that the admin functions use the
+// sandbox's lock keys, not the default ones.
+func TestSandboxForceReleaseLock(t *testing.T) {
+	t.Parallel()
+	s := newSandbox(t)
+	ctx := context.Background()
+
+	conn, err := s.DB.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var pid int
+	if err := conn.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", s.Config.LockBase+3); err != nil {
+		t.Fatal(err)
+	}
+
+	terminated, err := s.Migrator().ForceReleaseLock(ctx, 3, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(terminated) != 1 || terminated[0] != pid {
+		t.Errorf("terminated %v, want [%d]", terminated, pid)
+	}
+}
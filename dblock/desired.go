@@ -0,0 +1,64 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const defaultDesiredColumn = "version"
+
+// UpgradeToDesired upgrades to the version an operator published in
+// desiredTable rather than one compiled in, so instances converge on
+// whatever the control plane asks for.
+func UpgradeToDesired(db *sql.DB, desiredTable string, upgradeFunc func(*sql.Tx) error, timeout time.Duration) error {
+	_, err := New(db, Config{}).UpgradeToDesired(context.Background(), desiredTable, upgradeFunc, timeout)
+	return err
+}
+
+// UpgradeToDesired reads the target from the single row of desiredTable,
+// column Config.DesiredColumn ("version" by default), and runs Upgrade to
+// it. A missing table, row or value means nothing is desired yet and is a
+// no-op, as is a desired version below the current one, which only warns:
+// dblock never downgrades on its own.
+func (m *Migrator) UpgradeToDesired(ctx context.Context, desiredTable string, upgradeFunc func(*sql.Tx) error, timeout time.Duration) (Result, error) {
+	desired, ok, err := m.desiredVersion(ctx, desiredTable)
+	if err != nil {
+		return Result{}, err
+	}
+	current, err := m.readSchemaVersion(ctx, m.db)
+	if err != nil {
+		return Result{}, err
+	}
+	res := Result{From: current, To: current}
+	switch {
+	case !ok:
+		m.infof("No desired version in %s, not upgrading.", desiredTable)
+		return res, nil
+	case desired < current:
+		m.warnf("Desired version %d in %s is below the current version %d, not downgrading.", desired, desiredTable, current)
+		return res, nil
+	}
+	return m.Upgrade(ctx, desired, upgradeFunc, timeout)
+}
+
+func (m *Migrator) desiredVersion(ctx context.Context, desiredTable string) (int, bool, error) {
+	column := m.cfg.DesiredColumn
+	if column == "" {
+		column = defaultDesiredColumn
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s",
+		m.sql.dialect.QuoteIdentifier(column), quoteQualified(m.sql.dialect, desiredTable))
+
+	var desired sql.NullInt64
+	err := m.db.QueryRowContext(ctx, query).Scan(&desired)
+	switch {
+	case errors.Is(err, sql.ErrNoRows), isUndefinedTable(err):
+		return 0, false, nil
+	case err != nil:
+		return 0, false, m.logErrorf("Failed to read desired version from %s: %w", desiredTable, err)
+	}
+	return int(desired.Int64), desired.Valid, nil
+}
@@ -0,0 +1,56 @@
+package dblock_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestUpgradeToDesired(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	m := s.Migrator()
+	var ran int
+	upgrade := func(*sql.Tx) error {
+		ran++
+		return nil
+	}
+	converge := func(wantVersion int) {
+		t.Helper()
+		res, err := m.UpgradeToDesired(ctx, "desired", upgrade, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.To != wantVersion {
+			t.Errorf("result %+v, want version %d", res, wantVersion)
+		}
+	}
+	exec := func(query string) {
+		t.Helper()
+		if _, err := s.DB.ExecContext(ctx, query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	converge(0)
+	exec("CREATE TABLE desired (version INTEGER)")
+	converge(0)
+	if ran != 0 {
+		t.Fatalf("upgraded %d times with nothing desired", ran)
+	}
+
+	exec("INSERT INTO desired VALUES (2)")
+	converge(2)
+	exec("UPDATE desired SET version = 3")
+	converge(3)
+	if ran != 2 {
+		t.Errorf("upgraded %d times, want 2", ran)
+	}
+
+	exec("UPDATE desired SET version = 1")
+	converge(3)
+	if ran != 2 {
+		t.Error("upgraded to a desired version below the current one")
+	}
+}
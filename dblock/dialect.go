@@ -0,0 +1,189 @@
+package dblock
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dialect spells out the SQL dblock runs against the version table. Names
+// passed in are already quoted with QuoteIdentifier.
+//
+// SeedSQL is the conflict strategy for the first row: it must insert
+// initialVersion only into an empty table and be safe to run concurrently,
+// reporting one affected row only to the caller that inserted it. Layouts
+// such as a settings table keyed by name plug in their own upsert here.
+type Dialect interface {
+	QuoteIdentifier(name string) string
+	CreateVersionTableSQL(table, column string) string
+	SeedSQL(table, column string, initialVersion int) string
+	SelectVersionSQL(table, column string) string
+	UpdateVersionSQL(table, column string) string
+	InsertVersionSQL(table, column string) string
+}
+
+var Postgres Dialect = postgresDialect{}
+
+type postgresDialect struct{}
+
+func (postgresDialect) QuoteIdentifier(name string) string {
+	return quoteIdentifier(name)
+}
+
+// The singleton primary key allows only one row, so concurrent seeds
+// conflict instead of both inserting. Tables created by older releases lack
+// it and rely on the NOT EXISTS alone. The version is an INTEGER, which is
+// why versions stop at MaxVersion.
+func (postgresDialect) CreateVersionTableSQL(table, column string) string {
+	return fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (singleton BOOLEAN PRIMARY KEY DEFAULT true CHECK (singleton), %s INTEGER NOT NULL DEFAULT 0)",
+		table, column)
+}
+
+func (postgresDialect) SeedSQL(table, column string, initialVersion int) string {
+	return fmt.Sprintf("INSERT INTO %s (%s) SELECT %d WHERE NOT EXISTS (SELECT 1 FROM %s) ON CONFLICT DO NOTHING",
+		table, column, initialVersion, table)
+}
+
+func (postgresDialect) SelectVersionSQL(table, column string) string {
+	return fmt.Sprintf("SELECT %s FROM %s", column, table)
+}
+
+func (postgresDialect) UpdateVersionSQL(table, column string) string {
+	return fmt.Sprintf("UPDATE %s SET %s = $1", table, column)
+}
+
+func (postgresDialect) InsertVersionSQL(table, column string) string {
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES ($1)", table, column)
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// StateDialect spells out the SQL for the bookkeeping tables dblock keeps
+// next to the version table: failures that waiters watch for, intents for
+// dialects without transactional DDL and the runs of Config.RunToken. Names
+// passed in are already quoted. A Dialect that doesn't implement it gets no
+// failure reports to waiters, can't use RunToken, checkpoints or RunOnce and
+// must have transactional DDL.
+type StateDialect interface {
+	CreateFailureTableSQL(table string) string
+	// ClearFailureSQL deletes the failure of the target version given.
+	ClearFailureSQL(table string) string
+	// RecordFailureSQL inserts or replaces the failure of a target version
+	// with an error message, stamped with the database's time.
+	RecordFailureSQL(table string) string
+	// SelectFailureSQL reads the error of the target version given if it
+	// was recorded at or after the time given.
+	SelectFailureSQL(table string) string
+
+	CreateIntentTableSQL(table string) string
+	InsertIntentSQL(table string) string
+	DeleteIntentSQL(table string) string
+
+	CreateRunTableSQL(table string) string
+	// InsertRunSQL records a token and version, doing nothing if the pair
+	// is there already.
+	InsertRunSQL(table string) string
+	// SelectRunSQL reports whether a token and version were recorded.
+	SelectRunSQL(table string) string
+
+	CreateCheckpointTableSQL(table string) string
+	// SaveCheckpointSQL inserts or replaces the checkpoint of a version.
+	SaveCheckpointSQL(table string) string
+	SelectCheckpointSQL(table string) string
+	DeleteCheckpointSQL(table string) string
+
+	CreateOnceTableSQL(table string) string
+	InsertOnceSQL(table string) string
+	// SelectOnceSQL reports whether a key was recorded as completed.
+	SelectOnceSQL(table string) string
+}
+
+func (postgresDialect) CreateFailureTableSQL(table string) string {
+	return fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (target_version INTEGER PRIMARY KEY, error TEXT NOT NULL, failed_at TIMESTAMPTZ NOT NULL DEFAULT now())",
+		table)
+}
+
+func (postgresDialect) ClearFailureSQL(table string) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE target_version = $1", table)
+}
+
+func (postgresDialect) RecordFailureSQL(table string) string {
+	return fmt.Sprintf(
+		"INSERT INTO %s (target_version, error) VALUES ($1, $2) ON CONFLICT (target_version) DO UPDATE SET error = EXCLUDED.error, failed_at = now()",
+		table)
+}
+
+func (postgresDialect) SelectFailureSQL(table string) string {
+	return fmt.Sprintf("SELECT error FROM %s WHERE target_version = $1 AND failed_at >= $2", table)
+}
+
+func (postgresDialect) CreateIntentTableSQL(table string) string {
+	return fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (version INTEGER PRIMARY KEY, started_at TIMESTAMPTZ NOT NULL DEFAULT now())",
+		table)
+}
+
+func (postgresDialect) InsertIntentSQL(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (version) VALUES ($1)", table)
+}
+
+func (postgresDialect) DeleteIntentSQL(table string) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version = $1", table)
+}
+
+func (postgresDialect) CreateRunTableSQL(table string) string {
+	return fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (token TEXT NOT NULL, version INTEGER NOT NULL, applied_at TIMESTAMPTZ NOT NULL DEFAULT now(), PRIMARY KEY (token, version))",
+		table)
+}
+
+func (postgresDialect) InsertRunSQL(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (token, version) VALUES ($1, $2) ON CONFLICT DO NOTHING", table)
+}
+
+func (postgresDialect) SelectRunSQL(table string) string {
+	return fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE token = $1 AND version = $2)", table)
+}
+
+func (postgresDialect) CreateCheckpointTableSQL(table string) string {
+	return fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (version INTEGER PRIMARY KEY, checkpoint TEXT NOT NULL, updated_at TIMESTAMPTZ NOT NULL DEFAULT now())",
+		table)
+}
+
+func (postgresDialect) SaveCheckpointSQL(table string) string {
+	return fmt.Sprintf(
+		"INSERT INTO %s (version, checkpoint) VALUES ($1, $2) ON CONFLICT (version) DO UPDATE SET checkpoint = EXCLUDED.checkpoint, updated_at = now()",
+		table)
+}
+
+func (postgresDialect) SelectCheckpointSQL(table string) string {
+	return fmt.Sprintf("SELECT checkpoint FROM %s WHERE version = $1", table)
+}
+
+func (postgresDialect) DeleteCheckpointSQL(table string) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE version = $1", table)
+}
+
+func (postgresDialect) CreateOnceTableSQL(table string) string {
+	return fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (key TEXT PRIMARY KEY, completed_at TIMESTAMPTZ NOT NULL DEFAULT now())",
+		table)
+}
+
+func (postgresDialect) InsertOnceSQL(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (key) VALUES ($1)", table)
+}
+
+func (postgresDialect) SelectOnceSQL(table string) string {
+	return fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE key = $1)", table)
+}
+
+// stateDialect returns the dialect's StateDialect, if it has one.
+func (m *Migrator) stateDialect() (StateDialect, bool) {
+	d, ok := m.sql.dialect.(StateDialect)
+	return d, ok
+}
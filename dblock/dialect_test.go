@@ -0,0 +1,292 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// questionDialect is a dialect with ? placeholders and no transactional
+// DDL, like MySQL's.
+type questionDialect struct{}
+
+func (questionDialect) QuoteIdentifier(name string) string { return "`" + name + "`" }
+func (questionDialect) TransactionalDDL() bool             { return false }
+
+func (questionDialect) CreateVersionTableSQL(table, column string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s INT NOT NULL)", table, column)
+}
+
+func (questionDialect) SeedSQL(table, column string, initialVersion int) string {
+	return fmt.Sprintf("INSERT INTO %s (%s) SELECT %d FROM DUAL WHERE NOT EXISTS (SELECT 1 FROM %s)", table, column, initialVersion, table)
+}
+
+func (questionDialect) SelectVersionSQL(table, column string) string {
+	return fmt.Sprintf("SELECT %s FROM %s", column, table)
+}
+
+func (questionDialect) UpdateVersionSQL(table, column string) string {
+	return fmt.Sprintf("UPDATE %s SET %s = ?", table, column)
+}
+
+func (questionDialect) InsertVersionSQL(table, column string) string {
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (?)", table, column)
+}
+
+func (questionDialect) CreateFailureTableSQL(table string) string {
+	return "CREATE TABLE IF NOT EXISTS " + table + " (target_version INT PRIMARY KEY, error TEXT NOT NULL, failed_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6))"
+}
+
+func (questionDialect) ClearFailureSQL(table string) string {
+	return "DELETE FROM " + table + " WHERE target_version = ?"
+}
+
+func (questionDialect) RecordFailureSQL(table string) string {
+	return "REPLACE INTO " + table + " (target_version, error) VALUES (?, ?)"
+}
+
+func (questionDialect) SelectFailureSQL(table string) string {
+	return "SELECT error FROM " + table + " WHERE target_version = ? AND failed_at >= ?"
+}
+
+func (questionDialect) CreateIntentTableSQL(table string) string {
+	return "CREATE TABLE IF NOT EXISTS " + table + " (version INT PRIMARY KEY)"
+}
+
+func (questionDialect) InsertIntentSQL(table string) string {
+	return "INSERT INTO " + table + " (version) VALUES (?)"
+}
+
+func (questionDialect) DeleteIntentSQL(table string) string {
+	return "DELETE FROM " + table + " WHERE version = ?"
+}
+
+func (questionDialect) CreateRunTableSQL(table string) string {
+	return "CREATE TABLE IF NOT EXISTS " + table + " (token VARCHAR(255) NOT NULL, version INT NOT NULL, PRIMARY KEY (token, version))"
+}
+
+func (questionDialect) InsertRunSQL(table string) string {
+	return "INSERT IGNORE INTO " + table + " (token, version) VALUES (?, ?)"
+}
+
+func (questionDialect) SelectRunSQL(table string) string {
+	return "SELECT EXISTS (SELECT 1 FROM " + table + " WHERE token = ? AND version = ?)"
+}
+
+func (questionDialect) CreateCheckpointTableSQL(table string) string {
+	return "CREATE TABLE IF NOT EXISTS " + table + " (version INT PRIMARY KEY, checkpoint TEXT NOT NULL)"
+}
+
+func (questionDialect) SaveCheckpointSQL(table string) string {
+	return "REPLACE INTO " + table + " (version, checkpoint) VALUES (?, ?)"
+}
+
+func (questionDialect) SelectCheckpointSQL(table string) string {
+	return "SELECT checkpoint FROM " + table + " WHERE version = ?"
+}
+
+func (questionDialect) DeleteCheckpointSQL(table string) string {
+	return "DELETE FROM " + table + " WHERE version = ?"
+}
+
+func (questionDialect) CreateOnceTableSQL(table string) string {
+	return "CREATE TABLE IF NOT EXISTS " + table + " (`key` VARCHAR(255) PRIMARY KEY)"
+}
+
+func (questionDialect) InsertOnceSQL(table string) string {
+	return "INSERT INTO " + table + " (`key`) VALUES (?)"
+}
+
+func (questionDialect) SelectOnceSQL(table string) string {
+	return "SELECT EXISTS (SELECT 1 FROM " + table + " WHERE `key` = ?)"
+}
+
+// versionOnly hides everything of its Dialect but the Dialect methods, and
+// has no transactional DDL.
+type versionOnly struct{ Dialect }
+
+func (versionOnly) TransactionalDDL() bool { return false }
+
+func TestStateSQLComesFromDialect(t *testing.T) {
+	fake := &fakeDB{}
+	db := fake.open(t)
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	m := New(db, Config{Dialect: questionDialect{}, RunToken: "deploy-1", Silent: true})
+	if err := m.clearFailure(ctx, conn, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.checkIntent(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ensureRunTable(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.recordIntent(ctx, conn, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.clearIntent(ctx, conn, 3); err != nil {
+		t.Fatal(err)
+	}
+	m.recordFailure(ctx, conn, 3, fmt.Errorf("boom"))
+	if err := m.SaveCheckpoint(ctx, conn, 3, "100"); err != nil {
+		t.Fatal(err)
+	}
+	m.clearCheckpoint(ctx, conn, 3)
+
+	statements := fake.recorded()
+	if len(statements) != 11 {
+		t.Fatalf("ran %d statements, want 11: %q", len(statements), statements)
+	}
+	for _, stmt := range statements {
+		if strings.Contains(stmt, "$1") || strings.Contains(stmt, "TIMESTAMPTZ") || strings.Contains(stmt, `"`) {
+			t.Errorf("Postgres SQL with a question mark dialect: %s", stmt)
+		}
+		if !strings.Contains(stmt, "`schema_version_") {
+			t.Errorf("statement not on a schema_version_ table: %s", stmt)
+		}
+	}
+}
+
+func TestStateSQLWithoutStateDialect(t *testing.T) {
+	fake := &fakeDB{}
+	db := fake.open(t)
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	m := New(db, Config{Dialect: versionOnly{questionDialect{}}, Silent: true})
+	if err := m.clearFailure(ctx, conn, 3); err != nil {
+		t.Errorf("clearFailure: %v", err)
+	}
+	if err := m.checkIntent(ctx, conn); err == nil {
+		t.Error("checkIntent succeeded for a dialect without transactional DDL or StateDialect")
+	}
+	if statements := fake.recorded(); len(statements) != 0 {
+		t.Errorf("ran %q, want nothing", statements)
+	}
+}
+
+func TestApplicationNameComesFromDialect(t *testing.T) {
+	for _, tc := range []struct {
+		dialect Dialect
+		want    int
+	}{
+		{Postgres, 2},
+		{questionDialect{}, 0},
+	} {
+		fake := &fakeDB{}
+		db := fake.open(t)
+		ctx := context.Background()
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := New(db, Config{Dialect: tc.dialect, Silent: true})
+		if err := m.setApplicationName(ctx, conn); err != nil {
+			t.Fatal(err)
+		}
+		m.resetApplicationName(ctx, conn)
+		conn.Close()
+		if statements := fake.recorded(); len(statements) != tc.want {
+			t.Errorf("%T: ran %q, want %d statements", tc.dialect, statements, tc.want)
+		}
+	}
+}
+
+func TestVersionSQLComesFromDialect(t *testing.T) {
+	fake := &fakeDB{query: versionRows(0)}
+	db := fake.open(t)
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	m := New(db, Config{Dialect: questionDialect{}, Silent: true})
+	if _, err := m.getSchemaVersion(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.upgradeSchema(ctx, conn, Migration{Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := questionDialect{}
+	want := []string{
+		d.CreateVersionTableSQL("`schema_version`", "`version`"),
+		d.SeedSQL("`schema_version`", "`version`", 0),
+		d.SelectVersionSQL("`schema_version`", "`version`"),
+		d.SelectVersionSQL("`schema_version`", "`version`"),
+		d.UpdateVersionSQL("`schema_version`", "`version`"),
+	}
+	if got := fake.recorded(); !slices.Equal(got, want) {
+		t.Errorf("ran\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestHalfAppliedStepDetectedWithoutTransactionalDDL(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		intents = map[int64]bool{}
+	)
+	fake := &fakeDB{
+		exec: func(query string, args []driver.NamedValue) (driver.Result, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case strings.HasPrefix(query, "INSERT INTO `schema_version_intent`"):
+				intents[args[0].Value.(int64)] = true
+			case strings.HasPrefix(query, "DELETE FROM `schema_version_intent`"):
+				delete(intents, args[0].Value.(int64))
+			}
+			return driver.RowsAffected(1), nil
+		},
+		query: func(query string, args []driver.NamedValue) (driver.Rows, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if !strings.Contains(query, "`schema_version_intent`") {
+				return versionRows(1)(query, args)
+			}
+			rows := &fakeRows{cols: []string{"min"}}
+			for v := range intents {
+				rows.values = [][]driver.Value{{v}}
+			}
+			return rows, nil
+		},
+	}
+	m := New(fake.open(t), Config{Dialect: questionDialect{}, NoLock: true, SkipEngineCheck: true, Silent: true})
+	ctx := context.Background()
+
+	// The DDL committed implicitly, then the process died before the
+	// version bump.
+	errCrash := errors.New("connection lost")
+	if _, err := m.Upgrade(ctx, 2, func(*sql.Tx) error { return errCrash }, time.Minute); !errors.Is(err, errCrash) {
+		t.Fatalf("first attempt = %v, want %v", err, errCrash)
+	}
+	_, err := m.Upgrade(ctx, 2, func(*sql.Tx) error {
+		t.Error("re-ran a half-applied step")
+		return nil
+	}, time.Minute)
+	if !errors.Is(err, ErrHalfApplied) {
+		t.Fatalf("second attempt = %v, want ErrHalfApplied", err)
+	}
+	if !strings.Contains(err.Error(), "version 2") {
+		t.Errorf("error %q doesn't name the half-applied version", err)
+	}
+}
@@ -0,0 +1,54 @@
+package dblock
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRedactDSN(t *testing.T) {
+	tests := []struct {
+		dsn, want string
+	}{
+		{"postgres://user:secret@db:5432/app?sslmode=disable", "postgres://user:xxxxx@db:5432/app?sslmode=disable"},
+		{"postgres://user@db/app?password=secret", "postgres://user@db/app?password=xxxxx"},
+		{"postgres://db/app", "postgres://db/app"},
+		{"host=db user=app password=secret dbname=app", "host=db user=app password=xxxxx dbname=app"},
+		{"host=db PASSWORD = secret", "host=db PASSWORD = xxxxx"},
+		{`host=db password='se cr\'et' dbname=app`, "host=db password=xxxxx dbname=app"},
+		{"host=db dbname=app", "host=db dbname=app"},
+		{"postgres://user:secret@db:bad port/app", "xxxxx"},
+	}
+	for _, tt := range tests {
+		if got := RedactDSN(tt.dsn); got != tt.want {
+			t.Errorf("RedactDSN(%q) = %q, want %q", tt.dsn, got, tt.want)
+		}
+	}
+}
+
+// echoDriver fails to connect with an error quoting the DSN.
+type echoDriver struct{}
+
+func (echoDriver) Open(dsn string) (driver.Conn, error) {
+	return nil, errors.New("cannot connect to " + dsn)
+}
+
+func init() {
+	sql.Register("dblock-echo", echoDriver{})
+}
+
+func TestConnectRedactsPassword(t *testing.T) {
+	buf := captureLog(t)
+	_, err := Connect("dblock-echo", "postgres://user:secret@db/app")
+	if err == nil {
+		t.Fatal("Connect succeeded")
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("error %q contains the password", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Connect logged %q", buf)
+	}
+}
@@ -0,0 +1,53 @@
+package dblock
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+var ErrDecryptFailed = errors.New("failed to decrypt migration SQL")
+
+// EncryptSQL encrypts a migration file for LoadEncryptedManifest with
+// AES-GCM. key must be 16, 24 or 32 bytes; the random nonce is prepended to
+// the result.
+func EncryptSQL(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func decryptSQL(key, data []byte) ([]byte, error) {
+	if key == nil {
+		return nil, fmt.Errorf("%w: file is encrypted but no key was given", ErrDecryptFailed)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryptFailed, err)
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("%w: file is too short", ErrDecryptFailed)
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: wrong key or corrupted file", ErrDecryptFailed)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
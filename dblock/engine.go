@@ -0,0 +1,36 @@
+package dblock
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"strings"
+)
+
+var ErrWrongDatabaseEngine = errors.New("database is not PostgreSQL")
+
+// checkEngine makes pointing the Postgres dialect at another database fail
+// with ErrWrongDatabaseEngine instead of a syntax error on
+// pg_try_advisory_lock. Other dialects are not checked.
+func (m *Migrator) checkEngine(ctx context.Context, q Queryer) error {
+	if m.cfg.SkipEngineCheck || m.sql.dialect != Postgres {
+		return nil
+	}
+
+	var version string
+	err := q.QueryRowContext(ctx, "SELECT version()").Scan(&version)
+	var netErr net.Error
+	switch {
+	case err == nil:
+	case ctx.Err() != nil, errors.Is(err, driver.ErrBadConn), errors.As(err, &netErr):
+		return m.logErrorf("Failed to check database engine: %w", err)
+	default:
+		// Reached the server but it doesn't understand SELECT version().
+		return m.logErrorf("%w: %v", ErrWrongDatabaseEngine, err)
+	}
+	if !strings.Contains(version, "PostgreSQL") {
+		return m.logErrorf("%w: server reports %q", ErrWrongDatabaseEngine, version)
+	}
+	return nil
+}
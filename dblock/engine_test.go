@@ -0,0 +1,54 @@
+package dblock
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCheckEngine(t *testing.T) {
+	answer := func(version string, err error) func(string, []driver.NamedValue) (driver.Rows, error) {
+		return func(string, []driver.NamedValue) (driver.Rows, error) {
+			if err != nil {
+				return nil, err
+			}
+			return &fakeRows{cols: []string{"version"}, values: [][]driver.Value{{version}}}, nil
+		}
+	}
+	for _, tc := range []struct {
+		name      string
+		query     func(string, []driver.NamedValue) (driver.Rows, error)
+		cfg       Config
+		wantWrong bool
+		wantErr   bool
+	}{
+		{"postgres", answer("PostgreSQL 16.2 on x86_64-pc-linux-gnu", nil), Config{}, false, false},
+		{"mysql", answer("8.0.36", nil), Config{}, true, true},
+		{"no version()", answer("", errors.New(`no such function: version`)), Config{}, true, true},
+		{"connection lost", answer("", driver.ErrBadConn), Config{}, false, true},
+		{"skipped", answer("8.0.36", nil), Config{SkipEngineCheck: true}, false, false},
+		{"other dialect", answer("8.0.36", nil), Config{Dialect: questionDialect{}}, false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.cfg.Silent = true
+			fake := &fakeDB{query: tc.query}
+			db := fake.open(t)
+			err := New(db, tc.cfg).checkEngine(context.Background(), db)
+			if (err != nil) != tc.wantErr || errors.Is(err, ErrWrongDatabaseEngine) != tc.wantWrong {
+				t.Errorf("checkEngine = %v, want error %v, ErrWrongDatabaseEngine %v", err, tc.wantErr, tc.wantWrong)
+			}
+		})
+	}
+}
+
+func TestUpgradeAgainstOtherEngine(t *testing.T) {
+	fake := &fakeDB{query: func(string, []driver.NamedValue) (driver.Rows, error) {
+		return &fakeRows{cols: []string{"version"}, values: [][]driver.Value{{"8.0.36"}}}, nil
+	}}
+	m := New(fake.open(t), Config{Silent: true})
+	if _, err := m.Upgrade(context.Background(), 1, nil, time.Second); !errors.Is(err, ErrWrongDatabaseEngine) {
+		t.Errorf("error = %v, want ErrWrongDatabaseEngine", err)
+	}
+}
@@ -0,0 +1,56 @@
+package dblock
+
+import "time"
+
+// Event is sent on Config.Events as an upgrade progresses. It is one of
+// the types below.
+type Event interface {
+	event()
+}
+
+type (
+	LockAttempt  struct{ LockID int }
+	LockAcquired struct{ LockID int }
+	StepStarted  struct{ Version int }
+
+	StepCommitted struct {
+		Version          int
+		Duration         time.Duration
+		NonTransactional bool
+	}
+
+	// Waiting is sent on every poll while another instance upgrades.
+	Waiting struct{ Elapsed time.Duration }
+
+	// StepExplained carries the plan captured with Config.ExplainDML.
+	StepExplained struct {
+		Version int
+		Plan    string
+	}
+
+	Completed struct{ Result Result }
+	Failed    struct{ Err error }
+)
+
+func (LockAttempt) event()   {}
+func (LockAcquired) event()  {}
+func (StepStarted) event()   {}
+func (StepCommitted) event() {}
+func (Waiting) event()       {}
+func (StepExplained) event() {}
+func (Completed) event()     {}
+func (Failed) event()        {}
+
+// emit never blocks the upgrade: events that don't fit into the channel's
+// buffer are dropped.
+func (m *Migrator) emit(e Event) {
+	m.report.record(e)
+	if m.cfg.Events == nil {
+		return
+	}
+	select {
+	case m.cfg.Events <- e:
+	default:
+		m.debugf("Dropped event %T, events channel is full", e)
+	}
+}
@@ -0,0 +1,90 @@
+package dblock_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"dblock/dblock"
+)
+
+// kinds describes events by type and version, leaving out what varies
+// between runs.
+func kinds(events <-chan dblock.Event) []string {
+	var got []string
+	for e := range events {
+		switch e := e.(type) {
+		case dblock.StepStarted:
+			got = append(got, fmt.Sprintf("StepStarted %d", e.Version))
+		case dblock.StepCommitted:
+			got = append(got, fmt.Sprintf("StepCommitted %d", e.Version))
+		case dblock.Completed:
+			got = append(got, fmt.Sprintf("Completed %d", e.Result.To))
+		default:
+			got = append(got, fmt.Sprintf("%T", e)[len("dblock."):])
+		}
+	}
+	return got
+}
+
+func TestEventSequence(t *testing.T) {
+	s := newSandbox(t)
+	events := make(chan dblock.Event, 32)
+	cfg := s.Config
+	cfg.Events = events
+	steps := dblock.Migrations{{Version: 1}, {Version: 2, Up: func(*sql.Tx) error { return nil }}}
+	if _, err := dblock.New(s.DB, cfg).UpgradeSteps(context.Background(), steps, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	close(events)
+
+	want := []string{
+		"LockAttempt", "LockAcquired",
+		"StepStarted 1", "StepCommitted 1",
+		"StepStarted 2", "StepCommitted 2",
+		"Completed 2",
+	}
+	if got := kinds(events); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("events\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestEventSequenceFailure(t *testing.T) {
+	s := newSandbox(t)
+	events := make(chan dblock.Event, 32)
+	cfg := s.Config
+	cfg.Events = events
+	errStep := errors.New("step failed")
+	if _, err := dblock.New(s.DB, cfg).Upgrade(context.Background(), 1, func(*sql.Tx) error { return errStep }, time.Minute); !errors.Is(err, errStep) {
+		t.Fatalf("error = %v, want %v", err, errStep)
+	}
+	close(events)
+
+	got := kinds(events)
+	want := []string{"LockAttempt", "LockAcquired", "StepStarted 1", "Failed"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("events\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestEventsNeverBlock(t *testing.T) {
+	s := newSandbox(t)
+	cfg := s.Config
+	cfg.Events = make(chan dblock.Event)
+	done := make(chan error, 1)
+	go func() {
+		_, err := dblock.New(s.DB, cfg).Upgrade(context.Background(), 1, nil, time.Minute)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("upgrade blocked on an unread events channel")
+	}
+}
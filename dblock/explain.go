@@ -0,0 +1,48 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// explain runs mig.SQL in tx under EXPLAIN ANALYZE, which executes it just
+// like Up would, and reports the plan.
+func (m *Migrator) explain(ctx context.Context, tx *sql.Tx, mig Migration) error {
+	rows, err := tx.QueryContext(ctx, "EXPLAIN (ANALYZE, BUFFERS) "+mig.SQL)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	plan := strings.Join(lines, "\n")
+	m.infof("Plan for version %d:\n%s", mig.Version, plan)
+	m.emit(StepExplained{Version: mig.Version, Plan: plan})
+	return nil
+}
+
+// isSingleDML reports whether query is one data-modifying statement that
+// EXPLAIN accepts. Anything else, DDL or several statements, runs normally.
+func isSingleDML(query string) bool {
+	query = strings.TrimSuffix(strings.TrimSpace(query), ";")
+	if query == "" || strings.Contains(query, ";") {
+		return false
+	}
+	switch strings.ToUpper(strings.Fields(query)[0]) {
+	case "INSERT", "UPDATE", "DELETE", "MERGE":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,18 @@
+package dblock
+
+import "testing"
+
+func TestIsSingleDML(t *testing.T) {
+	for query, want := range map[string]bool{
+		"UPDATE users SET name = 'x'":                    true,
+		" delete from users where id = 1; ":              true,
+		"INSERT INTO users VALUES (1)":                   true,
+		"ALTER TABLE users ADD COLUMN x TEXT":            false,
+		"UPDATE users SET a = 1; UPDATE users SET b = 2": false,
+		"": false,
+	} {
+		if got := isSingleDML(query); got != want {
+			t.Errorf("isSingleDML(%q) = %v, want %v", query, got, want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package dblock
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+)
+
+// The counters are always kept up to date, PublishExpvar only makes them
+// visible.
+var (
+	expvarUpgrades       = new(expvar.Int)
+	expvarLockContention = new(expvar.Int)
+	expvarTimeouts       = new(expvar.Int)
+	expvarLastVersion    = new(expvar.Int)
+
+	publishOnce sync.Once
+)
+
+// PublishExpvar publishes dblock's counters as the expvar map "dblock", so
+// they show up on /debug/vars:
+//
+//	upgrades_total         upgrades this process performed
+//	lock_contention_total  times the lock was held by another instance
+//	timeouts_total         waits that timed out
+//	last_version           schema version after the last upgrade call
+//
+// It is safe to call more than once. If something else already published
+// "dblock" it does nothing.
+func PublishExpvar() {
+	publishOnce.Do(func() {
+		if expvar.Get("dblock") != nil {
+			return
+		}
+		vars := expvar.NewMap("dblock")
+		vars.Set("upgrades_total", expvarUpgrades)
+		vars.Set("lock_contention_total", expvarLockContention)
+		vars.Set("timeouts_total", expvarTimeouts)
+		vars.Set("last_version", expvarLastVersion)
+	})
+}
+
+func recordExpvar(res Result, err error) {
+	switch {
+	case err == nil:
+		expvarLastVersion.Set(int64(res.To))
+		if res.Upgraded {
+			expvarUpgrades.Add(1)
+		}
+	case errors.Is(err, ErrTimeout):
+		expvarTimeouts.Add(1)
+	}
+}
@@ -0,0 +1,56 @@
+package dblock
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestExpvarCounters(t *testing.T) {
+	PublishExpvar()
+	PublishExpvar()
+
+	read := func() map[string]int64 {
+		var vars map[string]int64
+		if err := json.Unmarshal([]byte(expvar.Get("dblock").String()), &vars); err != nil {
+			t.Fatal(err)
+		}
+		return vars
+	}
+	before := read()
+	recordExpvar(Result{From: 1, To: 3, Upgraded: true}, nil)
+	recordExpvar(Result{From: 3, To: 3}, nil)
+	recordExpvar(Result{}, fmt.Errorf("waiting: %w", ErrTimeout))
+	recordExpvar(Result{To: 9}, fmt.Errorf("boom"))
+
+	fake := &fakeDB{query: func(query string, _ []driver.NamedValue) (driver.Rows, error) {
+		if strings.Contains(query, "pg_try_advisory_lock") {
+			return &fakeRows{cols: []string{"locked"}, values: [][]driver.Value{{false}}}, nil
+		}
+		return &fakeRows{}, nil
+	}}
+	db := fake.open(t)
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := New(db, Config{Silent: true}).acquireAdvisoryLock(context.Background(), conn, 1); !errors.Is(err, ErrLockBusy) {
+		t.Fatalf("acquireAdvisoryLock = %v, want ErrLockBusy", err)
+	}
+	after := read()
+
+	for name, want := range map[string]int64{"upgrades_total": 1, "timeouts_total": 1, "lock_contention_total": 1} {
+		if got := after[name] - before[name]; got != want {
+			t.Errorf("%s went up by %d, want %d", name, got, want)
+		}
+	}
+	if after["last_version"] != 3 {
+		t.Errorf("last_version = %d, want 3", after["last_version"])
+	}
+}
@@ -0,0 +1,67 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrPeerMigrationFailed is returned to a waiting instance when the instance
+// holding the lock reports that its upgrade failed.
+var ErrPeerMigrationFailed = errors.New("migration failed on another instance")
+
+// The lock holder records failed upgrades in the version table's _failure
+// table (schema_version_failure by default) so that waiters don't have to
+// sit out their whole timeout for a version that is never going to arrive.
+// Dialects without StateDialect skip this and waiters time out instead.
+
+func (m *Migrator) clearFailure(ctx context.Context, conn *sql.Conn, targetVersion int) error {
+	d, ok := m.stateDialect()
+	if !ok {
+		return nil
+	}
+	if _, err := conn.ExecContext(ctx, d.CreateFailureTableSQL(m.sql.failureTable)); err != nil {
+		return m.logErrorf("Failed to initialize %s table: %w", m.sql.failureTable, err)
+	}
+
+	if _, err := conn.ExecContext(ctx, d.ClearFailureSQL(m.sql.failureTable), targetVersion); err != nil {
+		return m.logErrorf("Failed to clear previous failure: %w", err)
+	}
+	return nil
+}
+
+func (m *Migrator) recordFailure(ctx context.Context, conn *sql.Conn, targetVersion int, cause error) {
+	d, ok := m.stateDialect()
+	if !ok {
+		return
+	}
+	if _, err := conn.ExecContext(ctx, d.RecordFailureSQL(m.sql.failureTable), targetVersion, cause.Error()); err != nil {
+		_ = m.logErrorf("Failed to record migration failure: %w", err)
+	}
+}
+
+// peerFailure returns the failure recorded for targetVersion since the given
+// database time, if any. It is best-effort: lookup errors, including the
+// table not existing yet, count as no failure, and so does a zero since.
+func (m *Migrator) peerFailure(ctx context.Context, targetVersion int, since time.Time) (string, bool) {
+	d, ok := m.stateDialect()
+	if !ok || since.IsZero() {
+		return "", false
+	}
+	var msg string
+	if err := m.db.QueryRowContext(ctx, d.SelectFailureSQL(m.sql.failureTable), targetVersion, since).Scan(&msg); err != nil {
+		return "", false
+	}
+	return msg, true
+}
+
+// databaseNow returns the database's clock, or the zero time if it can't be
+// read.
+func (m *Migrator) databaseNow(ctx context.Context) time.Time {
+	var now time.Time
+	if err := m.db.QueryRowContext(ctx, "SELECT now()").Scan(&now); err != nil {
+		return time.Time{}
+	}
+	return now
+}
@@ -0,0 +1,94 @@
+package dblock_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"dblock/dblock"
+)
+
+func TestWaiterSeesPeerFailure(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	inUp, waiting := make(chan struct{}), make(chan struct{})
+	errStep := errors.New("step failed")
+
+	holderErr := make(chan error, 1)
+	go func() {
+		_, err := s.Migrator().Upgrade(ctx, 1, func(*sql.Tx) error {
+			close(inUp)
+			<-waiting
+			return errStep
+		}, time.Minute)
+		holderErr <- err
+	}()
+	<-inUp
+
+	var once sync.Once
+	cfg := s.Config
+	cfg.OnWait = func(time.Duration, time.Duration) { once.Do(func() { close(waiting) }) }
+	start := time.Now()
+	_, err := dblock.New(s.DB, cfg).Upgrade(ctx, 1, func(*sql.Tx) error {
+		t.Error("waiter ran Up")
+		return nil
+	}, time.Minute)
+	if !errors.Is(err, dblock.ErrPeerMigrationFailed) {
+		t.Errorf("waiter error = %v, want ErrPeerMigrationFailed", err)
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("waiter took %s to notice the failure", elapsed)
+	}
+	if err := <-holderErr; !errors.Is(err, errStep) {
+		t.Errorf("holder error = %v, want %v", err, errStep)
+	}
+}
+
+func TestWaiterIgnoresFailureFromBeforeItsWait(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	errStep := errors.New("step failed")
+	if _, err := s.Migrator().Upgrade(ctx, 1, func(*sql.Tx) error { return errStep }, time.Minute); !errors.Is(err, errStep) {
+		t.Fatalf("error = %v, want %v", err, errStep)
+	}
+
+	// The old failure is still recorded, but a fresh attempt succeeds.
+	if err := s.Migrator().WaitForSchemaVersion(ctx, 0, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Migrator().Upgrade(ctx, 1, nil, time.Minute); err != nil {
+		t.Errorf("Upgrade after an earlier failure: %v", err)
+	}
+}
+
+func TestWaiterTakesOverFromDeadHolder(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	holder, pid := holdLock(t, s, s.Config.LockBase+1)
+
+	var once sync.Once
+	cfg := s.Config
+	cfg.OnWait = func(time.Duration, time.Duration) {
+		// The holder dies mid-migration without advancing the version.
+		once.Do(func() {
+			if _, err := s.DB.ExecContext(ctx, "SELECT pg_terminate_backend($1)", pid); err != nil {
+				t.Error(err)
+			}
+			_ = holder.Close()
+		})
+	}
+	ran := false
+	res, err := dblock.New(s.DB, cfg).Upgrade(ctx, 1, func(*sql.Tx) error {
+		ran = true
+		return nil
+	}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ran || !res.Upgraded || res.To != 1 {
+		t.Errorf("ran %v, result %+v, want the waiter to apply version 1", ran, res)
+	}
+}
@@ -0,0 +1,97 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"sync"
+	"testing"
+)
+
+// fakeDB is a database/sql driver that records every statement and answers
+// them through exec, query and ping, which may be nil: statements and pings
+// then succeed and queries return no rows.
+type fakeDB struct {
+	mu         sync.Mutex
+	statements []string
+
+	exec  func(query string, args []driver.NamedValue) (driver.Result, error)
+	query func(query string, args []driver.NamedValue) (driver.Rows, error)
+	ping  func() error
+}
+
+// open returns a pool over f that is closed when the test ends.
+func (f *fakeDB) open(t *testing.T) *sql.DB {
+	t.Helper()
+	db := sql.OpenDB(f)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+// recorded returns the statements run so far.
+func (f *fakeDB) recorded() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.statements...)
+}
+
+func (f *fakeDB) record(query string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statements = append(f.statements, query)
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (c fakeConn) Close() error                        { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)           { return c, nil }
+func (c fakeConn) Commit() error                       { return nil }
+func (c fakeConn) Rollback() error                     { return nil }
+
+func (c fakeConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) { return c, nil }
+
+func (c fakeConn) Ping(context.Context) error {
+	if c.db.ping != nil {
+		return c.db.ping()
+	}
+	return nil
+}
+
+func (c fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.db.record(query)
+	if c.db.exec != nil {
+		return c.db.exec(query, args)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.db.record(query)
+	if c.db.query != nil {
+		return c.db.query(query, args)
+	}
+	return &fakeRows{}, nil
+}
+
+// fakeRows returns values, one row per element, in columns named cols.
+type fakeRows struct {
+	cols   []string
+	values [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
@@ -0,0 +1,42 @@
+package dblock
+
+import (
+	"context"
+	"database/sql/driver"
+	"slices"
+	"testing"
+)
+
+func TestCurrentVersionOnlyReads(t *testing.T) {
+	fake := &fakeDB{query: versionRows(3)}
+	m := New(fake.open(t), Config{Silent: true})
+	if v, err := m.CurrentVersion(context.Background()); err != nil || v != 3 {
+		t.Errorf("CurrentVersion = %d, %v, want 3", v, err)
+	}
+	if got := fake.recorded(); !slices.Equal(got, []string{m.sql.selectVersion()}) {
+		t.Errorf("CurrentVersion ran %q, want only the select", got)
+	}
+}
+
+func TestCurrentVersionOfEmptyVersionTable(t *testing.T) {
+	fake := &fakeDB{}
+	m := New(fake.open(t), Config{InitialVersion: 4, Silent: true})
+	if v, err := m.CurrentVersion(context.Background()); err != nil || v != 4 {
+		t.Errorf("CurrentVersion = %d, %v, want InitialVersion 4", v, err)
+	}
+}
+
+func TestForceVersionInsertsMissingRow(t *testing.T) {
+	fake := &fakeDB{exec: func(string, []driver.NamedValue) (driver.Result, error) {
+		return driver.RowsAffected(0), nil
+	}}
+	m := New(fake.open(t), Config{Silent: true})
+	if err := m.ForceVersion(context.Background(), 5); err != nil {
+		t.Fatal(err)
+	}
+	statements := fake.recorded()
+	update := slices.Index(statements, m.sql.updateVersion())
+	if update < 0 || !slices.Contains(statements[update:], m.sql.insertVersion()) {
+		t.Errorf("version not inserted after updating no rows, ran %q", statements)
+	}
+}
@@ -0,0 +1,269 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidGraph = errors.New("invalid migration graph")
+	ErrCycle        = errors.New("migration dependency cycle")
+)
+
+// Node is a migration identified by ID rather than by a version, for teams
+// that would otherwise fight over the next version number. It runs after
+// every node it DependsOn.
+type Node struct {
+	ID        string
+	DependsOn []string
+	Up        func(*sql.Tx) error
+	Checksum  string
+}
+
+// Graph is a set of nodes. Applied nodes are tracked by ID in
+// <VersionTable>_applied; the version table isn't used.
+type Graph []Node
+
+// Order returns the nodes sorted so that each comes after its dependencies,
+// ties broken by ID so every instance agrees on the order.
+func (g Graph) Order() ([]Node, error) {
+	byID := make(map[string]Node, len(g))
+	indegree := make(map[string]int, len(g))
+	for _, n := range g {
+		if n.ID == "" {
+			return nil, fmt.Errorf("%w: node without ID", ErrInvalidGraph)
+		}
+		if _, dup := byID[n.ID]; dup {
+			return nil, fmt.Errorf("%w: duplicate node %q", ErrInvalidGraph, n.ID)
+		}
+		byID[n.ID] = n
+		indegree[n.ID] = 0
+	}
+
+	dependents := make(map[string][]string)
+	for _, n := range g {
+		for _, dep := range n.DependsOn {
+			if _, ok := byID[dep]; !ok {
+				return nil, fmt.Errorf("%w: %q depends on unknown node %q", ErrInvalidGraph, n.ID, dep)
+			}
+			indegree[n.ID]++
+			dependents[dep] = append(dependents[dep], n.ID)
+		}
+	}
+
+	var ready []string
+	for id, d := range indegree {
+		if d == 0 {
+			ready = append(ready, id)
+		}
+	}
+	order := make([]Node, 0, len(g))
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		id := ready[0]
+		ready = ready[1:]
+		order = append(order, byID[id])
+		for _, next := range dependents[id] {
+			if indegree[next]--; indegree[next] == 0 {
+				ready = append(ready, next)
+			}
+		}
+	}
+
+	if len(order) < len(g) {
+		var stuck []string
+		for id, d := range indegree {
+			if d > 0 {
+				stuck = append(stuck, id)
+			}
+		}
+		sort.Strings(stuck)
+		return nil, fmt.Errorf("%w among %s", ErrCycle, strings.Join(stuck, ", "))
+	}
+	return order, nil
+}
+
+// UpgradeGraph applies every node of g not applied yet, each in its own
+// transaction, in dependency order, and returns the IDs it applied. It holds
+// one lock for the graph, taken like the upgrade lock; instances that lose
+// the race wait up to timeout for all nodes to be applied, taking over if
+// the holder goes away first.
+func (m *Migrator) UpgradeGraph(ctx context.Context, g Graph, timeout time.Duration) ([]string, error) {
+	order, err := g.Order()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.ensureAppliedTable(ctx, m.db); err != nil {
+		return nil, err
+	}
+	if pending, err := m.pendingNodes(ctx, m.db, order); err != nil || len(pending) == 0 {
+		return nil, err
+	}
+
+	conn, err := m.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := m.setApplicationName(ctx, conn); err != nil {
+		return nil, err
+	}
+
+	lockID := onceLockID("dblock graph " + m.sql.appliedTable)
+	release, err := m.acquireLock(ctx, conn, lockID)
+	switch {
+	case errors.Is(err, ErrLockBusy):
+		m.infof("Another instance is applying the migration graph.")
+		m.resetApplicationName(ctx, conn)
+		_ = conn.Close()
+		locked, err := m.waitForGraph(ctx, order, timeout, lockID)
+		if err != nil || locked == nil {
+			return nil, err
+		}
+		conn, release = locked.conn, locked.release
+		defer conn.Close()
+	case err != nil:
+		m.resetApplicationName(ctx, conn)
+		return nil, err
+	}
+	defer func() {
+		if release() == nil {
+			m.resetApplicationName(ctx, conn)
+		}
+	}()
+
+	if m.cfg.MigrationRole != "" {
+		if err := m.setRole(ctx, conn); err != nil {
+			return nil, err
+		}
+		defer m.resetRole(ctx, conn)
+	}
+
+	pending, err := m.pendingNodes(ctx, conn, order)
+	if err != nil {
+		return nil, err
+	}
+	var applied []string
+	for _, n := range pending {
+		m.infof("Applying migration %s...", n.ID)
+		if err := m.applyNode(ctx, conn, n); err != nil {
+			return applied, err
+		}
+		applied = append(applied, n.ID)
+	}
+	m.infof("Migration graph complete.")
+	return applied, nil
+}
+
+func (m *Migrator) ensureAppliedTable(ctx context.Context, q Queryer) error {
+	_, err := q.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id TEXT PRIMARY KEY,
+			checksum TEXT NOT NULL DEFAULT '',
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`, m.sql.appliedTable))
+	if err != nil {
+		return m.logErrorf("Failed to initialize applied migrations table: %w", err)
+	}
+	if !m.cfg.History {
+		return nil
+	}
+	// Only written with History, tables created without it lack them.
+	_, err = q.ExecContext(ctx, fmt.Sprintf(`
+		ALTER TABLE %s
+			ADD COLUMN IF NOT EXISTS instance_id TEXT NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}'
+	`, m.sql.appliedTable))
+	if err != nil {
+		return m.logErrorf("Failed to initialize applied migrations table: %w", err)
+	}
+	return nil
+}
+
+func (m *Migrator) pendingNodes(ctx context.Context, q Queryer, order []Node) ([]Node, error) {
+	var pending []Node
+	query := fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE id = $1)", m.sql.appliedTable)
+	for _, n := range order {
+		var applied bool
+		if err := q.QueryRowContext(ctx, query, n.ID).Scan(&applied); err != nil {
+			return nil, m.logErrorf("Failed to check migration %s: %w", n.ID, err)
+		}
+		if !applied {
+			pending = append(pending, n)
+		}
+	}
+	return pending, nil
+}
+
+func (m *Migrator) applyNode(ctx context.Context, conn *sql.Conn, n Node) error {
+	tx, err := m.beginTx(ctx, conn, &sql.TxOptions{Isolation: m.cfg.Isolation})
+	if err != nil {
+		return m.logErrorf("Failed to start transaction: %w", err)
+	}
+	if n.Up != nil {
+		if err := safeCall(func() error { return n.Up(tx) }); err != nil {
+			_ = tx.Rollback()
+			return m.logErrorf("Failed to apply migration %s: %w", n.ID, err)
+		}
+	}
+	if err := m.recordNode(ctx, tx, n); err != nil {
+		_ = tx.Rollback()
+		return m.logErrorf("Failed to record migration %s: %w", n.ID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return m.logErrorf("Failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// recordNode marks n as applied, with the instance and Metadata if History
+// is set.
+func (m *Migrator) recordNode(ctx context.Context, tx *sql.Tx, n Node) error {
+	if !m.cfg.History {
+		query := fmt.Sprintf("INSERT INTO %s (id, checksum) VALUES ($1, $2)", m.sql.appliedTable)
+		_, err := tx.ExecContext(ctx, query, n.ID, n.Checksum)
+		return err
+	}
+	metadata, err := encodeMetadata(m.cfg.Metadata)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("INSERT INTO %s (id, checksum, instance_id, metadata) VALUES ($1, $2, $3, $4)", m.sql.appliedTable)
+	_, err = tx.ExecContext(ctx, query, n.ID, n.Checksum, m.instanceID, string(metadata))
+	return err
+}
+
+// waitForGraph waits for another instance to apply every node, returning a
+// connection holding lockID instead if that instance went away first.
+func (m *Migrator) waitForGraph(ctx context.Context, order []Node, timeout time.Duration, lockID int) (*lockedConn, error) {
+	deadline := m.now().Add(timeout)
+	for m.now().Before(deadline) {
+		if err := sleep(ctx, checkInterval); err != nil {
+			return nil, err
+		}
+		pending, err := m.pendingNodes(ctx, m.db, order)
+		if err != nil {
+			return nil, err
+		}
+		if len(pending) == 0 {
+			m.infof("Migration graph was applied by another instance.")
+			return nil, nil
+		}
+
+		locked, err := m.tryTakeOver(ctx, lockID)
+		if err != nil {
+			return nil, err
+		}
+		if locked != nil {
+			m.infof("Lock holder went away with %d migrations pending, taking over the migration graph.", len(pending))
+			return locked, nil
+		}
+	}
+	return nil, m.logErrorf("%w waiting for the migration graph after %v", ErrTimeout, timeout)
+}
@@ -0,0 +1,136 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func ids(nodes []Node) string {
+	var s []string
+	for _, n := range nodes {
+		s = append(s, n.ID)
+	}
+	return fmt.Sprint(s)
+}
+
+func TestGraphOrderDiamond(t *testing.T) {
+	//     users
+	//     /   \
+	// emails  orders
+	//     \   /
+	//    reports
+	g := Graph{
+		{ID: "reports", DependsOn: []string{"orders", "emails"}},
+		{ID: "orders", DependsOn: []string{"users"}},
+		{ID: "emails", DependsOn: []string{"users"}},
+		{ID: "users"},
+	}
+	order, err := g.Order()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(order), "[users emails orders reports]"; got != want {
+		t.Errorf("order %s, want %s", got, want)
+	}
+}
+
+func TestGraphOrderInvalid(t *testing.T) {
+	for name, tc := range map[string]struct {
+		g    Graph
+		want error
+	}{
+		"cycle": {Graph{
+			{ID: "a", DependsOn: []string{"c"}},
+			{ID: "b", DependsOn: []string{"a"}},
+			{ID: "c", DependsOn: []string{"b"}},
+			{ID: "d"},
+		}, ErrCycle},
+		"self":         {Graph{{ID: "a", DependsOn: []string{"a"}}}, ErrCycle},
+		"unknown node": {Graph{{ID: "a", DependsOn: []string{"b"}}}, ErrInvalidGraph},
+		"duplicate":    {Graph{{ID: "a"}, {ID: "a"}}, ErrInvalidGraph},
+		"no ID":        {Graph{{}}, ErrInvalidGraph},
+	} {
+		if _, err := tc.g.Order(); !errors.Is(err, tc.want) {
+			t.Errorf("%s: error = %v, want %v", name, err, tc.want)
+		}
+	}
+}
+
+// keyLocker is a Locker that records the keys it was asked for.
+type keyLocker struct{ keys []int }
+
+func (l *keyLocker) Acquire(_ context.Context, key int) (func(), error) {
+	l.keys = append(l.keys, key)
+	return func() {}, nil
+}
+
+func TestUpgradeGraphUsesUpgradeSettings(t *testing.T) {
+	fake := &fakeDB{query: func(string, []driver.NamedValue) (driver.Rows, error) {
+		return &fakeRows{cols: []string{"exists"}, values: [][]driver.Value{{false}}}, nil
+	}}
+	locker := &keyLocker{}
+	var began int
+	m := New(fake.open(t), Config{
+		Locker:        locker,
+		MigrationRole: "migrator",
+		History:       true,
+		Silent:        true,
+		BeginTx: func(ctx context.Context, conn *sql.Conn, opts *sql.TxOptions) (*sql.Tx, error) {
+			began++
+			return conn.BeginTx(ctx, opts)
+		},
+	})
+	applied, err := m.UpgradeGraph(context.Background(), Graph{{ID: "users"}, {ID: "orders", DependsOn: []string{"users"}}}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(applied) != "[users orders]" {
+		t.Errorf("applied %v, want [users orders]", applied)
+	}
+	if len(locker.keys) != 1 {
+		t.Errorf("Locker asked for %v, want one key", locker.keys)
+	}
+	if began != 2 {
+		t.Errorf("BeginTx called %d times, want 2", began)
+	}
+
+	statements := fake.recorded()
+	for _, stmt := range statements {
+		if strings.Contains(stmt, "advisory") {
+			t.Errorf("ran %q with a Locker", stmt)
+		}
+	}
+	setRole := slices.Index(statements, `SET ROLE "migrator"`)
+	resetRole := slices.Index(statements, "RESET ROLE")
+	if setRole < 0 || resetRole < setRole {
+		t.Errorf("role not set and reset around the nodes, ran %q", statements)
+	}
+	recorded := slices.IndexFunc(statements, func(stmt string) bool {
+		return strings.Contains(stmt, "schema_version_applied") && strings.Contains(stmt, "instance_id, metadata")
+	})
+	if recorded < setRole || recorded > resetRole {
+		t.Errorf("nodes not recorded with their instance as the migration role, ran %q", statements)
+	}
+}
+
+func TestUpgradeGraphNoLock(t *testing.T) {
+	fake := &fakeDB{query: func(string, []driver.NamedValue) (driver.Rows, error) {
+		return &fakeRows{cols: []string{"exists"}, values: [][]driver.Value{{false}}}, nil
+	}}
+	m := New(fake.open(t), Config{NoLock: true, Silent: true})
+	if _, err := m.UpgradeGraph(context.Background(), Graph{{ID: "users"}}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range fake.recorded() {
+		if strings.Contains(stmt, "advisory") {
+			t.Errorf("ran %q with NoLock", stmt)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var ErrInconsistentState = errors.New("schema version and history disagree")
+
+// History statuses. Failed attempts are recorded after their transaction
+// rolled back and never count as applied.
+const (
+	HistoryApplied = "applied"
+	HistoryFailed  = "failed"
+)
+
+// historyStatus reads a row's status even from tables that predate the
+// column, where every row is an applied step.
+const historyStatus = "coalesce(to_jsonb(h)->>'status', 'applied')"
+
+func (m *Migrator) ensureHistoryTable(ctx context.Context, q Queryer) error {
+	_, err := q.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			version INTEGER NOT NULL,
+			checksum TEXT NOT NULL DEFAULT '',
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`, m.sql.historyTable))
+	if err != nil {
+		return m.logErrorf("Failed to initialize history table: %w", err)
+	}
+	// Added later, tables from older releases lack them.
+	_, err = q.ExecContext(ctx, fmt.Sprintf(`
+		ALTER TABLE %s
+			ADD COLUMN IF NOT EXISTS instance_id TEXT NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}',
+			ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'applied',
+			ADD COLUMN IF NOT EXISTS error TEXT NOT NULL DEFAULT ''
+	`, m.sql.historyTable))
+	if err != nil {
+		return m.logErrorf("Failed to initialize history table: %w", err)
+	}
+	return nil
+}
+
+func (m *Migrator) recordHistory(ctx context.Context, tx *sql.Tx, mig Migration) error {
+	if err := m.insertHistory(ctx, tx, mig); err != nil {
+		return m.logErrorf("Failed to record history for version %d: %w", mig.Version, err)
+	}
+	return nil
+}
+
+func (m *Migrator) insertHistory(ctx context.Context, tx *sql.Tx, mig Migration) error {
+	metadata, err := encodeMetadata(m.cfg.Metadata)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("INSERT INTO %s (version, checksum, instance_id, metadata) VALUES ($1, $2, $3, $4)", m.sql.historyTable)
+	_, err = tx.ExecContext(ctx, query, mig.Version, mig.Checksum, m.instanceID, string(metadata))
+	return err
+}
+
+// recordFailedAttempt records that mig failed with cause. The step's
+// transaction is gone, so it is written on its own on conn. It is
+// best-effort: a failure to record only costs a warning.
+func (m *Migrator) recordFailedAttempt(ctx context.Context, conn *sql.Conn, mig Migration, cause error) {
+	if !m.cfg.History {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	if err := m.ensureHistoryTable(ctx, conn); err != nil {
+		return
+	}
+	metadata, err := encodeMetadata(m.cfg.Metadata)
+	if err != nil {
+		m.warnf("Failed attempt at version %d not recorded: %v", mig.Version, err)
+		return
+	}
+	query := fmt.Sprintf(`
+		INSERT INTO %s (version, checksum, instance_id, metadata, status, error)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, m.sql.historyTable)
+	if _, err := conn.ExecContext(ctx, query, mig.Version, mig.Checksum, m.instanceID, string(metadata), HistoryFailed, cause.Error()); err != nil {
+		m.warnf("Failed attempt at version %d not recorded: %v", mig.Version, err)
+	}
+}
+
+// recordStepHistory records an applied step. Unless StrictHistory is set, a
+// history table that is missing or not writable only costs a warning: the
+// insert runs in a savepoint so the version bump can still commit.
+func (m *Migrator) recordStepHistory(ctx context.Context, tx *sql.Tx, mig Migration) error {
+	if m.cfg.StrictHistory {
+		return m.recordHistory(ctx, tx, mig)
+	}
+
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT dblock_history"); err != nil {
+		return m.logErrorf("Failed to create savepoint: %w", err)
+	}
+	err := m.insertHistory(ctx, tx, mig)
+	switch {
+	case err == nil:
+		_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT dblock_history")
+	case isHistoryUnavailable(err):
+		m.warnf("History not recorded for version %d: %v", mig.Version, err)
+		_, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT dblock_history")
+	default:
+		return m.logErrorf("Failed to record history for version %d: %w", mig.Version, err)
+	}
+	if err != nil {
+		return m.logErrorf("Failed to release savepoint: %w", err)
+	}
+	return nil
+}
+
+// checkConsistency fails if History is on and the highest version in the
+// history isn't version, e.g. after a half-done downgrade or a manual edit.
+// An empty or missing history table passes, as after turning History on.
+// Unless StrictHistory is set, a history behind the version passes too:
+// recordStepHistory may have skipped steps it couldn't record.
+func (m *Migrator) checkConsistency(ctx context.Context, q Queryer, version int) error {
+	if !m.cfg.History {
+		return nil
+	}
+
+	var maxApplied sql.NullInt64
+	err := q.QueryRowContext(ctx, fmt.Sprintf("SELECT max(version) FROM %s h WHERE %s = 'applied'", m.sql.historyTable, historyStatus)).Scan(&maxApplied)
+	switch {
+	case isUndefinedTable(err):
+		return nil
+	case err != nil:
+		return m.logErrorf("Failed to read history: %w", err)
+	case !maxApplied.Valid, int(maxApplied.Int64) == version:
+		return nil
+	case int(maxApplied.Int64) < version && !m.cfg.StrictHistory:
+		m.warnf("History's latest version is %d, behind version %d, steps in between weren't recorded", maxApplied.Int64, version)
+		return nil
+	default:
+		return m.logErrorf("%w: version is %d but the history's latest version is %d",
+			ErrInconsistentState, version, maxApplied.Int64)
+	}
+}
+
+// forceHistory makes the history agree with a forced version: later entries
+// are dropped and the forced version is recorded with checksum "forced".
+func (m *Migrator) forceHistory(ctx context.Context, tx *sql.Tx, version int) error {
+	if err := m.ensureHistoryTable(ctx, tx); err != nil {
+		return err
+	}
+	query := fmt.Sprintf("DELETE FROM %s WHERE version >= $1", m.sql.historyTable)
+	if _, err := tx.ExecContext(ctx, query, version); err != nil {
+		return m.logErrorf("Failed to rewrite history: %w", err)
+	}
+	return m.recordHistory(ctx, tx, Migration{Version: version, Checksum: "forced"})
+}
+
+// encodeMetadata encodes a nil map as {} rather than null.
+func encodeMetadata(metadata map[string]string) ([]byte, error) {
+	if metadata == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(metadata)
+}
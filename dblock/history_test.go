@@ -0,0 +1,134 @@
+package dblock_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"dblock/dblock"
+)
+
+func TestConsistencyCheck(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	cfg := s.Config
+	cfg.History = true
+	m := dblock.New(s.DB, cfg)
+	if _, err := m.Upgrade(ctx, 2, nil, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// A half-done downgrade moved the version but not the history.
+	if _, err := s.DB.Exec("UPDATE schema_version SET version = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Upgrade(ctx, 3, nil, time.Minute); !errors.Is(err, dblock.ErrInconsistentState) {
+		t.Errorf("error = %v, want ErrInconsistentState", err)
+	}
+	if _, err := s.Migrator().Upgrade(ctx, 3, nil, time.Minute); err != nil {
+		t.Errorf("Upgrade without History: %v", err)
+	}
+}
+
+func TestConsistencyCheckWithoutHistory(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	if _, err := s.Migrator().Upgrade(ctx, 2, nil, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Turning History on later starts from a missing history table.
+	cfg := s.Config
+	cfg.History = true
+	if _, err := dblock.New(s.DB, cfg).Upgrade(ctx, 3, nil, time.Minute); err != nil {
+		t.Errorf("Upgrade after turning History on: %v", err)
+	}
+}
+
+func TestHistoryMetadata(t *testing.T) {
+	s := newSandbox(t)
+	cfg := s.Config
+	cfg.History = true
+	cfg.Metadata = map[string]string{"git_sha": "abc123", "deploy_id": "42"}
+	if _, err := dblock.New(s.DB, cfg).Upgrade(context.Background(), 1, nil, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	var sha, deploy string
+	err := s.DB.QueryRow("SELECT metadata->>'git_sha', metadata->>'deploy_id' FROM schema_version_history WHERE version = 1").Scan(&sha, &deploy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha != "abc123" || deploy != "42" {
+		t.Errorf("metadata git_sha=%q deploy_id=%q, want abc123 and 42", sha, deploy)
+	}
+}
+
+func TestHistoryRecordsFailedAttempt(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	cfg := s.Config
+	cfg.History = true
+	m := dblock.New(s.DB, cfg)
+	if _, err := m.Upgrade(ctx, 1, nil, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	errStep := errors.New("column already exists")
+	steps := dblock.Migrations{{Version: 2, Up: func(*sql.Tx) error { return errStep }}}
+	if _, err := m.UpgradeSteps(ctx, steps, time.Minute); !errors.Is(err, errStep) {
+		t.Fatalf("error = %v, want %v", err, errStep)
+	}
+
+	var version int
+	if err := s.DB.QueryRow("SELECT version FROM schema_version").Scan(&version); err != nil || version != 1 {
+		t.Errorf("version = %d, %v, want 1", version, err)
+	}
+	var status, msg string
+	err := s.DB.QueryRow("SELECT status, error FROM schema_version_history WHERE version = 2").Scan(&status, &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != dblock.HistoryFailed || !strings.Contains(msg, errStep.Error()) {
+		t.Errorf("history status=%q error=%q, want a failure with %q", status, msg, errStep)
+	}
+	if err := s.DB.QueryRow("SELECT status FROM schema_version_history WHERE version = 1").Scan(&status); err != nil || status != dblock.HistoryApplied {
+		t.Errorf("version 1 status = %q, %v, want %q", status, err, dblock.HistoryApplied)
+	}
+}
+
+func TestUpgradeAfterLenientHistorySkip(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	cfg := s.Config
+	cfg.History = true
+	m := dblock.New(s.DB, cfg)
+	if _, err := m.Upgrade(ctx, 1, nil, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// The history becomes unwritable, as for a MigrationRole without
+	// rights on it, so version 2 commits without a history entry.
+	if _, err := s.DB.Exec("REVOKE INSERT ON schema_version_history FROM current_user"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Upgrade(ctx, 2, nil, time.Minute); err != nil {
+		t.Fatalf("lenient Upgrade with an unwritable history: %v", err)
+	}
+	if _, err := s.DB.Exec("GRANT INSERT ON schema_version_history TO current_user"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Upgrade(ctx, 3, nil, time.Minute); err != nil {
+		t.Errorf("Upgrade after the skipped history entry: %v", err)
+	}
+	strict := cfg
+	strict.StrictHistory = true
+	if _, err := s.DB.Exec("UPDATE schema_version SET version = 4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dblock.New(s.DB, strict).Upgrade(ctx, 5, nil, time.Minute); !errors.Is(err, dblock.ErrInconsistentState) {
+		t.Errorf("StrictHistory with the history behind: error = %v, want ErrInconsistentState", err)
+	}
+}
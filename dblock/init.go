@@ -0,0 +1,44 @@
+package dblock
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+var ErrNotEmpty = errors.New("database is not empty")
+
+func (m *Migrator) versionTableExists(ctx context.Context, q Queryer) (bool, error) {
+	var exists bool
+	if err := q.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", m.sql.table).Scan(&exists); err != nil {
+		return false, m.logErrorf("Failed to check for schema_version table: %w", err)
+	}
+	return exists, nil
+}
+
+// checkEmptyOnInit fails if schema_version is about to be created in a schema
+// that already holds tables other than dblock's own. The schema is the
+// version table's, or the current one if it isn't qualified.
+func (m *Migrator) checkEmptyOnInit(ctx context.Context, q Queryer) error {
+	exists, err := m.versionTableExists(ctx, q)
+	if err != nil || exists {
+		return err
+	}
+
+	var tables int
+	err = q.QueryRowContext(ctx, `
+		SELECT count(*) FROM information_schema.tables
+		WHERE table_schema = coalesce(nullif($1, ''), current_schema())
+			AND to_regclass(format('%I.%I', table_schema, table_name)) NOT IN (
+				SELECT to_regclass(name) FROM unnest($2::text[]) name WHERE to_regclass(name) IS NOT NULL
+			)
+	`, m.sql.schema, pq.Array(m.sql.ownTables())).Scan(&tables)
+	if err != nil {
+		return m.logErrorf("Failed to count existing tables: %w", err)
+	}
+	if tables > 0 {
+		return m.logErrorf("%w: schema_version is missing but %d other tables exist", ErrNotEmpty, tables)
+	}
+	return nil
+}
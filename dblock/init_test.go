@@ -0,0 +1,156 @@
+package dblock_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"dblock/dblock"
+)
+
+func TestRequireEmptyOnInitIgnoresDblockTables(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	for _, name := range []string{
+		"schema_version_history", "schema_version_applied", "schema_version_failure",
+		"schema_version_intent", "schema_version_run", "schema_version_once", "schema_version_checkpoint",
+	} {
+		if _, err := s.DB.ExecContext(ctx, "CREATE TABLE "+name+" (id INTEGER)"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := s.Config
+	cfg.RequireEmptyOnInit = true
+	if _, err := dblock.New(s.DB, cfg).Upgrade(ctx, 1, nil, time.Minute); err != nil {
+		t.Errorf("Upgrade with only dblock's tables: %v", err)
+	}
+}
+
+func TestRequireEmptyOnInitFindsApplicationTables(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	if _, err := s.DB.ExecContext(ctx, "CREATE TABLE users (id INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := s.Config
+	cfg.RequireEmptyOnInit = true
+	if _, err := dblock.New(s.DB, cfg).Upgrade(ctx, 1, nil, time.Minute); !errors.Is(err, dblock.ErrNotEmpty) {
+		t.Errorf("error = %v, want ErrNotEmpty", err)
+	}
+}
+
+func TestEnsureVersionTableReportsCreation(t *testing.T) {
+	s := newSandbox(t)
+	inits := 0
+	cfg := s.Config
+	cfg.OnFirstInit = func() { inits++ }
+	m := dblock.New(s.DB, cfg)
+	for i, want := range []bool{true, false, false} {
+		created, err := m.EnsureVersionTable(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created != want {
+			t.Errorf("call %d: created = %v, want %v", i+1, created, want)
+		}
+	}
+	if _, err := m.Upgrade(context.Background(), 1, nil, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if inits != 1 {
+		t.Errorf("OnFirstInit ran %d times, want 1", inits)
+	}
+}
+
+func TestConcurrentSeedInsertsOneRow(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	m := s.Migrator()
+	if _, err := m.EnsureVersionTable(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Leave the table but not its row, so the seeds race each other.
+	if _, err := s.DB.ExecContext(ctx, "DELETE FROM schema_version"); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		created int
+	)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := s.Migrator().EnsureVersionTable(ctx)
+			if err != nil {
+				t.Errorf("concurrent seed: %v", err)
+			}
+			if ok {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if created != 1 {
+		t.Errorf("%d seeds reported creating the row, want 1", created)
+	}
+	var rows int
+	if err := s.DB.QueryRowContext(ctx, "SELECT count(*) FROM schema_version").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Errorf("%d rows after concurrent seeding, want 1", rows)
+	}
+}
+
+// failingSeed is Postgres with a seed that always fails, to crash between
+// creating the version table and seeding it.
+type failingSeed struct{ dblock.Dialect }
+
+func (failingSeed) SeedSQL(table, column string, initialVersion int) string {
+	return "SELECT no_such_function()"
+}
+
+func TestInitIsAtomic(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	tableExists := func() bool {
+		t.Helper()
+		var exists bool
+		if err := s.DB.QueryRowContext(ctx, "SELECT to_regclass('schema_version') IS NOT NULL").Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		return exists
+	}
+
+	cfg := s.Config
+	cfg.Dialect = failingSeed{dblock.Postgres}
+	if _, err := dblock.New(s.DB, cfg).EnsureVersionTable(ctx); err == nil {
+		t.Fatal("EnsureVersionTable succeeded with a failing seed")
+	}
+	if tableExists() {
+		t.Error("failed init left the version table behind")
+	}
+
+	// Two statements leave the unseeded table, which is the caveat.
+	cfg.NonTransactionalInit = true
+	if _, err := dblock.New(s.DB, cfg).EnsureVersionTable(ctx); err == nil {
+		t.Fatal("EnsureVersionTable succeeded with a failing seed")
+	}
+	if !tableExists() {
+		t.Error("NonTransactionalInit rolled back the CREATE TABLE")
+	}
+
+	created, err := s.Migrator().EnsureVersionTable(ctx)
+	if err != nil || !created {
+		t.Errorf("EnsureVersionTable after the failures = %v, %v, want the table seeded", created, err)
+	}
+}
@@ -0,0 +1,57 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+)
+
+func defaultInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// ApplicationNamer is implemented by dialects that can label a session with
+// Config.ApplicationName. Sessions of other dialects stay unlabeled.
+type ApplicationNamer interface {
+	// SetApplicationNameSQL sets the session's name to its one parameter.
+	SetApplicationNameSQL() string
+	ResetApplicationNameSQL() string
+}
+
+// SET doesn't take parameters.
+func (postgresDialect) SetApplicationNameSQL() string {
+	return "SELECT set_config('application_name', $1, false)"
+}
+
+func (postgresDialect) ResetApplicationNameSQL() string {
+	return "RESET application_name"
+}
+
+// setApplicationName labels conn in pg_stat_activity, which is also where
+// LockBusyError and Status get the holder's name from.
+func (m *Migrator) setApplicationName(ctx context.Context, conn *sql.Conn) error {
+	d, ok := m.sql.dialect.(ApplicationNamer)
+	if !ok {
+		return nil
+	}
+	if _, err := conn.ExecContext(ctx, d.SetApplicationNameSQL(), m.cfg.ApplicationName); err != nil {
+		return m.logErrorf("Failed to set application_name: %w", err)
+	}
+	return nil
+}
+
+func (m *Migrator) resetApplicationName(ctx context.Context, conn *sql.Conn) {
+	d, ok := m.sql.dialect.(ApplicationNamer)
+	if !ok {
+		return
+	}
+	if _, err := conn.ExecContext(context.WithoutCancel(ctx), d.ResetApplicationNameSQL()); err != nil {
+		_ = m.logErrorf("Failed to reset application_name: %w", err)
+		discardConn(conn)
+	}
+}
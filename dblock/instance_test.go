@@ -0,0 +1,61 @@
+package dblock_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"dblock/dblock"
+)
+
+func TestInstanceID(t *testing.T) {
+	s := newSandbox(t)
+	cfg := s.Config
+	cfg.History = true
+	cfg.InstanceID = func() string { return "pod-7" }
+	var appName string
+	_, err := dblock.New(s.DB, cfg).Upgrade(context.Background(), 1, func(tx *sql.Tx) error {
+		return tx.QueryRow("SHOW application_name").Scan(&appName)
+	}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if appName != "dblock-migrator pod-7" {
+		t.Errorf("application_name = %q, want %q", appName, "dblock-migrator pod-7")
+	}
+	var instance string
+	if err := s.DB.QueryRow("SELECT instance_id FROM schema_version_history WHERE version = 1").Scan(&instance); err != nil {
+		t.Fatal(err)
+	}
+	if instance != "pod-7" {
+		t.Errorf("history instance_id = %q, want pod-7", instance)
+	}
+}
+
+func TestApplicationNameInPgStatActivity(t *testing.T) {
+	s := newSandbox(t)
+	cfg := s.Config
+	cfg.ApplicationName = "migrator " + s.Schema
+	count := func() int {
+		var n int
+		if err := s.DB.QueryRow("SELECT count(*) FROM pg_stat_activity WHERE application_name = $1", cfg.ApplicationName).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	during := 0
+	_, err := dblock.New(s.DB, cfg).Upgrade(context.Background(), 1, func(*sql.Tx) error {
+		during = count()
+		return nil
+	}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if during != 1 {
+		t.Errorf("%d backends named %q during the upgrade, want 1", during, cfg.ApplicationName)
+	}
+	if after := count(); after != 0 {
+		t.Errorf("%d backends still named %q after the upgrade", after, cfg.ApplicationName)
+	}
+}
@@ -0,0 +1,121 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// ErrHalfApplied means a step on a database without transactional DDL
+// started but its version bump never committed, so its DDL may be partly
+// in place.
+var ErrHalfApplied = errors.New("migration step may be half-applied")
+
+// TransactionalDDL is implemented by dialects that can say whether DDL rolls
+// back with its transaction. Dialects that don't implement it are taken to
+// have transactional DDL, like Postgres.
+type TransactionalDDL interface {
+	TransactionalDDL() bool
+}
+
+// Without transactional DDL (e.g. MySQL, where DDL commits implicitly) a
+// crash or error between a step's DDL and its version bump can't be rolled
+// back. dblock then records an intent in the version table's _intent table
+// (schema_version_intent by default) before each step and removes it once
+// the version bump committed. A leftover intent makes every later upgrade
+// fail with ErrHalfApplied: dblock can't tell how far the step got, so an
+// operator has to finish or revert it by hand and then call ForceVersion,
+// which clears the intents.
+
+func (m *Migrator) transactionalDDL() bool {
+	t, ok := m.sql.dialect.(TransactionalDDL)
+	return !ok || t.TransactionalDDL()
+}
+
+// intentDialect returns the StateDialect intents are recorded with. Without
+// transactional DDL a dialect must have one, or a half-applied step would go
+// unnoticed.
+func (m *Migrator) intentDialect() (StateDialect, error) {
+	d, ok := m.stateDialect()
+	if !ok {
+		return nil, m.logErrorf("Dialect %T has no transactional DDL, so it must implement StateDialect", m.sql.dialect)
+	}
+	return d, nil
+}
+
+func (m *Migrator) ensureIntentTable(ctx context.Context, q Queryer, d StateDialect) error {
+	if _, err := q.ExecContext(ctx, d.CreateIntentTableSQL(m.sql.intentTable)); err != nil {
+		return m.logErrorf("Failed to initialize %s table: %w", m.sql.intentTable, err)
+	}
+	return nil
+}
+
+func (m *Migrator) checkIntent(ctx context.Context, conn *sql.Conn) error {
+	if m.transactionalDDL() {
+		return nil
+	}
+	d, err := m.intentDialect()
+	if err != nil {
+		return err
+	}
+	if err := m.ensureIntentTable(ctx, conn, d); err != nil {
+		return err
+	}
+
+	var version int
+	err = conn.QueryRowContext(ctx, "SELECT min(version) FROM "+m.sql.intentTable+" HAVING count(*) > 0").Scan(&version)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil
+	case err != nil:
+		return m.logErrorf("Failed to read %s: %w", m.sql.intentTable, err)
+	}
+	return m.logErrorf("%w: version %d started but never finished", ErrHalfApplied, version)
+}
+
+func (m *Migrator) recordIntent(ctx context.Context, conn *sql.Conn, version int) error {
+	if m.transactionalDDL() {
+		return nil
+	}
+	d, err := m.intentDialect()
+	if err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, d.InsertIntentSQL(m.sql.intentTable), version); err != nil {
+		return m.logErrorf("Failed to record intent for version %d: %w", version, err)
+	}
+	return nil
+}
+
+func (m *Migrator) clearIntent(ctx context.Context, q Queryer, version int) error {
+	if m.transactionalDDL() {
+		return nil
+	}
+	d, err := m.intentDialect()
+	if err != nil {
+		return err
+	}
+	if _, err := q.ExecContext(ctx, d.DeleteIntentSQL(m.sql.intentTable), version); err != nil {
+		return m.logErrorf("Failed to clear intent for version %d: %w", version, err)
+	}
+	return nil
+}
+
+// clearIntents drops all intents after the operator forced a version.
+func (m *Migrator) clearIntents(ctx context.Context, tx *sql.Tx) error {
+	if m.transactionalDDL() {
+		return nil
+	}
+	d, ok := m.stateDialect()
+	if !ok {
+		// No intents were ever recorded.
+		return nil
+	}
+	if err := m.ensureIntentTable(ctx, tx, d); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+m.sql.intentTable); err != nil {
+		return m.logErrorf("Failed to clear intents: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// LintError reports the migration step that failed to apply during Lint.
+type LintError struct {
+	Version int
+	Err     error
+}
+
+func (e *LintError) Error() string {
+	return fmt.Sprintf("migration %d failed: %v", e.Version, e.Err)
+}
+
+func (e *LintError) Unwrap() error {
+	return e.Err
+}
+
+// Lint applies migrations in order inside a throwaway schema without touching
+// schema_version. Everything runs in a single transaction that is always
+// rolled back, so nothing is left behind. Only unqualified object names land
+// in the throwaway schema, so run it against a test database. Steps with NoTx
+// can't run inside the transaction and are skipped. It stops at
+// the first failing step and returns a *LintError for it.
+func Lint(ctx context.Context, db *sql.DB, migrations Migrations) error {
+	sorted, err := migrations.sorted(0)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	schema := quoteIdentifier(fmt.Sprintf("dblock_lint_%d", time.Now().UnixNano()))
+	if _, err := tx.ExecContext(ctx, "CREATE SCHEMA "+schema); err != nil {
+		return fmt.Errorf("failed to create lint schema: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "SET LOCAL search_path TO "+schema); err != nil {
+		return fmt.Errorf("failed to set search_path: %w", err)
+	}
+
+	for _, mig := range sorted {
+		if mig.NoTx != nil || mig.Up == nil {
+			continue
+		}
+		if err := mig.Up(tx); err != nil {
+			return &LintError{Version: mig.Version, Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package dblock_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"dblock/dblock"
+)
+
+func TestLintLeavesNothingBehind(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	migrations := dblock.Migrations{
+		{Version: 1, Up: func(tx *sql.Tx) error {
+			_, err := tx.Exec("CREATE TABLE linted (id INTEGER)")
+			return err
+		}},
+		{Version: 2, NoTx: func(context.Context, *sql.Conn) error {
+			t.Error("Lint ran a NoTx step")
+			return nil
+		}},
+		{Version: 3, Up: func(tx *sql.Tx) error {
+			_, err := tx.Exec("ALTER TABLE linted ADD COLUMN name TEXT")
+			return err
+		}},
+	}
+	if err := dblock.Lint(ctx, s.DB, migrations); err != nil {
+		t.Fatal(err)
+	}
+
+	var tables int
+	if err := s.DB.QueryRowContext(ctx, "SELECT count(*) FROM information_schema.tables WHERE table_name = 'linted'").Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Errorf("%d linted tables left behind", tables)
+	}
+}
+
+func TestLintReportsFailingStep(t *testing.T) {
+	s := newSandbox(t)
+	migrations := dblock.Migrations{
+		{Version: 1, Up: func(tx *sql.Tx) error {
+			_, err := tx.Exec("CREATE TABLE linted (id INTEGER)")
+			return err
+		}},
+		{Version: 2, Up: func(tx *sql.Tx) error {
+			_, err := tx.Exec("ALTER TABLE missing ADD COLUMN name TEXT")
+			return err
+		}},
+	}
+	err := dblock.Lint(context.Background(), s.DB, migrations)
+	var lintErr *dblock.LintError
+	if !errors.As(err, &lintErr) || lintErr.Version != 2 {
+		t.Errorf("error = %v, want a LintError for version 2", err)
+	}
+}
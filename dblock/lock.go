@@ -0,0 +1,195 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrLockBusy = errors.New("advisory lock is already held by another process")
+
+// Locker coordinates upgrades through something other than Postgres advisory
+// locks, e.g. an etcd lease or a Kubernetes Lease. Acquire must not block
+// while another instance holds key: it returns an error matching ErrLockBusy
+// and dblock waits for the version instead, retrying Acquire as it polls.
+// Reading and bumping the version still happens in the database.
+type Locker interface {
+	Acquire(ctx context.Context, key int) (release func(), err error)
+}
+
+// LockHolder describes the backend holding an advisory lock.
+type LockHolder struct {
+	PID             int
+	ApplicationName string
+	QueryStart      time.Time
+}
+
+// LockBusyError is returned when the advisory lock is held elsewhere. Holder
+// is nil if the holding backend could not be determined.
+type LockBusyError struct {
+	LockID int
+	Holder *LockHolder
+}
+
+func (e *LockBusyError) Error() string {
+	if e.Holder == nil {
+		return fmt.Sprintf("advisory lock %d is already held by another process", e.LockID)
+	}
+	return fmt.Sprintf("advisory lock %d is already held by pid %d (application_name %q, query started %s)",
+		e.LockID, e.Holder.PID, e.Holder.ApplicationName, e.Holder.QueryStart.Format(time.RFC3339))
+}
+
+func (e *LockBusyError) Is(target error) bool {
+	return target == ErrLockBusy
+}
+
+// lockHolder looks up the backend holding lockID. It is best-effort and
+// returns nil if the holder can't be determined.
+func lockHolder(ctx context.Context, q Queryer, lockID int) *LockHolder {
+	var (
+		h          LockHolder
+		queryStart sql.NullTime
+	)
+	err := q.QueryRowContext(ctx, `
+		SELECT a.pid, a.application_name, a.query_start
+		FROM pg_locks l JOIN pg_stat_activity a ON a.pid = l.pid
+		WHERE l.locktype = 'advisory' AND l.granted AND l.objsubid = 1
+			AND ((l.classid::bigint << 32) | l.objid::bigint) = $1
+		LIMIT 1
+	`, lockID).Scan(&h.PID, &h.ApplicationName, &queryStart)
+	if err != nil {
+		return nil
+	}
+	h.QueryStart = queryStart.Time
+	return &h
+}
+
+// ctxLock marks a context whose caller holds lockID on db through WithLock.
+type ctxLock struct {
+	db     *sql.DB
+	lockID int
+}
+
+type ctxLockKey struct{}
+
+// WithLock holds the upgrade lock for targetVersion while fn runs, so that a
+// sequence such as upgrade, seed, verify is exclusive as a whole. Methods
+// called with the ctx passed to fn don't take that lock again; peers trying
+// to upgrade to targetVersion wait for it as usual. It fails with an error
+// matching ErrLockBusy if the lock is held elsewhere.
+func (m *Migrator) WithLock(ctx context.Context, targetVersion int, fn func(ctx context.Context) error) error {
+	lockID, err := lockIDFor(m.cfg.LockBase, targetVersion)
+	if err != nil {
+		return err
+	}
+	if m.holdsLock(ctx, lockID) {
+		return fn(ctx)
+	}
+
+	conn, err := m.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := m.setApplicationName(ctx, conn); err != nil {
+		return err
+	}
+	release, err := m.acquireLock(ctx, conn, lockID)
+	if err != nil {
+		m.resetApplicationName(ctx, conn)
+		return err
+	}
+	defer func() {
+		if release() == nil {
+			m.resetApplicationName(ctx, conn)
+		}
+	}()
+
+	return fn(context.WithValue(ctx, ctxLockKey{}, ctxLock{db: m.db, lockID: lockID}))
+}
+
+func (m *Migrator) holdsLock(ctx context.Context, lockID int) bool {
+	l, ok := ctx.Value(ctxLockKey{}).(ctxLock)
+	return ok && l.db == m.db && l.lockID == lockID
+}
+
+var ErrAdvisoryLocksUnsupported = errors.New("advisory locks are not supported")
+
+// ProbeAdvisoryLocks takes and releases an advisory lock on a reserved key to
+// check that the database supports them, failing with
+// ErrAdvisoryLocksUnsupported up front rather than in the middle of an
+// upgrade.
+func (m *Migrator) ProbeAdvisoryLocks(ctx context.Context) error {
+	conn, err := m.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	lockID := onceLockID("dblock advisory lock probe")
+	var locked, unlocked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", lockID).Scan(&locked); err != nil {
+		return m.logErrorf("%w: %v", ErrAdvisoryLocksUnsupported, err)
+	}
+	if !locked {
+		// Someone else is probing right now, which proves the point.
+		return nil
+	}
+	if err := conn.QueryRowContext(ctx, "SELECT pg_advisory_unlock($1)", lockID).Scan(&unlocked); err != nil {
+		discardConn(conn)
+		return m.logErrorf("%w: %v", ErrAdvisoryLocksUnsupported, err)
+	}
+	if !unlocked {
+		return m.logErrorf("%w: lock %d was taken but could not be released", ErrAdvisoryLocksUnsupported, lockID)
+	}
+	return nil
+}
+
+// LockPriority decides who gets the lock when several instances start an
+// upgrade at the same time, e.g. so a dedicated migration Job wins over app
+// pods that only call Upgrade in case it didn't run.
+type LockPriority int
+
+const (
+	PriorityNormal LockPriority = iota
+
+	// PriorityLow waits out the head start before trying the lock once.
+	// It usually finds the upgrade done or in progress and just waits.
+	PriorityLow
+
+	// PriorityHigh keeps retrying a busy lock for the head start before
+	// falling back to waiting.
+	PriorityHigh
+)
+
+const defaultPriorityHeadStart = 2 * time.Second
+
+// acquirePrioritized is acquireLock honoring Config.LockPriority.
+func (m *Migrator) acquirePrioritized(ctx context.Context, conn *sql.Conn, lockID int) (func() error, error) {
+	headStart := m.cfg.PriorityHeadStart
+	if headStart <= 0 {
+		headStart = defaultPriorityHeadStart
+	}
+
+	switch {
+	case m.cfg.LockPriority == PriorityLow:
+		m.debugf("Low lock priority, trying lock %d in %v", lockID, headStart)
+		if err := sleep(ctx, headStart); err != nil {
+			return nil, err
+		}
+	case m.cfg.LockPriority == PriorityHigh && !m.cfg.NoLock && !m.holdsLock(ctx, lockID):
+		deadline := m.now().Add(headStart)
+		for m.now().Before(deadline) {
+			release, err := m.tryLock(ctx, conn, lockID)
+			if err != nil || release != nil {
+				return release, err
+			}
+			if err := sleep(ctx, 100*time.Millisecond); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m.acquireLock(ctx, conn, lockID)
+}
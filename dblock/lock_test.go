@@ -0,0 +1,265 @@
+package dblock_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dblock/dblock"
+)
+
+func TestLockBusyError(t *testing.T) {
+	err := error(&dblock.LockBusyError{LockID: 7})
+	if !errors.Is(err, dblock.ErrLockBusy) {
+		t.Error("LockBusyError doesn't match ErrLockBusy")
+	}
+	if !strings.Contains(err.Error(), "7") {
+		t.Errorf("Error() = %q, want the lock ID", err)
+	}
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	err = &dblock.LockBusyError{LockID: 7, Holder: &dblock.LockHolder{PID: 42, ApplicationName: "migrator-a", QueryStart: start}}
+	for _, want := range []string{"42", "migrator-a", "2024-05-01T12:00:00Z"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Error() = %q, want %q in it", err, want)
+		}
+	}
+}
+
+func TestWithLockReportsHolder(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	_, pid := holdLock(t, s, s.Config.LockBase+2)
+
+	err := s.Migrator().WithLock(ctx, 2, func(context.Context) error {
+		t.Error("fn ran while another session held the lock")
+		return nil
+	})
+	var busy *dblock.LockBusyError
+	if !errors.As(err, &busy) {
+		t.Fatalf("error = %v, want a LockBusyError", err)
+	}
+	if busy.LockID != s.Config.LockBase+2 {
+		t.Errorf("LockID = %d, want %d", busy.LockID, s.Config.LockBase+2)
+	}
+	if busy.Holder == nil || busy.Holder.PID != pid {
+		t.Errorf("Holder = %+v, want pid %d", busy.Holder, pid)
+	}
+}
+
+// memLocker is a Locker for a single process.
+type memLocker struct {
+	mu   sync.Mutex
+	held map[int]bool
+	log  []string
+}
+
+func (l *memLocker) Acquire(_ context.Context, key int) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held[key] {
+		return nil, dblock.ErrLockBusy
+	}
+	l.held[key] = true
+	l.log = append(l.log, fmt.Sprintf("acquire %d", key))
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.held, key)
+		l.log = append(l.log, fmt.Sprintf("release %d", key))
+	}, nil
+}
+
+func TestCustomLocker(t *testing.T) {
+	s := newSandbox(t)
+	locker := &memLocker{held: map[int]bool{}}
+	cfg := s.Config
+	cfg.Locker = locker
+
+	var runs, inside, maxInside atomic.Int32
+	up := func(*sql.Tx) error {
+		runs.Add(1)
+		n := inside.Add(1)
+		defer inside.Add(-1)
+		if n > maxInside.Load() {
+			maxInside.Store(n)
+		}
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := dblock.New(s.DB, cfg).Upgrade(context.Background(), 1, up, time.Minute); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if runs.Load() != 1 || maxInside.Load() != 1 {
+		t.Errorf("Up ran %d times, at most %d at once, want once", runs.Load(), maxInside.Load())
+	}
+	// Late instances may take the lock after the upgrade just to find the
+	// version reached, but never while someone else holds it.
+	key := s.Config.LockBase + 1
+	if len(locker.log) == 0 || len(locker.log)%2 != 0 {
+		t.Fatalf("locker saw %v, want acquire and release pairs", locker.log)
+	}
+	for i, entry := range locker.log {
+		want := fmt.Sprintf("acquire %d", key)
+		if i%2 == 1 {
+			want = fmt.Sprintf("release %d", key)
+		}
+		if entry != want {
+			t.Errorf("locker saw %v, want alternating acquire and release of %d", locker.log, key)
+			break
+		}
+	}
+}
+
+func TestSharedLockKeyBlocks(t *testing.T) {
+	s := newSandbox(t)
+	shared := s.Config.LockBase - 1
+	holder, _ := holdLock(t, s, shared)
+
+	cfg := s.Config
+	cfg.SharedLockKey = shared
+	up := func(*sql.Tx) error {
+		t.Error("Up ran while the other tool held the shared key")
+		return nil
+	}
+	if _, err := dblock.New(s.DB, cfg).Upgrade(context.Background(), 1, up, time.Second); !errors.Is(err, dblock.ErrTimeout) {
+		t.Errorf("error = %v, want ErrTimeout", err)
+	}
+
+	// Without cross-tool mode the shared key doesn't matter.
+	if _, err := s.Migrator().Upgrade(context.Background(), 1, nil, time.Minute); err != nil {
+		t.Error(err)
+	}
+	_ = holder.Close()
+}
+
+// bumpingLocker moves the version to version while the caller waits for the
+// lock, as a newer migrator would.
+type bumpingLocker struct {
+	db      *sql.DB
+	version int
+}
+
+func (l bumpingLocker) Acquire(ctx context.Context, _ int) (func(), error) {
+	if _, err := l.db.ExecContext(ctx, "UPDATE schema_version SET version = $1", l.version); err != nil {
+		return nil, err
+	}
+	return func() {}, nil
+}
+
+func TestSchemaAheadAfterLock(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		s := newSandbox(t)
+		ctx := context.Background()
+		if _, err := s.Migrator().EnsureVersionTable(ctx); err != nil {
+			t.Fatal(err)
+		}
+		cfg := s.Config
+		cfg.Locker = bumpingLocker{db: s.DB, version: 3}
+		cfg.ErrorOnSchemaAhead = strict
+		res, err := dblock.New(s.DB, cfg).Upgrade(ctx, 1, func(*sql.Tx) error {
+			t.Error("Up ran although the schema is already past the target")
+			return nil
+		}, time.Minute)
+		if strict {
+			if !errors.Is(err, dblock.ErrSchemaAhead) {
+				t.Errorf("ErrorOnSchemaAhead: error = %v, want ErrSchemaAhead", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("error = %v", err)
+		}
+		if res.To != 3 || res.Upgraded {
+			t.Errorf("result %+v, want version 3 found, not upgraded", res)
+		}
+	}
+}
+
+func TestWithLockHoldsAcrossOperations(t *testing.T) {
+	s := newSandbox(t)
+	locker := &memLocker{held: map[int]bool{}}
+	cfg := s.Config
+	cfg.Locker = locker
+	m := dblock.New(s.DB, cfg)
+
+	err := m.WithLock(context.Background(), 2, func(ctx context.Context) error {
+		if _, err := m.Upgrade(ctx, 2, nil, time.Minute); err != nil {
+			return err
+		}
+		if _, err := m.Upgrade(ctx, 2, nil, time.Minute); err != nil {
+			return err
+		}
+		// A peer is blocked the whole time.
+		peer := dblock.New(s.DB, cfg)
+		if err := peer.WithLock(context.Background(), 2, func(context.Context) error { return nil }); !errors.Is(err, dblock.ErrLockBusy) {
+			t.Errorf("peer WithLock = %v, want ErrLockBusy", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := s.Config.LockBase + 2
+	if want := fmt.Sprintf("[acquire %d release %d]", key, key); fmt.Sprint(locker.log) != want {
+		t.Errorf("locker saw %v, want %s", locker.log, want)
+	}
+}
+
+func TestProbeAdvisoryLocks(t *testing.T) {
+	s := newSandbox(t)
+	if err := s.Migrator().ProbeAdvisoryLocks(context.Background()); err != nil {
+		t.Fatalf("ProbeAdvisoryLocks on Postgres: %v", err)
+	}
+}
+
+func TestHighPriorityWinsContention(t *testing.T) {
+	s := newSandbox(t)
+	var (
+		mu  sync.Mutex
+		ran []string
+		wg  sync.WaitGroup
+	)
+	start := func(name string, priority dblock.LockPriority) {
+		cfg := s.Config
+		cfg.LockPriority = priority
+		cfg.PriorityHeadStart = 500 * time.Millisecond
+		m := dblock.New(s.DB, cfg)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := m.Upgrade(context.Background(), 1, func(*sql.Tx) error {
+				mu.Lock()
+				ran = append(ran, name)
+				mu.Unlock()
+				return nil
+			}, time.Minute)
+			if err != nil && !errors.Is(err, dblock.ErrNoMigrationNeeded) {
+				t.Errorf("%s: %v", name, err)
+			}
+		}()
+	}
+	// The low-priority pod starts first but still leaves the upgrade to
+	// the migration Job.
+	start("app pod", dblock.PriorityLow)
+	start("migration job", dblock.PriorityHigh)
+	wg.Wait()
+	if fmt.Sprint(ran) != "[migration job]" {
+		t.Errorf("ran by %q, want only the migration job", ran)
+	}
+}
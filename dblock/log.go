@@ -0,0 +1,45 @@
+package dblock
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// LogLevel gates what a Migrator logs. The zero value is LogInfo. The values
+// match slog's levels.
+type LogLevel int
+
+const (
+	LogDebug  LogLevel = -4
+	LogInfo   LogLevel = 0
+	LogWarn   LogLevel = 4
+	LogError  LogLevel = 8
+	LogSilent LogLevel = 12
+)
+
+func (m *Migrator) logf(level LogLevel, format string, v ...interface{}) {
+	if level < m.cfg.LogLevel {
+		return
+	}
+	m.logger.Log(context.Background(), slog.Level(level), fmt.Sprintf(format, v...))
+}
+
+func (m *Migrator) debugf(format string, v ...interface{}) {
+	m.logf(LogDebug, format, v...)
+}
+
+func (m *Migrator) infof(format string, v ...interface{}) {
+	m.logf(LogInfo, format, v...)
+}
+
+func (m *Migrator) warnf(format string, v ...interface{}) {
+	m.logf(LogWarn, format, v...)
+}
+
+// logErrorf returns the formatted error after logging it at LogError.
+func (m *Migrator) logErrorf(format string, v ...interface{}) error {
+	err := fmt.Errorf(format, v...)
+	m.logf(LogError, "%v", err)
+	return err
+}
@@ -0,0 +1,67 @@
+package dblock
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogLevel(t *testing.T) {
+	for _, tc := range []struct {
+		cfg  Config
+		want []string
+	}{
+		{Config{}, []string{"info", "warn", "error"}},
+		{Config{LogLevel: LogDebug}, []string{"debug", "info", "warn", "error"}},
+		{Config{LogLevel: LogWarn}, []string{"warn", "error"}},
+		{Config{LogLevel: LogError}, []string{"error"}},
+		{Config{LogLevel: LogSilent}, nil},
+		{Config{Silent: true, LogLevel: LogDebug}, nil},
+	} {
+		var buf bytes.Buffer
+		tc.cfg.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		m := New(nil, tc.cfg)
+		m.debugf("debug")
+		m.infof("info")
+		m.warnf("warn")
+		_ = m.logErrorf("error")
+
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if _, msg, ok := strings.Cut(line, "msg="); ok {
+				got = append(got, msg)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("LogLevel %d, Silent %v: logged %v, want %v", tc.cfg.LogLevel, tc.cfg.Silent, got, tc.want)
+		}
+	}
+}
+
+func TestSilentUpgradeWritesNothingToTheDefaultLogger(t *testing.T) {
+	buf := captureLog(t)
+	run := func(cfg Config) {
+		fake := &fakeDB{query: versionRows(0)}
+		m := New(fake.open(t), cfg)
+		ctx := context.Background()
+		if _, err := m.Upgrade(ctx, 1, func(*sql.Tx) error { return nil }, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = m.Upgrade(ctx, 2, func(*sql.Tx) error { return errors.New("boom") }, time.Minute)
+	}
+
+	run(Config{NoLock: true, SkipEngineCheck: true})
+	if buf.Len() == 0 {
+		t.Fatal("nothing logged without Silent, the capture doesn't work")
+	}
+	buf.Reset()
+	run(Config{NoLock: true, SkipEngineCheck: true, Silent: true})
+	if buf.Len() != 0 {
+		t.Errorf("Silent upgrade logged:\n%s", buf)
+	}
+}
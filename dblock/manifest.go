@@ -0,0 +1,195 @@
+package dblock
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidManifest = errors.New("invalid migration manifest")
+
+// Manifest lists migrations kept as SQL files, for defining them without Go
+// code. File paths are relative to the manifest.
+//
+//	{"migrations": [
+//		{"version": 1, "up": "0001_users.up.sql", "down": "0001_users.down.sql"},
+//		{"version": 2, "up": "0002_index.up.sql", "transactional": false,
+//		 "checksum": "9f86d081884c7d65..."}
+//	]}
+type Manifest struct {
+	Migrations []ManifestEntry `json:"migrations"`
+
+	// Sparse allows gaps between versions, e.g. for timestamp versions like
+	// 20240115. Steps are applied by ascending version either way.
+	Sparse bool `json:"sparse,omitempty"`
+}
+
+type ManifestEntry struct {
+	Version int    `json:"version"`
+	Up      string `json:"up"`
+	Down    string `json:"down,omitempty"`
+
+	// Transactional defaults to true. Non-transactional steps run as NoTx.
+	Transactional *bool `json:"transactional,omitempty"`
+
+	// Checksum is the hex SHA-256 of the up file's SQL, after decryption
+	// and decompression. If set, loading fails when the file doesn't match.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// LoadManifest reads the JSON manifest name from fsys, which may be an
+// embed.FS or any other fs.FS such as mounted object storage, and builds
+// Migrations from the SQL files it refers to. Files ending in .gz are
+// decompressed, files ending in .enc are rejected, see
+// LoadEncryptedManifest. Versions must be unique and, unless the manifest is
+// sparse, contiguous.
+func LoadManifest(fsys fs.FS, name string) (Migrations, error) {
+	return loadManifest(fsys, name, nil)
+}
+
+// LoadEncryptedManifest is LoadManifest for manifests whose SQL files may be
+// encrypted with EncryptSQL, e.g. because they seed bootstrap secrets. Files
+// ending in .enc are decrypted in memory with key, then handled like any
+// other file, so 0001_seed.sql.gz.enc works too.
+func LoadEncryptedManifest(fsys fs.FS, name string, key []byte) (Migrations, error) {
+	if key == nil {
+		return nil, fmt.Errorf("%w: no decryption key", ErrInvalidManifest)
+	}
+	return loadManifest(fsys, name, key)
+}
+
+func loadManifest(fsys fs.FS, name string, key []byte) (Migrations, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidManifest, name, err)
+	}
+	if err := manifest.validate(); err != nil {
+		return nil, err
+	}
+
+	dir := path.Dir(name)
+	migrations := make(Migrations, 0, len(manifest.Migrations))
+	for _, entry := range manifest.Migrations {
+		mig, err := entry.load(fsys, dir, key)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, mig)
+	}
+	return migrations, nil
+}
+
+func (mf Manifest) validate() error {
+	entries := make([]ManifestEntry, len(mf.Migrations))
+	copy(entries, mf.Migrations)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Version < entries[j].Version })
+
+	for i, entry := range entries {
+		if entry.Version <= 0 {
+			return fmt.Errorf("%w: version %d must be positive", ErrInvalidManifest, entry.Version)
+		}
+		if entry.Up == "" {
+			return fmt.Errorf("%w: version %d has no up file", ErrInvalidManifest, entry.Version)
+		}
+		if i == 0 {
+			continue
+		}
+		switch prev := entries[i-1].Version; {
+		case prev == entry.Version:
+			return fmt.Errorf("%w: duplicate version %d", ErrInvalidManifest, entry.Version)
+		case prev+1 != entry.Version && !mf.Sparse:
+			return fmt.Errorf("%w: gap between versions %d and %d", ErrInvalidManifest, prev, entry.Version)
+		}
+	}
+	return nil
+}
+
+func (e ManifestEntry) load(fsys fs.FS, dir string, key []byte) (Migration, error) {
+	up, err := readSQL(fsys, path.Join(dir, e.Up), key)
+	if err != nil {
+		return Migration{}, fmt.Errorf("%w: version %d: %w", ErrInvalidManifest, e.Version, err)
+	}
+
+	sum := checksum(up)
+	if e.Checksum != "" && !strings.EqualFold(e.Checksum, sum) {
+		return Migration{}, fmt.Errorf("%w: version %d: checksum of %s is %s, want %s",
+			ErrInvalidManifest, e.Version, e.Up, sum, e.Checksum)
+	}
+
+	mig := Migration{Version: e.Version, Checksum: sum}
+	upSQL := string(up)
+	if e.Transactional == nil || *e.Transactional {
+		mig.Up = execTx(upSQL)
+		mig.SQL = upSQL
+	} else {
+		mig.NoTx = func(ctx context.Context, conn *sql.Conn) error {
+			_, err := conn.ExecContext(ctx, upSQL)
+			return err
+		}
+	}
+
+	if e.Down != "" {
+		down, err := readSQL(fsys, path.Join(dir, e.Down), key)
+		if err != nil {
+			return Migration{}, fmt.Errorf("%w: version %d: %w", ErrInvalidManifest, e.Version, err)
+		}
+		mig.Down = execTx(string(down))
+	}
+	return mig, nil
+}
+
+// readSQL reads a migration file, decrypting it if its name ends in .enc
+// and then gunzipping it if the rest ends in .gz.
+func readSQL(fsys fs.FS, name string, key []byte) ([]byte, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	if base, ok := strings.CutSuffix(name, ".enc"); ok {
+		if data, err = decryptSQL(key, data); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		name = base
+	}
+	if !strings.HasSuffix(name, ".gz") {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	defer zr.Close()
+	text, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return text, nil
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func execTx(query string) func(*sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
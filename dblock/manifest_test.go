@@ -0,0 +1,170 @@
+package dblock
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadManifest(t *testing.T) {
+	fsys := fstest.MapFS{
+		"db/manifest.json": {Data: []byte(`{"migrations": [
+			{"version": 2, "up": "0002.up.sql", "transactional": false},
+			{"version": 1, "up": "0001.up.sql", "down": "0001.down.sql",
+			 "checksum": "` + checksum([]byte("CREATE TABLE users (id INT)")) + `"}
+		]}`)},
+		"db/0001.up.sql":   {Data: []byte("CREATE TABLE users (id INT)")},
+		"db/0001.down.sql": {Data: []byte("DROP TABLE users")},
+		"db/0002.up.sql":   {Data: []byte("CREATE INDEX CONCURRENTLY users_id ON users (id)")},
+	}
+	migrations, err := LoadManifest(fsys, "db/manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 2 {
+		t.Fatalf("got %d migrations, want 2", len(migrations))
+	}
+	byVersion := map[int]Migration{}
+	for _, mig := range migrations {
+		byVersion[mig.Version] = mig
+	}
+	if mig := byVersion[1]; mig.Up == nil || mig.NoTx != nil || mig.Down == nil || mig.SQL != "CREATE TABLE users (id INT)" {
+		t.Errorf("version 1 = %+v, want a transactional step with a down", mig)
+	}
+	if mig := byVersion[2]; mig.Up != nil || mig.NoTx == nil || mig.Down != nil {
+		t.Errorf("version 2 = %+v, want a NoTx step", mig)
+	}
+	if got, want := byVersion[2].Checksum, checksum(fsys["db/0002.up.sql"].Data); got != want {
+		t.Errorf("checksum = %s, want %s", got, want)
+	}
+}
+
+func TestLoadManifestInvalid(t *testing.T) {
+	for name, manifest := range map[string]string{
+		"not json":          `{"migrations": [`,
+		"zero version":      `{"migrations": [{"version": 0, "up": "a.sql"}]}`,
+		"no up file":        `{"migrations": [{"version": 1}]}`,
+		"duplicate version": `{"migrations": [{"version": 1, "up": "a.sql"}, {"version": 1, "up": "a.sql"}]}`,
+		"gap":               `{"migrations": [{"version": 1, "up": "a.sql"}, {"version": 3, "up": "a.sql"}]}`,
+		"missing file":      `{"migrations": [{"version": 1, "up": "missing.sql"}]}`,
+		"bad checksum":      `{"migrations": [{"version": 1, "up": "a.sql", "checksum": "00"}]}`,
+	} {
+		fsys := fstest.MapFS{
+			"manifest.json": {Data: []byte(manifest)},
+			"a.sql":         {Data: []byte("SELECT 1")},
+		}
+		if _, err := LoadManifest(fsys, "manifest.json"); !errors.Is(err, ErrInvalidManifest) {
+			t.Errorf("%s: error = %v, want ErrInvalidManifest", name, err)
+		}
+	}
+	if _, err := LoadManifest(fstest.MapFS{}, "manifest.json"); !errors.Is(err, ErrInvalidManifest) {
+		t.Errorf("missing manifest: error = %v, want ErrInvalidManifest", err)
+	}
+}
+
+func TestLoadSparseManifest(t *testing.T) {
+	manifest := `{"sparse": true, "migrations": [
+		{"version": 20240301, "up": "a.sql"},
+		{"version": 20240101, "up": "a.sql"},
+		{"version": 20240115, "up": "a.sql"}
+	]}`
+	fsys := fstest.MapFS{
+		"manifest.json": {Data: []byte(manifest)},
+		"a.sql":         {Data: []byte("SELECT 1")},
+	}
+	migrations, err := LoadManifest(fsys, "manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrations.Latest() != 20240301 {
+		t.Errorf("Latest() = %d, want 20240301", migrations.Latest())
+	}
+}
+
+func gzipped(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLoadManifestGzip(t *testing.T) {
+	seed := "INSERT INTO countries (code) VALUES ('de'), ('fr')"
+	fsys := fstest.MapFS{
+		"manifest.json": {Data: []byte(`{"migrations": [{"version": 1, "up": "0001_seed.sql.gz",
+			"checksum": "` + checksum([]byte(seed)) + `"}]}`)},
+		"0001_seed.sql.gz": {Data: gzipped(t, seed)},
+	}
+	migrations, err := LoadManifest(fsys, "manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := &fakeDB{}
+	tx, err := fake.open(t).Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := migrations[0].Up(tx); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.recorded(); len(got) != 1 || got[0] != seed {
+		t.Errorf("applied %q, want %q", got, seed)
+	}
+
+	fsys["0001_seed.sql.gz"] = &fstest.MapFile{Data: []byte(seed)}
+	if _, err := LoadManifest(fsys, "manifest.json"); !errors.Is(err, ErrInvalidManifest) {
+		t.Errorf("uncompressed .gz file: error = %v, want ErrInvalidManifest", err)
+	}
+}
+
+func TestLoadEncryptedManifest(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	const seed = "INSERT INTO secrets VALUES ('bootstrap')"
+	enc, err := EncryptSQL(key, []byte(seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{
+		"manifest.json": {Data: []byte(`{"migrations": [
+			{"version": 1, "up": "0001.up.sql.enc", "checksum": "` + checksum([]byte(seed)) + `"}
+		]}`)},
+		"0001.up.sql.enc": {Data: enc},
+	}
+
+	migrations, err := LoadEncryptedManifest(fsys, "manifest.json", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 1 || migrations[0].SQL != seed {
+		t.Fatalf("migrations = %+v, want the decrypted seed", migrations)
+	}
+	fake := &fakeDB{}
+	tx, err := fake.open(t).Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrations[0].Up(tx); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.recorded(); len(got) != 1 || got[0] != seed {
+		t.Errorf("Up ran %q, want %q", got, seed)
+	}
+
+	wrong := bytes.Repeat([]byte{8}, 32)
+	if _, err := LoadEncryptedManifest(fsys, "manifest.json", wrong); !errors.Is(err, ErrDecryptFailed) {
+		t.Errorf("wrong key: error = %v, want ErrDecryptFailed", err)
+	}
+	if _, err := LoadManifest(fsys, "manifest.json"); !errors.Is(err, ErrDecryptFailed) {
+		t.Errorf("no key: error = %v, want ErrDecryptFailed", err)
+	}
+}
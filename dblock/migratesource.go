@@ -0,0 +1,81 @@
+package dblock
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// MigrateSource is the part of golang-migrate's source.Driver that dblock
+// needs, so any of its source drivers (file://, s3://, github://, ...) can be
+// passed in without dblock depending on golang-migrate.
+type MigrateSource interface {
+	First() (version uint, err error)
+	Next(version uint) (nextVersion uint, err error)
+	ReadUp(version uint) (r io.ReadCloser, identifier string, err error)
+	ReadDown(version uint) (r io.ReadCloser, identifier string, err error)
+}
+
+// FromMigrateSource reads every versioned up (and down, if present)
+// migration from a golang-migrate source driver, for use with UpgradeSteps.
+// Versions without an up migration are skipped. Versions must fit dblock's
+// INTEGER version column, so the timestamp versions of migrate create's
+// default format (20240101120000) are unsupported and fail with
+// ErrInvalidVersion; create migrations with -seq, or with -format 20060102
+// for dates.
+func FromMigrateSource(src MigrateSource) (Migrations, error) {
+	var migrations Migrations
+
+	version, err := src.First()
+	for ; err == nil; version, err = src.Next(version) {
+		mig, ok, err := readMigrateVersion(src, version)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			migrations = append(migrations, mig)
+		}
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to list migrations: %w", err)
+	}
+	return migrations, nil
+}
+
+func readMigrateVersion(src MigrateSource, version uint) (Migration, bool, error) {
+	if uint64(version) > MaxVersion {
+		return Migration{}, false, fmt.Errorf("%w: migration version %d is above %d", ErrInvalidVersion, version, MaxVersion)
+	}
+
+	up, err := readMigrateFile(src.ReadUp(version))
+	if errors.Is(err, os.ErrNotExist) {
+		return Migration{}, false, nil
+	}
+	if err != nil {
+		return Migration{}, false, fmt.Errorf("failed to read up migration %d: %w", version, err)
+	}
+	mig := Migration{Version: int(version), Up: execTx(up), Checksum: checksum([]byte(up))}
+
+	down, err := readMigrateFile(src.ReadDown(version))
+	switch {
+	case err == nil:
+		mig.Down = execTx(down)
+	case !errors.Is(err, os.ErrNotExist):
+		return Migration{}, false, fmt.Errorf("failed to read down migration %d: %w", version, err)
+	}
+	return mig, true, nil
+}
+
+func readMigrateFile(r io.ReadCloser, _ string, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
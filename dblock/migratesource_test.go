@@ -0,0 +1,114 @@
+package dblock
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/golang-migrate/migrate/v4/source/file"
+)
+
+// mapSource is a MigrateSource over up migrations kept in memory.
+type mapSource struct {
+	versions []uint
+	up       map[uint]string
+}
+
+func (s mapSource) First() (uint, error) {
+	if len(s.versions) == 0 {
+		return 0, os.ErrNotExist
+	}
+	return s.versions[0], nil
+}
+
+func (s mapSource) Next(version uint) (uint, error) {
+	for i, v := range s.versions {
+		if v == version && i+1 < len(s.versions) {
+			return s.versions[i+1], nil
+		}
+	}
+	return 0, os.ErrNotExist
+}
+
+func (s mapSource) ReadUp(version uint) (io.ReadCloser, string, error) {
+	up, ok := s.up[version]
+	if !ok {
+		return nil, "", os.ErrNotExist
+	}
+	return io.NopCloser(strings.NewReader(up)), "", nil
+}
+
+func (s mapSource) ReadDown(uint) (io.ReadCloser, string, error) {
+	return nil, "", os.ErrNotExist
+}
+
+func TestFromMigrateSource(t *testing.T) {
+	src := mapSource{
+		versions: []uint{1, 2, 3},
+		up:       map[uint]string{1: "CREATE TABLE a ()", 3: "CREATE TABLE c ()"},
+	}
+	migrations, err := FromMigrateSource(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 2 || migrations[0].Version != 1 || migrations[1].Version != 3 {
+		t.Errorf("got %d migrations, want versions 1 and 3", len(migrations))
+	}
+}
+
+func TestFromMigrateSourceRejectsTimestampVersions(t *testing.T) {
+	src := mapSource{
+		versions: []uint{20240101120000},
+		up:       map[uint]string{20240101120000: "CREATE TABLE a ()"},
+	}
+	if _, err := FromMigrateSource(src); !errors.Is(err, ErrInvalidVersion) {
+		t.Errorf("error = %v, want ErrInvalidVersion", err)
+	}
+}
+
+func TestFromMigrateSourceFile(t *testing.T) {
+	src, err := (&file.File{}).Open("file://testdata/migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	migrations, err := FromMigrateSource(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 3 {
+		t.Fatalf("got %d migrations, want 3", len(migrations))
+	}
+	for i, mig := range migrations {
+		if mig.Version != i+1 || mig.Up == nil || mig.Checksum == "" {
+			t.Errorf("migrations[%d] = version %d, up %v, checksum %q", i, mig.Version, mig.Up != nil, mig.Checksum)
+		}
+	}
+	if migrations[2].Down != nil {
+		t.Error("version 3 has a down migration without a down file")
+	}
+
+	fake := &fakeDB{}
+	db := fake.open(t)
+	for _, mig := range []Migration{migrations[1], migrations[0]} {
+		tx, err := db.BeginTx(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mig.Down(tx); err != nil {
+			t.Fatalf("down %d: %v", mig.Version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"ALTER TABLE users DROP COLUMN email;\n", "DROP TABLE users;\n"}
+	if got := fake.recorded(); !slices.Equal(got, want) {
+		t.Errorf("down migrations ran %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,130 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrStopMigration can be returned by Up or NoTx to end the run early: the
+// step still commits and the version moves to it, but later steps are left
+// for another time and the upgrade reports success.
+var ErrStopMigration = errors.New("stop migration")
+
+// ErrPanic wraps a panic in a step, which is rolled back like any failure.
+var ErrPanic = errors.New("migration panicked")
+
+// ErrUnknownTargetVersion means the target is beyond every migration this
+// binary knows about, see Config.MaxKnownVersion.
+var ErrUnknownTargetVersion = errors.New("target version is not among the known migrations")
+
+// Migration upgrades the schema from the previous registered version to
+// Version. A step without Up or NoTx only bumps the version, e.g. to record
+// that a manual change was made.
+type Migration struct {
+	Version int
+	Up      func(*sql.Tx) error
+
+	// NoTx is used instead of Up for statements that can't run inside a
+	// transaction, such as CREATE INDEX CONCURRENTLY. It runs directly on
+	// the lock connection and the version is bumped afterwards in a
+	// transaction of its own, so it must be safe to re-run after a crash.
+	NoTx func(ctx context.Context, conn *sql.Conn) error
+
+	// Down reverts the step. It is optional.
+	Down func(*sql.Tx) error
+
+	// Checksum identifies the step's source, e.g. the hash of its SQL file.
+	Checksum string
+
+	// SQL is the statement Up runs, if the step is plain SQL like those from
+	// manifests. It lets Config.ExplainDML run it under EXPLAIN instead.
+	SQL string
+
+	// Requires is checked before the step runs.
+	Requires Prerequisites
+
+	// Flag names a feature flag gating the application's use of the step's
+	// schema. Config.EnableFlag is called with it once the step committed.
+	Flag string
+
+	// Settings are applied with SET LOCAL in the step's transaction before
+	// Up runs, e.g. {"row_security": "off"} for RLS policy changes, and reset
+	// when it ends. They don't apply to NoTx.
+	Settings map[string]string
+
+	// ReadOnly runs Up in a READ ONLY transaction of its own, so a step
+	// meant only to verify fails on any write. The version is bumped in a
+	// second transaction afterwards.
+	ReadOnly bool
+
+	// Deferrable starts the step's transaction with SET TRANSACTION
+	// DEFERRABLE, which only has an effect with a serializable, read-only
+	// one.
+	Deferrable bool
+
+	// Tables lists the tables the step touches, for the estimates of
+	// AnalyzePlan.
+	Tables []string
+
+	// rerun is set when Config.ShouldUpgrade asked to apply a step the
+	// schema is already at, so the at-most-once check must not skip it.
+	rerun bool
+}
+
+// errStepAlreadyApplied means the step's transaction found the version
+// already there and didn't run it.
+var errStepAlreadyApplied = errors.New("step already applied")
+
+// Migrations is a set of steps. Order doesn't matter, steps are always
+// applied by ascending Version. Versions needn't be contiguous: every
+// registered version above the current one is applied, so timestamps like
+// 20240115 work as well as 1, 2, 3.
+type Migrations []Migration
+
+// Latest returns the highest registered version, or 0 if there are none.
+func (ms Migrations) Latest() int {
+	latest := 0
+	for _, mig := range ms {
+		latest = max(latest, mig.Version)
+	}
+	return latest
+}
+
+// CheckTarget fails with ErrUnknownTargetVersion if targetVersion is above
+// Latest, e.g. when a deploy asks for a version whose code isn't compiled in.
+func (ms Migrations) CheckTarget(targetVersion int) error {
+	if latest := ms.Latest(); targetVersion > latest {
+		return fmt.Errorf("%w: target %d, latest known %d", ErrUnknownTargetVersion, targetVersion, latest)
+	}
+	return nil
+}
+
+// sorted validates and sorts the steps. Versions below minVersion are
+// rejected: 1 normally, 0 with VersionZeroApplied.
+func (ms Migrations) sorted(minVersion int) (Migrations, error) {
+	sorted := make(Migrations, len(ms))
+	copy(sorted, ms)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+
+	for i, mig := range sorted {
+		if mig.Version < minVersion {
+			return nil, fmt.Errorf("%w: migration version %d must be at least %d", ErrInvalidVersion, mig.Version, minVersion)
+		}
+		if mig.Version > MaxVersion {
+			return nil, fmt.Errorf("%w: migration version %d is above %d", ErrInvalidVersion, mig.Version, MaxVersion)
+		}
+		if i > 0 && sorted[i-1].Version == mig.Version {
+			return nil, fmt.Errorf("%w: duplicate migration version %d", ErrInvalidVersion, mig.Version)
+		}
+		if mig.Up != nil && mig.NoTx != nil {
+			return nil, fmt.Errorf("migration %d has both Up and NoTx", mig.Version)
+		}
+		if mig.ReadOnly && mig.NoTx != nil {
+			return nil, fmt.Errorf("migration %d is ReadOnly but has NoTx", mig.Version)
+		}
+	}
+	return sorted, nil
+}
@@ -0,0 +1,35 @@
+package dblock
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnknownTargetVersion(t *testing.T) {
+	var ms Migrations
+	for v := 1; v <= 5; v++ {
+		ms = append(ms, Migration{Version: v})
+	}
+	if err := ms.CheckTarget(5); err != nil {
+		t.Errorf("CheckTarget(5) = %v", err)
+	}
+	err := ms.CheckTarget(9)
+	if !errors.Is(err, ErrUnknownTargetVersion) {
+		t.Fatalf("CheckTarget(9) = %v, want ErrUnknownTargetVersion", err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "target 9") || !strings.Contains(msg, "latest known 5") {
+		t.Errorf("error %q doesn't name the target and the latest version", msg)
+	}
+
+	fake := &fakeDB{query: versionRows(0)}
+	m := New(fake.open(t), Config{MaxKnownVersion: ms.Latest(), NoLock: true, SkipEngineCheck: true, Silent: true})
+	if _, err := m.Upgrade(context.Background(), 9, nil, time.Minute); !errors.Is(err, ErrUnknownTargetVersion) {
+		t.Errorf("Upgrade(9) = %v, want ErrUnknownTargetVersion", err)
+	}
+	if got := fake.recorded(); len(got) != 0 {
+		t.Errorf("Upgrade(9) ran %q", got)
+	}
+}
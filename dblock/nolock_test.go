@@ -0,0 +1,30 @@
+package dblock
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNoLockIssuesNoAdvisoryLockQueries(t *testing.T) {
+	fake := &fakeDB{query: versionRows(0)}
+	m := New(fake.open(t), Config{NoLock: true, SkipEngineCheck: true, Silent: true})
+	res, err := m.Upgrade(context.Background(), 1, nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Upgraded || res.To != 1 {
+		t.Errorf("result %+v, want an upgrade to 1", res)
+	}
+	statements := fake.recorded()
+	for _, stmt := range statements {
+		if strings.Contains(stmt, "advisory") {
+			t.Errorf("ran %q with NoLock", stmt)
+		}
+	}
+	if !slices.Contains(statements, m.sql.updateVersion()) {
+		t.Errorf("version never bumped, ran %q", statements)
+	}
+}
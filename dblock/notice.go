@@ -0,0 +1,59 @@
+package dblock
+
+import (
+	"database/sql"
+	"database/sql/driver"
+
+	"github.com/lib/pq"
+)
+
+// NoticeCapturer is implemented by dialects that can forward server notices,
+// such as RAISE NOTICE output, from a driver connection. Getting at them is
+// driver-specific, so SetNoticeHandler returns false for drivers it doesn't
+// know.
+type NoticeCapturer interface {
+	SetNoticeHandler(conn driver.Conn, handler func(notice string)) bool
+}
+
+// SetNoticeHandler supports lib/pq connections. A nil handler removes it.
+func (postgresDialect) SetNoticeHandler(conn driver.Conn, handler func(notice string)) (ok bool) {
+	// pq.SetNoticeHandler panics on connections of other drivers.
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	if handler == nil {
+		pq.SetNoticeHandler(conn, nil)
+	} else {
+		pq.SetNoticeHandler(conn, func(e *pq.Error) { handler(e.Message) })
+	}
+	return true
+}
+
+// captureNotices routes notices on conn to OnNotice until the returned
+// function is called.
+func (m *Migrator) captureNotices(conn *sql.Conn) func() {
+	c, ok := m.sql.dialect.(NoticeCapturer)
+	if !ok || m.cfg.OnNotice == nil {
+		return func() {}
+	}
+
+	var set bool
+	_ = conn.Raw(func(dc interface{}) error {
+		if dc, ok := dc.(driver.Conn); ok {
+			set = c.SetNoticeHandler(dc, m.cfg.OnNotice)
+		}
+		return nil
+	})
+	if !set {
+		m.warnf("Can't capture notices with this driver")
+		return func() {}
+	}
+	return func() {
+		_ = conn.Raw(func(dc interface{}) error {
+			c.SetNoticeHandler(dc.(driver.Conn), nil)
+			return nil
+		})
+	}
+}
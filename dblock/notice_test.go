@@ -0,0 +1,28 @@
+package dblock
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestCaptureNoticesOtherDriver(t *testing.T) {
+	db := (&fakeDB{}).open(t)
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	m := New(db, Config{
+		OnNotice: func(string) { t.Error("notice from a fake connection") },
+		Logger:   slog.New(slog.NewTextHandler(&buf, nil)),
+	})
+	m.captureNotices(conn)()
+	if !strings.Contains(buf.String(), "Can't capture notices") {
+		t.Errorf("logged %q, want a warning", buf.String())
+	}
+}
@@ -0,0 +1,50 @@
+package dblock_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"dblock/dblock"
+
+	"github.com/lib/pq"
+)
+
+func TestNotifyProgressReachesListener(t *testing.T) {
+	s := newSandbox(t)
+	if _, err := s.DB.Exec("CREATE TABLE items (id INTEGER PRIMARY KEY, done BOOLEAN NOT NULL DEFAULT false)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DB.Exec("INSERT INTO items (id) SELECT generate_series(1, 25)"); err != nil {
+		t.Fatal(err)
+	}
+
+	channel := "progress_" + s.Schema
+	listener := pq.NewListener(os.Getenv("DBLOCK_TEST_DSN"), time.Second, time.Minute, nil)
+	defer listener.Close()
+	if err := listener.Listen(channel); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	query := "UPDATE items SET done = true WHERE id IN (SELECT id FROM items WHERE NOT done LIMIT $1)"
+	total, err := dblock.BackfillInBatches(ctx, s.DB, query, 10, dblock.NotifyProgress(ctx, s.DB, channel, "version=4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 25 {
+		t.Errorf("backfilled %d rows, want 25", total)
+	}
+
+	for _, want := range []string{"version=4 rows=10", "version=4 rows=20", "version=4 rows=25"} {
+		select {
+		case n := <-listener.Notify:
+			if n == nil || n.Channel != channel || n.Extra != want {
+				t.Errorf("notification %+v, want %q on %s", n, want, channel)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no notification %q", want)
+		}
+	}
+}
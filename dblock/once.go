@@ -0,0 +1,112 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+// RunOnceWithLock runs fn on exactly one of all instances calling it with the
+// same key, using the same advisory lock pattern as the schema upgrade but
+// without version tracking. Completion is recorded in the version table's
+// _once table (schema_version_once by default); instances that lose the race
+// wait up to timeout for that record to appear.
+func RunOnceWithLock(db *sql.DB, key string, timeout time.Duration, fn func() error) error {
+	return New(db, Config{}).RunOnce(context.Background(), key, fn, timeout)
+}
+
+func (m *Migrator) RunOnce(ctx context.Context, key string, fn func() error, timeout time.Duration) error {
+	done, err := m.onceDone(ctx, m.db, key)
+	if err != nil || done {
+		return err
+	}
+
+	conn, err := m.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	lockID := onceLockID(key)
+	if err := m.acquireAdvisoryLock(ctx, conn, lockID); err != nil {
+		m.infof("Another instance is running %q.", key)
+		return m.waitForOnce(ctx, key, timeout)
+	}
+	defer func() {
+		_ = m.releaseAdvisoryLock(ctx, conn, lockID)
+	}()
+
+	if done, err := m.onceDone(ctx, conn, key); err != nil || done {
+		return err
+	}
+
+	m.infof("Running %q...", key)
+	if err := fn(); err != nil {
+		return m.logErrorf("Failed to run %q: %w", key, err)
+	}
+
+	d, err := m.onceDialect()
+	if err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, d.InsertOnceSQL(m.sql.onceTable), key); err != nil {
+		return m.logErrorf("Failed to record completion of %q: %w", key, err)
+	}
+	m.infof("Completed %q.", key)
+	return nil
+}
+
+// onceDialect returns the StateDialect completions are recorded with.
+func (m *Migrator) onceDialect() (StateDialect, error) {
+	d, ok := m.stateDialect()
+	if !ok {
+		return nil, m.logErrorf("RunOnce needs a dialect implementing StateDialect, %T doesn't", m.sql.dialect)
+	}
+	return d, nil
+}
+
+func (m *Migrator) onceDone(ctx context.Context, q Queryer, key string) (bool, error) {
+	d, err := m.onceDialect()
+	if err != nil {
+		return false, err
+	}
+	if _, err := q.ExecContext(ctx, d.CreateOnceTableSQL(m.sql.onceTable)); err != nil {
+		return false, m.logErrorf("Failed to initialize %s table: %w", m.sql.onceTable, err)
+	}
+
+	var done bool
+	if err := q.QueryRowContext(ctx, d.SelectOnceSQL(m.sql.onceTable), key).Scan(&done); err != nil {
+		return false, m.logErrorf("Failed to check completion of %q: %w", key, err)
+	}
+	return done, nil
+}
+
+func (m *Migrator) waitForOnce(ctx context.Context, key string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if err := sleep(ctx, checkInterval); err != nil {
+			return err
+		}
+
+		done, err := m.onceDone(ctx, m.db, key)
+		if err != nil {
+			return err
+		}
+		if done {
+			m.infof("%q was completed by another instance.", key)
+			return nil
+		}
+	}
+
+	return m.logErrorf("%w waiting for %q after %v", ErrTimeout, key, timeout)
+}
+
+// onceLockID hashes key into the 64-bit advisory lock space. Collisions with
+// the small version lock IDs are practically impossible.
+func onceLockID(key string) int {
+	h := fnv.New64a()
+	_, _ = fmt.Fprint(h, key)
+	return int(int64(h.Sum64()))
+}
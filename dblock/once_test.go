@@ -0,0 +1,95 @@
+package dblock_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dblock/dblock"
+)
+
+func TestRunOnceConcurrentCallers(t *testing.T) {
+	s := newSandbox(t)
+	key := "import " + s.Schema
+	var runs atomic.Int32
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.Migrator().RunOnce(context.Background(), key, func() error {
+				runs.Add(1)
+				time.Sleep(200 * time.Millisecond)
+				return nil
+			}, time.Minute)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("caller %d: %v", i, err)
+		}
+	}
+	if n := runs.Load(); n != 1 {
+		t.Errorf("fn ran %d times, want 1", n)
+	}
+
+	// Completion is recorded, so later callers don't run it either.
+	if err := s.Migrator().RunOnce(context.Background(), key, func() error {
+		t.Error("fn ran after completion was recorded")
+		return nil
+	}, time.Minute); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunOnceFailureIsNotRecorded(t *testing.T) {
+	s := newSandbox(t)
+	key := "import " + s.Schema
+	errImport := errors.New("import failed")
+	if err := s.Migrator().RunOnce(context.Background(), key, func() error { return errImport }, time.Minute); !errors.Is(err, errImport) {
+		t.Fatalf("error = %v, want %v", err, errImport)
+	}
+	ran := false
+	if err := s.Migrator().RunOnce(context.Background(), key, func() error {
+		ran = true
+		return nil
+	}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if !ran {
+		t.Error("fn didn't run again after failing")
+	}
+}
+
+func TestRunOnceIsPerVersionTable(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	key := "import " + s.Schema
+	if err := s.Migrator().RunOnce(ctx, key, func() error { return nil }, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := s.Config
+	cfg.VersionTable = s.Schema + ".other_version"
+	ran := false
+	if err := dblock.New(s.DB, cfg).RunOnce(ctx, key, func() error {
+		ran = true
+		return nil
+	}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if !ran {
+		t.Error("fn didn't run for another version table")
+	}
+	var exists bool
+	err := s.DB.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", s.Schema+".schema_version_once").Scan(&exists)
+	if err != nil || !exists {
+		t.Errorf("completion not recorded next to the version table: %v, %v", exists, err)
+	}
+}
@@ -0,0 +1,89 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// Plan returns the versions UpgradeSteps would apply, in order, without
+// taking the lock or changing anything. Another instance may of course get
+// there first.
+func (m *Migrator) Plan(ctx context.Context, migrations Migrations) ([]int, error) {
+	sorted, err := migrations.sorted(m.minVersion())
+	if err != nil {
+		return nil, err
+	}
+	current, err := m.readSchemaVersion(ctx, m.db)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []int
+	for _, mig := range sorted {
+		if mig.Version > current {
+			pending = append(pending, mig.Version)
+		}
+	}
+	return pending, nil
+}
+
+// PlannedStep is a pending step with estimates for the tables it declares.
+type PlannedStep struct {
+	Version int
+	Tables  []TableEstimate
+}
+
+// TableEstimate is the planner's idea of a table's size. Rows comes from
+// pg_class.reltuples and is only as fresh as the last ANALYZE; it is -1 for
+// tables never analyzed. Tables that don't exist yet have Exists false.
+type TableEstimate struct {
+	Name   string
+	Exists bool
+	Rows   int64
+	Bytes  int64
+}
+
+// AnalyzePlan is Plan annotated with the approximate row counts and total
+// sizes, indexes and TOAST included, of each step's Tables, to judge whether
+// it needs a maintenance window. Like Plan it changes nothing.
+func (m *Migrator) AnalyzePlan(ctx context.Context, migrations Migrations) ([]PlannedStep, error) {
+	pending, err := m.Plan(ctx, migrations)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]Migration, len(migrations))
+	for _, mig := range migrations {
+		byVersion[mig.Version] = mig
+	}
+
+	steps := make([]PlannedStep, 0, len(pending))
+	for _, version := range pending {
+		step := PlannedStep{Version: version}
+		for _, table := range byVersion[version].Tables {
+			est, err := m.estimateTable(ctx, table)
+			if err != nil {
+				return nil, err
+			}
+			step.Tables = append(step.Tables, est)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+func (m *Migrator) estimateTable(ctx context.Context, table string) (TableEstimate, error) {
+	est := TableEstimate{Name: table}
+	err := m.db.QueryRowContext(ctx, `
+		SELECT reltuples::bigint, pg_total_relation_size(oid)
+		FROM pg_class WHERE oid = to_regclass($1)
+	`, table).Scan(&est.Rows, &est.Bytes)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return est, nil
+	case err != nil:
+		return est, m.logErrorf("Failed to estimate size of %s: %w", table, err)
+	}
+	est.Exists = true
+	return est, nil
+}
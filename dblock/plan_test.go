@@ -0,0 +1,37 @@
+package dblock_test
+
+import (
+	"context"
+	"testing"
+
+	"dblock/dblock"
+)
+
+func TestAnalyzePlanEstimatesDeclaredTables(t *testing.T) {
+	s := newSandbox(t)
+	if _, err := s.DB.Exec(`
+		CREATE TABLE users (id INTEGER);
+		INSERT INTO users SELECT generate_series(1, 1000);
+		ANALYZE users
+	`); err != nil {
+		t.Fatal(err)
+	}
+	steps := dblock.Migrations{
+		{Version: 1, Tables: []string{"users"}},
+		{Version: 2, Tables: []string{"orders"}},
+	}
+	plan, err := s.Migrator().AnalyzePlan(context.Background(), steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 2 || len(plan[0].Tables) != 1 || len(plan[1].Tables) != 1 {
+		t.Fatalf("plan %+v, want two steps with one table each", plan)
+	}
+	users := plan[0].Tables[0]
+	if users.Name != "users" || !users.Exists || users.Rows != 1000 || users.Bytes <= 0 {
+		t.Errorf("users estimate %+v, want 1000 rows and a size", users)
+	}
+	if orders := plan[1].Tables[0]; orders.Exists {
+		t.Errorf("orders estimate %+v for a table that doesn't exist", orders)
+	}
+}
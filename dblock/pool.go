@@ -0,0 +1,51 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+var ErrConnAcquireTimeout = errors.New("timed out waiting for a connection from the pool")
+
+// checkPool warns about pool settings that make the dedicated lock
+// connection block or starve the application. The lock connection is
+// checked out for the whole upgrade, so idle and lifetime limits can't reap
+// it; only the size of the pool matters.
+func (m *Migrator) checkPool() {
+	stats := m.db.Stats()
+	if stats.MaxOpenConnections != 1 {
+		return
+	}
+
+	if stats.InUse > 0 {
+		m.warnf("The pool allows a single connection and it is in use; " +
+			"taking the lock connection blocks until it is returned. Set MaxOpenConns >= 2.")
+		return
+	}
+	m.warnf("The pool allows a single connection; other queries on it block " +
+		"while an upgrade holds the lock connection. Set MaxOpenConns >= 2.")
+}
+
+// conn checks out a dedicated connection, giving up after ConnAcquireTimeout
+// so a saturated pool doesn't make the migrator look stuck.
+func (m *Migrator) conn(ctx context.Context) (*sql.Conn, error) {
+	if m.cfg.ConnAcquireTimeout <= 0 {
+		conn, err := m.db.Conn(ctx)
+		if err != nil {
+			return nil, m.logErrorf("Failed to get database connection: %w", err)
+		}
+		return conn, nil
+	}
+
+	acquireCtx, cancel := context.WithTimeout(ctx, m.cfg.ConnAcquireTimeout)
+	defer cancel()
+	conn, err := m.db.Conn(acquireCtx)
+	if err != nil {
+		if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+			return nil, m.logErrorf("%w after %v", ErrConnAcquireTimeout, m.cfg.ConnAcquireTimeout)
+		}
+		return nil, m.logErrorf("Failed to get database connection: %w", err)
+	}
+	return conn, nil
+}
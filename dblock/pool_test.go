@@ -0,0 +1,67 @@
+package dblock
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckPool(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		maxOpen  int
+		inUse    bool
+		wantWarn string
+	}{
+		{"unlimited", 0, false, ""},
+		{"two", 2, true, ""},
+		{"single idle", 1, false, "other queries on it block"},
+		{"single in use", 1, true, "it is in use"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := (&fakeDB{}).open(t)
+			db.SetMaxOpenConns(tc.maxOpen)
+			if tc.inUse {
+				conn, err := db.Conn(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+			}
+			var buf bytes.Buffer
+			New(db, Config{Logger: slog.New(slog.NewTextHandler(&buf, nil))}).checkPool()
+			switch got := buf.String(); {
+			case tc.wantWarn == "" && got != "":
+				t.Errorf("warned %q", got)
+			case !strings.Contains(got, tc.wantWarn):
+				t.Errorf("warned %q, want %q", got, tc.wantWarn)
+			}
+		})
+	}
+}
+
+func TestConnAcquireTimeout(t *testing.T) {
+	db := (&fakeDB{}).open(t)
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	held, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+
+	m := New(db, Config{ConnAcquireTimeout: 50 * time.Millisecond, Silent: true})
+	if _, err := m.conn(ctx); !errors.Is(err, ErrConnAcquireTimeout) {
+		t.Errorf("error = %v, want ErrConnAcquireTimeout", err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := m.conn(canceled); err == nil || errors.Is(err, ErrConnAcquireTimeout) {
+		t.Errorf("error = %v after cancel, want a plain failure", err)
+	}
+}
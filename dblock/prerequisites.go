@@ -0,0 +1,51 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+var ErrPrerequisiteNotMet = errors.New("migration prerequisite not met")
+
+// Prerequisites describe the server a step needs.
+type Prerequisites struct {
+	// MinServerVersion is compared against server_version_num, e.g. 150000
+	// for Postgres 15.
+	MinServerVersion int
+
+	// Extensions must all be installed in the database.
+	Extensions []string
+}
+
+func (m *Migrator) checkPrerequisites(ctx context.Context, conn *sql.Conn, mig Migration) error {
+	req := mig.Requires
+	if req.MinServerVersion > 0 {
+		var serverVersion int
+		if err := conn.QueryRowContext(ctx, "SHOW server_version_num").Scan(&serverVersion); err != nil {
+			return m.logErrorf("Failed to get server version: %w", err)
+		}
+		if serverVersion < req.MinServerVersion {
+			return m.logErrorf("%w: version %d needs server version %d, have %d",
+				ErrPrerequisiteNotMet, mig.Version, req.MinServerVersion, serverVersion)
+		}
+	}
+
+	var missing []string
+	for _, ext := range req.Extensions {
+		var installed bool
+		err := conn.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = $1)", ext).Scan(&installed)
+		if err != nil {
+			return m.logErrorf("Failed to look up extension %s: %w", ext, err)
+		}
+		if !installed {
+			missing = append(missing, ext)
+		}
+	}
+	if len(missing) > 0 {
+		return m.logErrorf("%w: version %d needs extensions %s",
+			ErrPrerequisiteNotMet, mig.Version, strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package dblock
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckPrerequisites(t *testing.T) {
+	fake := &fakeDB{query: func(query string, args []driver.NamedValue) (driver.Rows, error) {
+		if strings.HasPrefix(query, "SHOW") {
+			return &fakeRows{cols: []string{"server_version_num"}, values: [][]driver.Value{{"150004"}}}, nil
+		}
+		installed := args[0].Value == "pg_trgm"
+		return &fakeRows{cols: []string{"exists"}, values: [][]driver.Value{{installed}}}, nil
+	}}
+	db := fake.open(t)
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m := New(db, Config{Silent: true})
+
+	for _, tc := range []struct {
+		req     Prerequisites
+		wantErr string
+	}{
+		{Prerequisites{}, ""},
+		{Prerequisites{MinServerVersion: 150000, Extensions: []string{"pg_trgm"}}, ""},
+		{Prerequisites{MinServerVersion: 160000}, "needs server version 160000, have 150004"},
+		{Prerequisites{Extensions: []string{"pg_trgm", "postgis", "uuid-ossp"}}, "needs extensions postgis, uuid-ossp"},
+	} {
+		err := m.checkPrerequisites(ctx, conn, Migration{Version: 4, Requires: tc.req})
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("%+v: %v", tc.req, err)
+		case tc.wantErr != "" && (!errors.Is(err, ErrPrerequisiteNotMet) || !strings.Contains(err.Error(), tc.wantErr)):
+			t.Errorf("%+v: error = %v, want ErrPrerequisiteNotMet: %s", tc.req, err, tc.wantErr)
+		}
+	}
+}
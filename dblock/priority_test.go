@@ -0,0 +1,66 @@
+package dblock
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPriorityHeadStartUsesNow(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		tries int
+		clock = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	)
+	fake := &fakeDB{query: func(query string, _ []driver.NamedValue) (driver.Rows, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.Contains(query, "pg_try_advisory_lock") {
+			tries++
+		}
+		return &fakeRows{cols: []string{"locked"}, values: [][]driver.Value{{false}}}, nil
+	}}
+	db := fake.open(t)
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Every reading of the clock is half an hour later, so the hour-long
+	// head start is over after the first try.
+	m := New(db, Config{
+		LockPriority:      PriorityHigh,
+		PriorityHeadStart: time.Hour,
+		Silent:            true,
+		Now: func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			clock = clock.Add(30 * time.Minute)
+			return clock
+		},
+	})
+	done := make(chan error, 1)
+	go func() {
+		_, err := m.acquirePrioritized(ctx, conn, 42)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrLockBusy) {
+			t.Errorf("error = %v, want ErrLockBusy", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("head start measured with the wall clock instead of Config.Now")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if tries != 2 {
+		t.Errorf("tried the lock %d times, want once in the head start and once after", tries)
+	}
+}
@@ -0,0 +1,22 @@
+package dblock
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestProbeAdvisoryLocksUnsupported(t *testing.T) {
+	fake := &fakeDB{query: func(query string, _ []driver.NamedValue) (driver.Rows, error) {
+		if strings.Contains(query, "advisory") {
+			return nil, errors.New("unknown function: pg_try_advisory_lock()")
+		}
+		return &fakeRows{}, nil
+	}}
+	err := New(fake.open(t), Config{Silent: true}).ProbeAdvisoryLocks(context.Background())
+	if !errors.Is(err, ErrAdvisoryLocksUnsupported) {
+		t.Fatalf("ProbeAdvisoryLocks = %v, want ErrAdvisoryLocksUnsupported", err)
+	}
+}
@@ -0,0 +1,32 @@
+package dblock
+
+import (
+	"context"
+	"time"
+)
+
+// waitReady pings the database until it answers or ReadyTimeout passes,
+// backing off between attempts, so a migrator started during a failover or
+// restart rides it out. Errors other than connection errors fail at once.
+func (m *Migrator) waitReady(ctx context.Context) error {
+	if m.cfg.ReadyTimeout <= 0 {
+		return nil
+	}
+
+	deadline := time.Now().Add(m.cfg.ReadyTimeout)
+	backoff := 100 * time.Millisecond
+	for {
+		err := m.db.PingContext(ctx)
+		if err == nil || !isConnError(err) {
+			return err
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return m.logErrorf("Database not ready after %v: %w", m.cfg.ReadyTimeout, err)
+		}
+		m.infof("Database not ready, retrying in %v: %v", backoff, err)
+		if err := sleep(ctx, backoff); err != nil {
+			return err
+		}
+		backoff = min(2*backoff, checkInterval)
+	}
+}
@@ -0,0 +1,45 @@
+package dblock
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestWaitReadyRidesOutConnectionErrors(t *testing.T) {
+	pings := 0
+	fake := &fakeDB{
+		query: versionRows(1),
+		ping: func() error {
+			pings++
+			if pings <= 2 {
+				return &pq.Error{Code: "57P03", Message: "the database system is starting up"}
+			}
+			return nil
+		},
+	}
+	m := New(fake.open(t), Config{NoLock: true, SkipEngineCheck: true, Silent: true, ReadyTimeout: 5 * time.Second})
+	res, err := m.Upgrade(context.Background(), 1, nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pings != 3 {
+		t.Errorf("pinged %d times, want 3", pings)
+	}
+	if res.From != 1 || res.Upgraded {
+		t.Errorf("result %+v, want version 1 read without an upgrade", res)
+	}
+}
+
+func TestWaitReadyGivesUp(t *testing.T) {
+	fake := &fakeDB{ping: func() error { return &pq.Error{Code: "08006"} }}
+	m := New(fake.open(t), Config{NoLock: true, SkipEngineCheck: true, Silent: true, ReadyTimeout: 250 * time.Millisecond})
+	if _, err := m.Upgrade(context.Background(), 1, nil, time.Minute); err == nil {
+		t.Fatal("Upgrade succeeded against a database that never came up")
+	}
+	for _, stmt := range fake.recorded() {
+		t.Errorf("ran %q before the database was ready", stmt)
+	}
+}
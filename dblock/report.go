@@ -0,0 +1,93 @@
+package dblock
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Report statuses.
+const (
+	StatusUpgraded = "upgraded"
+	StatusCurrent  = "current"
+	StatusWaited   = "waited"
+	StatusFailed   = "failed"
+)
+
+// Report summarizes an upgrade run for CI artifacts and dashboards. It
+// marshals to JSON as is.
+type Report struct {
+	From  int          `json:"from"`
+	To    int          `json:"to"`
+	Steps []ReportStep `json:"steps"`
+
+	// NonTransactional is true if any applied step ran outside a
+	// transaction.
+	NonTransactional bool `json:"non_transactional"`
+
+	// LockWait is the time spent waiting for the lock or for another
+	// instance to finish, in nanoseconds when marshaled.
+	LockWait   time.Duration `json:"lock_wait"`
+	InstanceID string        `json:"instance_id"`
+
+	// Status is one of StatusUpgraded, StatusCurrent, StatusWaited (another
+	// instance did the work) and StatusFailed.
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	lockStart time.Time
+}
+
+// ReportStep is a step applied by this instance.
+type ReportStep struct {
+	Version          int           `json:"version"`
+	Duration         time.Duration `json:"duration"`
+	NonTransactional bool          `json:"non_transactional"`
+}
+
+// UpgradeStepsReport is UpgradeSteps returning a Report of the run. The
+// report is filled in on failure too.
+func (m *Migrator) UpgradeStepsReport(ctx context.Context, migrations Migrations, timeout time.Duration) (*Report, error) {
+	report := &Report{InstanceID: m.instanceID, Steps: []ReportStep{}}
+	mm := *m
+	mm.report = report
+
+	res, err := mm.UpgradeSteps(ctx, migrations, timeout)
+	report.finishLockWait()
+	report.From, report.To = res.From, res.To
+	switch {
+	case err != nil && !errors.Is(err, ErrNoMigrationNeeded):
+		report.Status = StatusFailed
+		report.Error = err.Error()
+	case res.Upgraded:
+		report.Status = StatusUpgraded
+	case res.From == res.To:
+		report.Status = StatusCurrent
+	default:
+		report.Status = StatusWaited
+	}
+	return report, err
+}
+
+func (r *Report) record(e Event) {
+	if r == nil {
+		return
+	}
+	switch e := e.(type) {
+	case LockAttempt:
+		r.lockStart = time.Now()
+	case LockAcquired, Completed, Failed:
+		r.finishLockWait()
+	case StepCommitted:
+		r.Steps = append(r.Steps, ReportStep{Version: e.Version, Duration: e.Duration, NonTransactional: e.NonTransactional})
+		r.NonTransactional = r.NonTransactional || e.NonTransactional
+	}
+}
+
+// finishLockWait adds the time since the last LockAttempt, if still open.
+func (r *Report) finishLockWait() {
+	if !r.lockStart.IsZero() {
+		r.LockWait += time.Since(r.lockStart)
+		r.lockStart = time.Time{}
+	}
+}
@@ -0,0 +1,62 @@
+package dblock_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"dblock/dblock"
+)
+
+func TestUpgradeStepsReport(t *testing.T) {
+	s := newSandbox(t)
+	steps := dblock.Migrations{
+		{Version: 1, Up: func(tx *sql.Tx) error {
+			_, err := tx.Exec("CREATE TABLE users (id INTEGER)")
+			return err
+		}},
+		{Version: 2, NoTx: func(ctx context.Context, conn *sql.Conn) error {
+			_, err := conn.ExecContext(ctx, "CREATE INDEX CONCURRENTLY IF NOT EXISTS users_id ON users (id)")
+			return err
+		}},
+	}
+	cfg := s.Config
+	cfg.InstanceID = func() string { return "ci-1" }
+	report, err := dblock.New(s.DB, cfg).UpgradeStepsReport(context.Background(), steps, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"from", "to", "steps", "non_transactional", "lock_wait", "instance_id", "status"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("report %s lacks %q", data, key)
+		}
+	}
+
+	var got dblock.Report
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.From != 0 || got.To != 2 || got.Status != dblock.StatusUpgraded || got.InstanceID != "ci-1" {
+		t.Errorf("report %s, want an upgrade from 0 to 2 by ci-1", data)
+	}
+	if !got.NonTransactional || len(got.Steps) != 2 {
+		t.Fatalf("report %s, want two steps, one non-transactional", data)
+	}
+	if got.Steps[0].Version != 1 || got.Steps[0].NonTransactional || got.Steps[1].Version != 2 || !got.Steps[1].NonTransactional {
+		t.Errorf("steps %+v, want 1 in a transaction and 2 outside one", got.Steps)
+	}
+	if got.Error != "" {
+		t.Errorf("error %q in a successful report", got.Error)
+	}
+}
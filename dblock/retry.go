@@ -0,0 +1,53 @@
+package dblock
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net"
+	"strings"
+)
+
+func sqlState(err error) string {
+	var sqlErr interface{ SQLState() string }
+	if !errors.As(err, &sqlErr) {
+		return ""
+	}
+	return sqlErr.SQLState()
+}
+
+// isRetryable reports whether err is a serialization failure or deadlock,
+// after which the whole transaction can simply be run again. Drivers expose
+// the SQLSTATE through a SQLState method (lib/pq, pgx).
+func isRetryable(err error) bool {
+	switch sqlState(err) {
+	case "40001", "40P01":
+		return true
+	}
+	return false
+}
+
+func isUndefinedTable(err error) bool {
+	return sqlState(err) == "42P01"
+}
+
+// isHistoryUnavailable reports whether err means the history table is
+// missing, lacks a column or can't be written by the current role.
+func isHistoryUnavailable(err error) bool {
+	switch sqlState(err) {
+	case "42P01", "42703", "42501":
+		return true
+	}
+	return false
+}
+
+// isConnError reports whether err means the server isn't reachable or not
+// ready yet: network errors, broken connections, SQLSTATE class 08 and
+// 57P03 (cannot_connect_now, e.g. still starting up or in recovery).
+func isConnError(err error) bool {
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) || errors.As(err, &netErr) {
+		return true
+	}
+	state := sqlState(err)
+	return state == "57P03" || strings.HasPrefix(state, "08")
+}
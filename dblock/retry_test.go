@@ -0,0 +1,62 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// versionRows answers every query with a single version row.
+func versionRows(version int64) func(string, []driver.NamedValue) (driver.Rows, error) {
+	return func(string, []driver.NamedValue) (driver.Rows, error) {
+		return &fakeRows{cols: []string{"version"}, values: [][]driver.Value{{version}}}, nil
+	}
+}
+
+func TestUpgradeSchemaRetries(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		code       pq.ErrorCode
+		failures   int
+		maxRetries int
+		wantCalls  int
+		wantErr    bool
+	}{
+		{"serialization failure", "40001", 2, 2, 3, false},
+		{"deadlock", "40P01", 1, 2, 2, false},
+		{"out of retries", "40001", 3, 2, 3, true},
+		{"no retries by default", "40001", 1, 0, 1, true},
+		{"other errors", "23505", 1, 2, 1, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &fakeDB{query: versionRows(0)}
+			db := fake.open(t)
+			ctx := context.Background()
+			conn, err := db.Conn(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			calls := 0
+			up := func(tx *sql.Tx) error {
+				calls++
+				if calls <= tc.failures {
+					return &pq.Error{Code: tc.code}
+				}
+				return nil
+			}
+			m := New(db, Config{MaxRetries: tc.maxRetries, Silent: true})
+			err = m.upgradeSchema(ctx, conn, Migration{Version: 1, Up: up})
+			if (err != nil) != tc.wantErr {
+				t.Errorf("error = %v, want error: %v", err, tc.wantErr)
+			}
+			if calls != tc.wantCalls {
+				t.Errorf("Up ran %d times, want %d", calls, tc.wantCalls)
+			}
+		})
+	}
+}
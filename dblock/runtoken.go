@@ -0,0 +1,66 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+)
+
+// With a RunToken every version bump is also recorded under the token in the
+// version table's _run table (schema_version_run by default), in the same
+// transaction. A later call with the same token that finds nothing to do can
+// then tell its own earlier work, e.g. from before a retry by the
+// orchestrator, from a peer's.
+
+// runDialect returns the StateDialect runs are recorded with.
+func (m *Migrator) runDialect() (StateDialect, error) {
+	d, ok := m.stateDialect()
+	if !ok {
+		return nil, m.logErrorf("RunToken needs a dialect implementing StateDialect, %T doesn't", m.sql.dialect)
+	}
+	return d, nil
+}
+
+func (m *Migrator) ensureRunTable(ctx context.Context, q Queryer) error {
+	if m.cfg.RunToken == "" {
+		return nil
+	}
+	d, err := m.runDialect()
+	if err != nil {
+		return err
+	}
+	if _, err := q.ExecContext(ctx, d.CreateRunTableSQL(m.sql.runTable)); err != nil {
+		return m.logErrorf("Failed to initialize %s table: %w", m.sql.runTable, err)
+	}
+	return nil
+}
+
+func (m *Migrator) recordRun(ctx context.Context, tx *sql.Tx, version int) error {
+	if m.cfg.RunToken == "" {
+		return nil
+	}
+	d, err := m.runDialect()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, d.InsertRunSQL(m.sql.runTable), m.cfg.RunToken, version); err != nil {
+		return m.logErrorf("Failed to record run token for version %d: %w", version, err)
+	}
+	return nil
+}
+
+// appliedByRun reports whether this RunToken already took the schema to
+// targetVersion. It is best-effort: lookup errors, including the table not
+// existing yet, count as no.
+func (m *Migrator) appliedByRun(ctx context.Context, q Queryer, targetVersion int) bool {
+	d, ok := m.stateDialect()
+	if m.cfg.RunToken == "" || !ok {
+		return false
+	}
+	var applied bool
+	err := q.QueryRowContext(ctx, d.SelectRunSQL(m.sql.runTable), m.cfg.RunToken, targetVersion).Scan(&applied)
+	if err != nil || !applied {
+		return false
+	}
+	m.infof("Version %d was already applied by run %s.", targetVersion, m.cfg.RunToken)
+	return true
+}
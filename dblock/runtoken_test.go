@@ -0,0 +1,49 @@
+package dblock_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"dblock/dblock"
+)
+
+func TestRunTokenRecognizesOwnCompletion(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	runs := 0
+	up := func(*sql.Tx) error {
+		runs++
+		return nil
+	}
+	withToken := func(token string) *dblock.Migrator {
+		cfg := s.Config
+		cfg.RunToken = token
+		cfg.ErrorOnNoOp = true
+		return dblock.New(s.DB, cfg)
+	}
+
+	if res, err := withToken("deploy-1").Upgrade(ctx, 1, up, time.Minute); err != nil || res.SameRun {
+		t.Fatalf("first call: %+v, %v", res, err)
+	}
+
+	// The orchestrator retries the call, e.g. because it never saw the
+	// result.
+	res, err := withToken("deploy-1").Upgrade(ctx, 1, up, time.Minute)
+	if err != nil {
+		t.Fatalf("retried call: %v", err)
+	}
+	if !res.SameRun || res.Upgraded {
+		t.Errorf("retried call: %+v, want SameRun", res)
+	}
+	if runs != 1 {
+		t.Errorf("Up ran %d times, want 1", runs)
+	}
+
+	// A different run finds the version reached by someone else.
+	if _, err := withToken("deploy-2").Upgrade(ctx, 1, up, time.Minute); !errors.Is(err, dblock.ErrNoMigrationNeeded) {
+		t.Errorf("other run: error = %v, want ErrNoMigrationNeeded", err)
+	}
+}
@@ -0,0 +1,21 @@
+package dblock_test
+
+import (
+	"os"
+	"testing"
+
+	"dblock/dblock/dblocktest"
+
+	_ "github.com/lib/pq"
+)
+
+// newSandbox returns a sandbox in the database at $DBLOCK_TEST_DSN and
+// skips the test if it isn't set.
+func newSandbox(t *testing.T) *dblocktest.Sandbox {
+	t.Helper()
+	dsn := os.Getenv("DBLOCK_TEST_DSN")
+	if dsn == "" {
+		t.Skip("DBLOCK_TEST_DSN not set")
+	}
+	return dblocktest.NewSandbox(t, "postgres", dsn)
+}
@@ -0,0 +1,37 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// ErrPostMigrationSmokeFailed means the upgrade committed but
+// Config.SmokeQuery failed afterwards. The schema stays at the new version.
+var ErrPostMigrationSmokeFailed = errors.New("post-migration smoke query failed")
+
+// smokeTest runs SmokeQuery after the upgrade committed, reading all rows so
+// errors raised mid-result surface too. It uses a connection from the pool
+// to see the schema as the application does, not the lock connection with
+// SessionSetup's settings, unless the pool only has the one connection.
+func (m *Migrator) smokeTest(ctx context.Context, conn *sql.Conn, version int) error {
+	if m.cfg.SmokeQuery == "" {
+		return nil
+	}
+	query := m.db.QueryContext
+	if m.db.Stats().MaxOpenConnections == 1 {
+		query = conn.QueryContext
+	}
+	rows, err := query(ctx, m.cfg.SmokeQuery)
+	if err == nil {
+		for rows.Next() {
+		}
+		err = rows.Err()
+		rows.Close()
+	}
+	if err != nil {
+		return m.logErrorf("%w at version %d, the schema was not rolled back: %v", ErrPostMigrationSmokeFailed, version, err)
+	}
+	m.debugf("Smoke query passed at version %d", version)
+	return nil
+}
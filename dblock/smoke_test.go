@@ -0,0 +1,83 @@
+package dblock_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"dblock/dblock"
+)
+
+func TestSmokeQuery(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	create := func(tx *sql.Tx) error {
+		_, err := tx.Exec("CREATE TABLE users (id INTEGER)")
+		return err
+	}
+
+	cfg := s.Config
+	cfg.SmokeQuery = "SELECT id FROM users LIMIT 1"
+	if _, err := dblock.New(s.DB, cfg).Upgrade(ctx, 1, create, time.Minute); err != nil {
+		t.Errorf("smoke query against the created table: %v", err)
+	}
+
+	cfg.SmokeQuery = "SELECT id FROM orders LIMIT 1"
+	_, err := dblock.New(s.DB, cfg).Upgrade(ctx, 2, nil, time.Minute)
+	if !errors.Is(err, dblock.ErrPostMigrationSmokeFailed) {
+		t.Fatalf("smoke query against a missing table = %v, want ErrPostMigrationSmokeFailed", err)
+	}
+	var version int
+	if err := s.DB.QueryRow("SELECT version FROM schema_version").Scan(&version); err != nil || version != 2 {
+		t.Errorf("version = %d, %v, want 2 kept after the failed smoke query", version, err)
+	}
+}
+
+func TestSmokeQueryRunsWithoutMigrationRoleAndSessionSetup(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	if _, err := s.Migrator().Upgrade(ctx, 1, nil, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	role := s.Schema + "_owner"
+	if _, err := s.DB.ExecContext(ctx, "CREATE ROLE "+role+" NOLOGIN"); err != nil {
+		t.Skipf("can't create a role: %v", err)
+	}
+	t.Cleanup(func() {
+		_, _ = s.DB.Exec("DROP OWNED BY " + role)
+		_, _ = s.DB.Exec("DROP ROLE " + role)
+	})
+	for _, grant := range []string{
+		"GRANT " + role + " TO current_user",
+		"GRANT USAGE, CREATE ON SCHEMA " + s.Schema + " TO " + role,
+		"GRANT SELECT, UPDATE ON schema_version TO " + role,
+	} {
+		if _, err := s.DB.ExecContext(ctx, grant); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var duringUp string
+	cfg := s.Config
+	cfg.MigrationRole = role
+	cfg.SessionSetup = func(ctx context.Context, conn *sql.Conn) error {
+		_, err := conn.ExecContext(ctx, "SET dblock.test_setting = 'migration'")
+		return err
+	}
+	// Divides by zero unless it runs as the login role without the
+	// migration's session settings.
+	cfg.SmokeQuery = `SELECT 1 / CASE WHEN current_user = session_user
+		AND current_setting('dblock.test_setting', true) IS DISTINCT FROM 'migration' THEN 1 ELSE 0 END`
+	_, err := dblock.New(s.DB, cfg).Upgrade(ctx, 2, func(tx *sql.Tx) error {
+		return tx.QueryRow("SELECT current_user").Scan(&duringUp)
+	}, time.Minute)
+	if err != nil {
+		t.Fatalf("smoke query saw the migration's session: %v", err)
+	}
+	if duringUp != role {
+		t.Errorf("Up ran as %s, want %s", duringUp, role)
+	}
+}
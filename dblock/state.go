@@ -0,0 +1,133 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// State is the migration state as exported by ExportState.
+type State struct {
+	Version int            `json:"version"`
+	History []HistoryEntry `json:"history"`
+}
+
+// HistoryEntry is one row of the history table.
+type HistoryEntry struct {
+	Version    int       `json:"version"`
+	Checksum   string    `json:"checksum"`
+	InstanceID string    `json:"instance_id"`
+	AppliedAt  time.Time `json:"applied_at"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Status is HistoryApplied or HistoryFailed, Error the failure.
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func ExportState(db *sql.DB) ([]byte, error) {
+	return New(db, Config{}).ExportState(context.Background())
+}
+
+func ImportState(db *sql.DB, data []byte, confirm bool) error {
+	return New(db, Config{}).ImportState(context.Background(), data, confirm)
+}
+
+// ExportState serializes the version and the history, if there is one, as
+// JSON, e.g. to reproduce production's state in staging. It only reads.
+func (m *Migrator) ExportState(ctx context.Context) ([]byte, error) {
+	version, err := m.readSchemaVersion(ctx, m.db)
+	if err != nil {
+		return nil, err
+	}
+	state := State{Version: version, History: []HistoryEntry{}}
+
+	rows, err := m.db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT version, checksum, instance_id, applied_at, metadata, %s, coalesce(to_jsonb(h)->>'error', '') FROM %s h ORDER BY applied_at, version",
+		historyStatus, m.sql.historyTable))
+	switch {
+	case isUndefinedTable(err):
+		return json.Marshal(state)
+	case err != nil:
+		return nil, m.logErrorf("Failed to read history: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			e        HistoryEntry
+			metadata []byte
+		)
+		if err := rows.Scan(&e.Version, &e.Checksum, &e.InstanceID, &e.AppliedAt, &metadata, &e.Status, &e.Error); err != nil {
+			return nil, m.logErrorf("Failed to read history: %w", err)
+		}
+		if err := json.Unmarshal(metadata, &e.Metadata); err != nil {
+			return nil, m.logErrorf("Failed to read history metadata: %w", err)
+		}
+		state.History = append(state.History, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, m.logErrorf("Failed to read history: %w", err)
+	}
+	return json.Marshal(state)
+}
+
+// ImportState replaces the version and the history with an exported state,
+// in one transaction and without taking the lock. It overwrites whatever was
+// there, so confirm must be true or ErrNotConfirmed is returned.
+func (m *Migrator) ImportState(ctx context.Context, data []byte, confirm bool) error {
+	if !confirm {
+		return ErrNotConfirmed
+	}
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return m.logErrorf("Failed to parse state: %w", err)
+	}
+	if _, err := ShouldUpgrade(state.Version, state.Version); err != nil {
+		return err
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return m.logErrorf("Failed to start transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := m.getSchemaVersion(ctx, tx); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, m.sql.updateVersion(), state.Version); err != nil {
+		return m.logErrorf("Failed to import schema version: %w", err)
+	}
+
+	if err := m.ensureHistoryTable(ctx, tx); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s", m.sql.historyTable)); err != nil {
+		return m.logErrorf("Failed to clear history: %w", err)
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (version, checksum, instance_id, applied_at, metadata, status, error) VALUES ($1, $2, $3, $4, $5, $6, $7)", m.sql.historyTable)
+	for _, e := range state.History {
+		metadata, err := encodeMetadata(e.Metadata)
+		if err != nil {
+			return m.logErrorf("Failed to encode history metadata: %w", err)
+		}
+		status := e.Status
+		if status == "" {
+			status = HistoryApplied
+		}
+		if _, err := tx.ExecContext(ctx, insert, e.Version, e.Checksum, e.InstanceID, e.AppliedAt, string(metadata), status, e.Error); err != nil {
+			return m.logErrorf("Failed to import history for version %d: %w", e.Version, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return m.logErrorf("Failed to commit transaction: %w", err)
+	}
+	m.infof("Imported schema version %d with %d history entries", state.Version, len(state.History))
+	return nil
+}
@@ -0,0 +1,71 @@
+package dblock_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"dblock/dblock"
+)
+
+func TestExportImportState(t *testing.T) {
+	ctx := context.Background()
+	src := newSandbox(t)
+	cfg := src.Config
+	cfg.History = true
+	cfg.Metadata = map[string]string{"deploy": "42"}
+	steps := dblock.Migrations{{Version: 1}, {Version: 2}, {Version: 3}}
+	if _, err := dblock.New(src.DB, cfg).UpgradeSteps(ctx, steps, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	exported, err := src.Migrator().ExportState(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state dblock.State
+	if err := json.Unmarshal(exported, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Version != 3 || len(state.History) != 3 || state.History[0].Metadata["deploy"] != "42" {
+		t.Errorf("exported %s", exported)
+	}
+
+	dst := newSandbox(t)
+	if _, err := dst.Migrator().Upgrade(ctx, 7, nil, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Migrator().ImportState(ctx, exported, false); !errors.Is(err, dblock.ErrNotConfirmed) {
+		t.Errorf("ImportState without confirm: %v, want ErrNotConfirmed", err)
+	}
+	if err := dst.Migrator().ImportState(ctx, exported, true); err != nil {
+		t.Fatal(err)
+	}
+	reexported, err := dst.Migrator().ExportState(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(exported, reexported) {
+		t.Errorf("round trip changed the state:\n%s\n%s", exported, reexported)
+	}
+}
+
+func TestExportStateOnlyReads(t *testing.T) {
+	s := newSandbox(t)
+	exported, err := s.Migrator().ExportState(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(exported) != `{"version":0,"history":[]}` {
+		t.Errorf("exported %s from an empty database", exported)
+	}
+	var tables int
+	if err := s.DB.QueryRow("SELECT count(*) FROM information_schema.tables WHERE table_schema = $1", s.Schema).Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Errorf("ExportState created %d tables", tables)
+	}
+}
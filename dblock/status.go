@@ -0,0 +1,150 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Status is a snapshot of the schema version and any upgrades in progress.
+type Status struct {
+	Version int
+	Locks   []HeldLock
+}
+
+// HeldLock is an advisory lock in dblock's key space and its holder.
+type HeldLock struct {
+	TargetVersion int
+	Database      string
+	Holder        LockHolder
+}
+
+// CurrentVersion reads the schema version without creating the version
+// table, reporting InitialVersion if there is none yet.
+func (m *Migrator) CurrentVersion(ctx context.Context) (int, error) {
+	return m.readSchemaVersion(ctx, m.db)
+}
+
+// Status returns the current version and the holders of dblock's advisory
+// locks. Any application lock with a key from LockBase to LockBase plus
+// MaxVersion is taken to be dblock's. Like CurrentVersion it doesn't write.
+func (m *Migrator) Status(ctx context.Context) (Status, error) {
+	version, err := m.readSchemaVersion(ctx, m.db)
+	if err != nil {
+		return Status{}, err
+	}
+
+	locks, err := m.heldLocks(ctx)
+	if err != nil {
+		return Status{}, err
+	}
+	return Status{Version: version, Locks: locks}, nil
+}
+
+// ForceVersion sets the schema version without running any upgrade, e.g. to
+// record a manual fix after a failed migration. It does not take the lock.
+func (m *Migrator) ForceVersion(ctx context.Context, version int) error {
+	if _, err := ShouldUpgrade(version, version); err != nil {
+		return err
+	}
+	if _, err := m.ensureVersionTable(ctx, m.db); err != nil {
+		return err
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return m.logErrorf("Failed to start transaction: %w", err)
+	}
+	res, err := tx.ExecContext(ctx, m.sql.updateVersion(), version)
+	if err != nil {
+		_ = tx.Rollback()
+		return m.logErrorf("Failed to force schema version: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		// The table has no row to update, e.g. it was truncated.
+		if _, err := tx.ExecContext(ctx, m.sql.insertVersion(), version); err != nil {
+			_ = tx.Rollback()
+			return m.logErrorf("Failed to force schema version: %w", err)
+		}
+	}
+	if m.cfg.History {
+		if err := m.forceHistory(ctx, tx, version); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if err := m.clearIntents(ctx, tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return m.logErrorf("Failed to commit transaction: %w", err)
+	}
+	m.infof("Forced schema version to %d", version)
+	return nil
+}
+
+// InProgress lists the upgrades running anywhere in the cluster, not just in
+// this database, by the advisory locks they hold.
+func (m *Migrator) InProgress(ctx context.Context) ([]HeldLock, error) {
+	return m.heldLocks(ctx)
+}
+
+// Cancel terminates the backend pid, which must hold one of dblock's locks.
+// Its transaction rolls back and its lock is released. Like
+// ForceReleaseLock, confirm must be true or ErrNotConfirmed is returned.
+func (m *Migrator) Cancel(ctx context.Context, pid int, confirm bool) error {
+	if !confirm {
+		return ErrNotConfirmed
+	}
+
+	locks, err := m.heldLocks(ctx)
+	if err != nil {
+		return err
+	}
+	for _, l := range locks {
+		if l.Holder.PID != pid {
+			continue
+		}
+		var ok bool
+		if err := m.db.QueryRowContext(ctx, "SELECT pg_terminate_backend($1)", pid).Scan(&ok); err != nil {
+			return m.logErrorf("Failed to terminate backend %d: %w", pid, err)
+		}
+		if !ok {
+			return m.logErrorf("Backend %d already exited", pid)
+		}
+		m.infof("Canceled upgrade to %d in %s by backend %d", l.TargetVersion, l.Database, pid)
+		return nil
+	}
+	return m.logErrorf("Backend %d is not running an upgrade", pid)
+}
+
+func (m *Migrator) heldLocks(ctx context.Context) ([]HeldLock, error) {
+	rows, err := m.db.QueryContext(ctx, `
+		SELECT ((l.classid::bigint << 32) | l.objid::bigint) - $1, coalesce(a.datname, ''), a.pid, a.application_name, a.query_start
+		FROM pg_locks l JOIN pg_stat_activity a ON a.pid = l.pid
+		WHERE l.locktype = 'advisory' AND l.granted AND l.objsubid = 1
+			AND ((l.classid::bigint << 32) | l.objid::bigint) BETWEEN $1 AND $1 + $2
+		ORDER BY 1
+	`, m.cfg.LockBase, MaxVersion)
+	if err != nil {
+		return nil, m.logErrorf("Failed to look up advisory locks: %w", err)
+	}
+	defer rows.Close()
+
+	var locks []HeldLock
+	for rows.Next() {
+		var (
+			l          HeldLock
+			queryStart sql.NullTime
+		)
+		if err := rows.Scan(&l.TargetVersion, &l.Database, &l.Holder.PID, &l.Holder.ApplicationName, &queryStart); err != nil {
+			return nil, m.logErrorf("Failed to read advisory lock: %w", err)
+		}
+		l.Holder.QueryStart = queryStart.Time
+		locks = append(locks, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, m.logErrorf("Failed to read advisory locks: %w", err)
+	}
+	return locks, nil
+}
@@ -0,0 +1,103 @@
+package dblock_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"dblock/dblock"
+)
+
+func TestInProgressIgnoresLocksOutsideVersionRange(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	conn, err := s.DB.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, key := range []int{s.Config.LockBase + 5, s.Config.LockBase + dblock.MaxVersion + 1} {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	locks, err := s.Migrator().InProgress(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locks) != 1 || locks[0].TargetVersion != 5 {
+		t.Errorf("InProgress = %+v, want only the lock for version 5", locks)
+	}
+}
+
+func TestInProgressListsLocksAndCancelsOne(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	_, pid3 := holdLock(t, s, s.Config.LockBase+3)
+	_, pid7 := holdLock(t, s, s.Config.LockBase+7)
+
+	m := s.Migrator()
+	locks, err := m.InProgress(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locks) != 2 || locks[0].TargetVersion != 3 || locks[0].Holder.PID != pid3 || locks[1].TargetVersion != 7 || locks[1].Holder.PID != pid7 {
+		t.Fatalf("InProgress = %+v, want versions 3 and 7 with their holders", locks)
+	}
+
+	if err := m.Cancel(ctx, pid7, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// pg_terminate_backend only signals, give the backend a moment to exit.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		locks, err = m.InProgress(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(locks) == 1 && locks[0].TargetVersion == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("InProgress after Cancel = %+v, want only version 3", locks)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestStatusDoesNotCreateVersionTable(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	m := s.Migrator()
+	if v, err := m.CurrentVersion(ctx); err != nil || v != 0 {
+		t.Errorf("CurrentVersion = %d, %v, want 0", v, err)
+	}
+	if status, err := m.Status(ctx); err != nil || status.Version != 0 {
+		t.Errorf("Status = %+v, %v, want version 0", status, err)
+	}
+	var exists bool
+	if err := s.DB.QueryRowContext(ctx, "SELECT to_regclass('schema_version') IS NOT NULL").Scan(&exists); err != nil || exists {
+		t.Errorf("version table created by a read: %v, %v", exists, err)
+	}
+}
+
+func TestForceVersionOnEmptyVersionTable(t *testing.T) {
+	s := newSandbox(t)
+	ctx := context.Background()
+	if _, err := s.DB.ExecContext(ctx, "CREATE TABLE schema_version (version INTEGER NOT NULL)"); err != nil {
+		t.Fatal(err)
+	}
+	m := s.Migrator()
+	if err := m.ForceVersion(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+	var rows, version int
+	if err := s.DB.QueryRowContext(ctx, "SELECT count(*), max(version) FROM schema_version").Scan(&rows, &version); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 || version != 5 {
+		t.Errorf("schema_version has %d rows at %d, want one at 5", rows, version)
+	}
+}
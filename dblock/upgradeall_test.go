@@ -0,0 +1,94 @@
+package dblock_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"dblock/dblock"
+)
+
+func TestUpgradeAllContinuesPastFailures(t *testing.T) {
+	a, b, c := newSandbox(t), newSandbox(t), newSandbox(t)
+	errTenant := errors.New("tenant b is broken")
+	up := func(tx *sql.Tx) error {
+		var schema string
+		if err := tx.QueryRow("SELECT current_schema()").Scan(&schema); err != nil {
+			return err
+		}
+		if schema == b.Schema {
+			return errTenant
+		}
+		return nil
+	}
+	// The sandboxes share one database and so the default lock keys: run
+	// them one at a time.
+	dbs := []*sql.DB{a.DB, b.DB, c.DB}
+	opts := dblock.UpgradeAllOptions{Names: []string{"a", "b", "c"}}
+	results := dblock.UpgradeAll(context.Background(), dbs, 1, up, time.Minute, opts)
+
+	for i, want := range []error{nil, errTenant, nil} {
+		if !errors.Is(results[i].Err, want) {
+			t.Errorf("results[%d].Err = %v, want %v", i, results[i].Err, want)
+		}
+		if want == nil && (!results[i].Upgraded || results[i].To != 1) {
+			t.Errorf("results[%d] = %+v, want an upgrade to 1", i, results[i])
+		}
+	}
+}
+
+func TestUpgradeAllFailFast(t *testing.T) {
+	a, b, c := newSandbox(t), newSandbox(t), newSandbox(t)
+	errTenant := errors.New("tenant a is broken")
+	up := func(*sql.Tx) error { return errTenant }
+	dbs := []*sql.DB{c.DB, b.DB, a.DB}
+	opts := dblock.UpgradeAllOptions{FailFast: true, Names: []string{"c", "b", "a"}}
+	results := dblock.UpgradeAll(context.Background(), dbs, 1, up, time.Minute, opts)
+
+	// a goes first by name and fails, so b and c never start.
+	if !errors.Is(results[2].Err, errTenant) {
+		t.Errorf("a: %v, want %v", results[2].Err, errTenant)
+	}
+	for _, i := range []int{0, 1} {
+		if !errors.Is(results[i].Err, context.Canceled) {
+			t.Errorf("results[%d].Err = %v, want context.Canceled", i, results[i].Err)
+		}
+	}
+}
+
+func TestConcurrentUpgradeAllDoesntDeadlock(t *testing.T) {
+	a, b := newSandbox(t), newSandbox(t)
+	cfg := dblock.Config{SharedLockKey: a.Config.LockBase - 1}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	// Both callers pass the databases in opposite orders but lock them in
+	// the same one, so neither holds one lock while waiting for the other.
+	var wg sync.WaitGroup
+	all := make([][]dblock.AsyncResult, 2)
+	for i, caller := range []struct {
+		dbs   []*sql.DB
+		names []string
+	}{
+		{[]*sql.DB{a.DB, b.DB}, []string{"a", "b"}},
+		{[]*sql.DB{b.DB, a.DB}, []string{"b", "a"}},
+	} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			opts := dblock.UpgradeAllOptions{Config: cfg, Names: caller.names}
+			all[i] = dblock.UpgradeAll(ctx, caller.dbs, 1, nil, time.Minute, opts)
+		}()
+	}
+	wg.Wait()
+	for i, results := range all {
+		for j, res := range results {
+			if res.Err != nil && !errors.Is(res.Err, dblock.ErrNoMigrationNeeded) {
+				t.Errorf("caller %d, database %d: %v", i, j, res.Err)
+			}
+		}
+	}
+}
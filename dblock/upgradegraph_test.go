@@ -0,0 +1,36 @@
+package dblock_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"dblock/dblock"
+)
+
+func TestUpgradeGraph(t *testing.T) {
+	s := newSandbox(t)
+	var ran []string
+	node := func(id string, deps ...string) dblock.Node {
+		return dblock.Node{ID: id, DependsOn: deps, Up: func(*sql.Tx) error {
+			ran = append(ran, id)
+			return nil
+		}}
+	}
+	g := dblock.Graph{node("b", "a"), node("a")}
+	if applied, err := s.Migrator().UpgradeGraph(context.Background(), g, time.Minute); err != nil || fmt.Sprint(applied) != "[a b]" {
+		t.Fatalf("UpgradeGraph = %v, %v, want [a b]", applied, err)
+	}
+
+	// Applied nodes are tracked by ID, so only the new one runs.
+	g = append(g, node("c", "a"))
+	applied, err := s.Migrator().UpgradeGraph(context.Background(), g, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(applied) != "[c]" || fmt.Sprint(ran) != "[a b c]" {
+		t.Errorf("applied %v, ran %v, want [c] and [a b c]", applied, ran)
+	}
+}
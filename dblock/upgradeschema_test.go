@@ -0,0 +1,163 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestUpgradeSchemaEmptyVersionTable(t *testing.T) {
+	fake := &fakeDB{}
+	db := fake.open(t)
+	m := New(db, Config{Silent: true})
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := m.upgradeSchema(ctx, conn, Migration{Version: 3, Up: func(*sql.Tx) error { return nil }}); err != nil {
+		t.Fatal(err)
+	}
+	inserted := false
+	for _, stmt := range fake.recorded() {
+		if stmt == m.sql.updateVersion() {
+			t.Errorf("ran %q on an empty version table", stmt)
+		}
+		inserted = inserted || stmt == m.sql.insertVersion()
+	}
+	if !inserted {
+		t.Errorf("version not inserted, ran %q", fake.recorded())
+	}
+}
+
+func TestUpgradeSchemaUpdateWithoutRows(t *testing.T) {
+	fake := &fakeDB{
+		query: versionRows(2),
+		exec: func(string, []driver.NamedValue) (driver.Result, error) {
+			return driver.RowsAffected(0), nil
+		},
+	}
+	db := fake.open(t)
+	m := New(db, Config{Silent: true})
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := m.upgradeSchema(ctx, conn, Migration{Version: 3}); err == nil {
+		t.Error("upgradeSchema succeeded although the UPDATE touched no rows")
+	}
+}
+
+func TestRecordStepHistoryMissingTable(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		fake := &fakeDB{exec: func(query string, _ []driver.NamedValue) (driver.Result, error) {
+			if strings.HasPrefix(query, "INSERT INTO") {
+				return nil, &pq.Error{Code: "42P01", Message: `relation "schema_version_history" does not exist`}
+			}
+			return driver.RowsAffected(0), nil
+		}}
+		db := fake.open(t)
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := New(db, Config{History: true, StrictHistory: strict, Silent: true})
+		err = m.recordStepHistory(context.Background(), tx, Migration{Version: 2})
+		_ = tx.Rollback()
+
+		if strict {
+			if !isUndefinedTable(err) {
+				t.Errorf("StrictHistory: error = %v, want the missing table", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("lenient: %v", err)
+		}
+		statements := fake.recorded()
+		if last := statements[len(statements)-1]; last != "ROLLBACK TO SAVEPOINT dblock_history" {
+			t.Errorf("lenient: ran %q, want a rollback to the savepoint last", statements)
+		}
+	}
+}
+
+func TestCheckConsistencyHistoryBehind(t *testing.T) {
+	fake := &fakeDB{query: versionRows(1)}
+	db := fake.open(t)
+	ctx := context.Background()
+	for _, tc := range []struct {
+		strict  bool
+		version int
+		ok      bool
+	}{
+		{false, 1, true},
+		{false, 2, true},
+		{true, 2, false},
+		{false, 0, false},
+		{true, 0, false},
+	} {
+		m := New(db, Config{History: true, StrictHistory: tc.strict, Silent: true})
+		err := m.checkConsistency(ctx, db, tc.version)
+		if tc.ok && err != nil || !tc.ok && !errors.Is(err, ErrInconsistentState) {
+			t.Errorf("strict %v, history at 1, version %d: error = %v", tc.strict, tc.version, err)
+		}
+	}
+}
+
+func TestAutoAnalyze(t *testing.T) {
+	for _, auto := range []bool{false, true} {
+		fake := &fakeDB{query: versionRows(0)}
+		cfg := Config{NoLock: true, SkipEngineCheck: true, Silent: true, AutoAnalyze: auto, AnalyzeTables: []string{"app.users"}}
+		m := New(fake.open(t), cfg)
+		if _, err := m.Upgrade(context.Background(), 1, nil, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		statements := fake.recorded()
+		analyzed := slices.Index(statements, `ANALYZE "app"."users"`)
+		if !auto {
+			if analyzed >= 0 {
+				t.Errorf("ANALYZE without AutoAnalyze: %q", statements)
+			}
+			continue
+		}
+		if bumped := slices.Index(statements, m.sql.updateVersion()); analyzed < bumped || bumped < 0 {
+			t.Errorf("want ANALYZE after the version bump, ran %q", statements)
+		}
+	}
+}
+
+func TestCustomBeginTx(t *testing.T) {
+	fake := &fakeDB{query: versionRows(0)}
+	var begun []*sql.Tx
+	cfg := Config{NoLock: true, SkipEngineCheck: true, Silent: true}
+	cfg.BeginTx = func(ctx context.Context, conn *sql.Conn, opts *sql.TxOptions) (*sql.Tx, error) {
+		tx, err := conn.BeginTx(ctx, opts)
+		begun = append(begun, tx)
+		return tx, err
+	}
+	var used *sql.Tx
+	if _, err := New(fake.open(t), cfg).Upgrade(context.Background(), 1, func(tx *sql.Tx) error {
+		used = tx
+		return nil
+	}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if len(begun) == 0 {
+		t.Fatal("custom BeginTx never called")
+	}
+	if !slices.Contains(begun, used) {
+		t.Error("step didn't run in the transaction from the custom BeginTx")
+	}
+}
@@ -0,0 +1,92 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+var (
+	ErrSchemaBehind = errors.New("schema is behind the expected version")
+	ErrSchemaAhead  = errors.New("schema is ahead of the expected version")
+
+	// ErrVersionMismatch is returned in ExactVersion mode when the schema
+	// isn't at the target version.
+	ErrVersionMismatch = errors.New("schema version does not match")
+
+	ErrSchemaDrift = errors.New("schema does not match its version")
+)
+
+// Validation is a query Verify runs to check the schema itself, e.g.
+//
+//	SELECT EXISTS (SELECT 1 FROM information_schema.columns
+//		WHERE table_name = 'users' AND column_name = 'email')
+//
+// It passes if it returns a single row whose only column is true.
+type Validation struct {
+	Name  string
+	Query string
+}
+
+// Verify checks that the schema is exactly at expectedVersion, e.g. for a
+// readiness probe in a service that leaves migrating to a separate job.
+func Verify(db *sql.DB, expectedVersion int, validations ...Validation) error {
+	return New(db, Config{}).Verify(context.Background(), expectedVersion, validations...)
+}
+
+// Verify returns ErrSchemaBehind or ErrSchemaAhead, wrapped in a
+// *VersionError, unless the schema is at expectedVersion. It only reads the
+// version: it takes no lock and creates nothing, so a missing version table
+// counts as InitialVersion. Once the version matches, validations run in
+// order and the first that doesn't pass fails with ErrSchemaDrift.
+func (m *Migrator) Verify(ctx context.Context, expectedVersion int, validations ...Validation) error {
+	if _, err := ShouldUpgrade(expectedVersion, expectedVersion); err != nil {
+		return err
+	}
+	version, err := m.readSchemaVersion(ctx, m.db)
+	if err != nil {
+		return err
+	}
+
+	var verr error
+	switch {
+	case version < expectedVersion:
+		verr = ErrSchemaBehind
+	case version > expectedVersion:
+		verr = ErrSchemaAhead
+	default:
+		return m.validate(ctx, version, validations)
+	}
+	return &VersionError{Op: "verify", Current: version, Target: expectedVersion, Err: verr}
+}
+
+func (m *Migrator) validate(ctx context.Context, version int, validations []Validation) error {
+	for _, v := range validations {
+		var ok bool
+		err := m.db.QueryRowContext(ctx, v.Query).Scan(&ok)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return m.logErrorf("%w: version %d: %s returned no rows", ErrSchemaDrift, version, v.Name)
+		case err != nil:
+			return m.logErrorf("%w: version %d: %s failed: %v", ErrSchemaDrift, version, v.Name, err)
+		case !ok:
+			return m.logErrorf("%w: version %d: %s returned false", ErrSchemaDrift, version, v.Name)
+		}
+	}
+	return nil
+}
+
+// checkExactVersion backs Config.ExactVersion: it reads the version without
+// locking and fails with ErrVersionMismatch unless it is targetVersion.
+func (m *Migrator) checkExactVersion(ctx context.Context, targetVersion int) (Result, error) {
+	version, err := m.readSchemaVersion(ctx, m.db)
+	if err != nil {
+		return Result{}, err
+	}
+	res := Result{From: version, To: version}
+	if version != targetVersion {
+		return res, m.logErrorf("%w", &VersionError{Op: "verify", Current: version, Target: targetVersion, Err: ErrVersionMismatch})
+	}
+	m.infof("Schema is at version %d.", version)
+	return res, nil
+}
@@ -0,0 +1,137 @@
+package dblock
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestVerify(t *testing.T) {
+	fake := &fakeDB{query: versionRows(2)}
+	m := New(fake.open(t), Config{Silent: true})
+	ctx := context.Background()
+	for _, tc := range []struct {
+		expected int
+		want     error
+	}{
+		{1, ErrSchemaAhead},
+		{2, nil},
+		{3, ErrSchemaBehind},
+	} {
+		err := m.Verify(ctx, tc.expected)
+		if tc.want == nil && err != nil || !errors.Is(err, tc.want) {
+			t.Errorf("Verify(%d) = %v, want %v", tc.expected, err, tc.want)
+		}
+		if tc.want != nil && !errors.Is(err, &VersionError{Op: "verify", Current: 2, Target: tc.expected}) {
+			t.Errorf("Verify(%d) = %v, want a VersionError", tc.expected, err)
+		}
+	}
+	for _, stmt := range fake.recorded() {
+		if stmt != m.sql.selectVersion() {
+			t.Errorf("Verify ran %q", stmt)
+		}
+	}
+}
+
+func TestVerifyMissingVersionTable(t *testing.T) {
+	fake := &fakeDB{query: func(string, []driver.NamedValue) (driver.Rows, error) {
+		return nil, &pq.Error{Code: "42P01"}
+	}}
+	m := New(fake.open(t), Config{Silent: true})
+	if err := m.Verify(context.Background(), 0); err != nil {
+		t.Errorf("Verify(0) = %v", err)
+	}
+	if err := m.Verify(context.Background(), 1); !errors.Is(err, ErrSchemaBehind) {
+		t.Errorf("Verify(1) = %v, want ErrSchemaBehind", err)
+	}
+	if got := fake.recorded(); len(got) != 2 {
+		t.Errorf("ran %q, want only the two version reads", got)
+	}
+}
+
+func TestExactVersion(t *testing.T) {
+	fake := &fakeDB{query: versionRows(2)}
+	m := New(fake.open(t), Config{ExactVersion: true, SkipEngineCheck: true, Silent: true})
+	for _, tc := range []struct {
+		target int
+		want   error
+	}{
+		{1, ErrVersionMismatch},
+		{2, nil},
+		{3, ErrVersionMismatch},
+	} {
+		res, err := m.Upgrade(context.Background(), tc.target, func(*sql.Tx) error {
+			t.Errorf("Upgrade(%d) ran the upgrade in ExactVersion mode", tc.target)
+			return nil
+		}, time.Minute)
+		if tc.want == nil && err != nil || !errors.Is(err, tc.want) {
+			t.Errorf("Upgrade(%d) = %v, want %v", tc.target, err, tc.want)
+		}
+		if res.From != 2 || res.To != 2 || res.Upgraded {
+			t.Errorf("Upgrade(%d) result %+v, want the schema left at 2", tc.target, res)
+		}
+	}
+	for _, stmt := range fake.recorded() {
+		if stmt != m.sql.selectVersion() {
+			t.Errorf("ExactVersion ran %q", stmt)
+		}
+	}
+}
+
+func TestExactVersionPerStep(t *testing.T) {
+	steps := make(Migrations, 0, 3)
+	for v := 1; v <= 3; v++ {
+		steps = append(steps, Migration{Version: v, Up: func(*sql.Tx) error {
+			t.Errorf("step %d ran in ExactVersion mode", v)
+			return nil
+		}})
+	}
+	for _, tc := range []struct {
+		current int64
+		want    error
+	}{
+		{3, nil},
+		{2, ErrVersionMismatch},
+		{4, ErrVersionMismatch},
+	} {
+		fake := &fakeDB{query: versionRows(tc.current)}
+		cfg := Config{ExactVersion: true, LockGranularity: LockPerStep, SkipEngineCheck: true, Silent: true}
+		_, err := New(fake.open(t), cfg).UpgradeSteps(context.Background(), steps, time.Minute)
+		if tc.want == nil && err != nil || !errors.Is(err, tc.want) {
+			t.Errorf("schema at %d: UpgradeSteps = %v, want %v", tc.current, err, tc.want)
+		}
+	}
+}
+
+func TestVerifyValidations(t *testing.T) {
+	fake := &fakeDB{query: func(query string, args []driver.NamedValue) (driver.Rows, error) {
+		switch query {
+		case "SELECT has_email":
+			return &fakeRows{cols: []string{"ok"}, values: [][]driver.Value{{true}}}, nil
+		case "SELECT has_phone":
+			return &fakeRows{cols: []string{"ok"}, values: [][]driver.Value{{false}}}, nil
+		}
+		return versionRows(2)(query, args)
+	}}
+	m := New(fake.open(t), Config{Silent: true})
+	ctx := context.Background()
+	email := Validation{Name: "users.email", Query: "SELECT has_email"}
+	phone := Validation{Name: "users.phone", Query: "SELECT has_phone"}
+
+	if err := m.Verify(ctx, 2, email); err != nil {
+		t.Errorf("Verify with a passing validation = %v", err)
+	}
+	err := m.Verify(ctx, 2, email, phone)
+	if !errors.Is(err, ErrSchemaDrift) {
+		t.Fatalf("Verify with a failing validation = %v, want ErrSchemaDrift", err)
+	}
+	if !strings.Contains(err.Error(), "users.phone") {
+		t.Errorf("error %q doesn't name the failing validation", err)
+	}
+}
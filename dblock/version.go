@@ -0,0 +1,121 @@
+package dblock
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidVersion = errors.New("invalid schema version")
+
+// MaxVersion is the largest version the INTEGER version column holds.
+// Timestamp versions such as 20240101120000 are beyond it.
+const MaxVersion = math.MaxInt32
+
+// Uninitialized is the version of a schema no step was applied to yet, with
+// Config.VersionZeroApplied.
+const Uninitialized = -1
+
+// ShouldUpgrade reports whether a schema at current needs upgrading to reach
+// target. Negative versions, targets above MaxVersion and targets whose lock
+// key would overflow are rejected with ErrInvalidVersion.
+func ShouldUpgrade(current, target int) (bool, error) {
+	if current < 0 {
+		return false, fmt.Errorf("%w: current version %d is negative", ErrInvalidVersion, current)
+	}
+	if _, err := lockIDFor(baseLockID, target); err != nil {
+		return false, err
+	}
+	return current < target, nil
+}
+
+// VersionReached reports whether a waiter for target can stop waiting.
+func VersionReached(current, target int) bool {
+	return current >= target
+}
+
+func lockIDFor(base, target int) (int, error) {
+	if target < 0 {
+		return 0, fmt.Errorf("%w: target version %d is negative", ErrInvalidVersion, target)
+	}
+	if target > MaxVersion {
+		return 0, fmt.Errorf("%w: target version %d is above %d", ErrInvalidVersion, target, MaxVersion)
+	}
+	if target > math.MaxInt64-base {
+		return 0, fmt.Errorf("%w: target version %d overflows the lock key", ErrInvalidVersion, target)
+	}
+	return base + target, nil
+}
+
+// Composite major.minor versions are encoded as major*minorRange + minor,
+// so the plain integer order is the major-then-minor order (3.10 > 3.2) and
+// the lock key, history and every comparison work unchanged.
+const minorRange = 1_000_000
+
+// MajorMinor encodes major.minor as a single version.
+func MajorMinor(major, minor int) (int, error) {
+	if major < 0 || minor < 0 || minor >= minorRange {
+		return 0, fmt.Errorf("%w: %d.%d", ErrInvalidVersion, major, minor)
+	}
+	if major > MaxVersion/minorRange || major*minorRange+minor > MaxVersion {
+		return 0, fmt.Errorf("%w: %d.%d is above %d", ErrInvalidVersion, major, minor, MaxVersion)
+	}
+	return major*minorRange + minor, nil
+}
+
+// SplitMajorMinor is the inverse of MajorMinor.
+func SplitMajorMinor(version int) (major, minor int) {
+	return version / minorRange, version % minorRange
+}
+
+// ParseMajorMinor encodes a version written as "3.2". A bare "3" is 3.0.
+func ParseMajorMinor(s string) (int, error) {
+	majorStr, minorStr, hasMinor := strings.Cut(s, ".")
+	major, err := strconv.Atoi(majorStr)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidVersion, s)
+	}
+	minor := 0
+	if hasMinor {
+		if minor, err = strconv.Atoi(minorStr); err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidVersion, s)
+		}
+	}
+	return MajorMinor(major, minor)
+}
+
+var (
+	ErrTimeout           = errors.New("timed out")
+	ErrNoMigrationNeeded = errors.New("no migration needed")
+)
+
+// VersionError carries the versions involved in a failed operation. Use
+// errors.As to get at them.
+type VersionError struct {
+	Op      string
+	Current int
+	Target  int
+	Err     error
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("%s from %d to %d failed: %v", e.Op, e.Current, e.Target, e.Err)
+}
+
+func (e *VersionError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches another *VersionError whose non-zero fields are all equal, so
+// errors.Is(err, &VersionError{Op: "upgrade"}) finds any failed upgrade.
+func (e *VersionError) Is(target error) bool {
+	t, ok := target.(*VersionError)
+	if !ok {
+		return false
+	}
+	return (t.Op == "" || t.Op == e.Op) &&
+		(t.Current == 0 || t.Current == e.Current) &&
+		(t.Target == 0 || t.Target == e.Target)
+}
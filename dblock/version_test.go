@@ -0,0 +1,241 @@
+package dblock
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestShouldUpgrade(t *testing.T) {
+	tests := []struct {
+		name            string
+		current, target int
+		want            bool
+		wantErr         bool
+	}{
+		{"behind", 1, 2, true, false},
+		{"from zero", 0, 1, true, false},
+		{"zero to zero", 0, 0, false, false},
+		{"equal", 5, 5, false, false},
+		{"ahead", 6, 5, false, false},
+		{"negative current", -1, 5, false, true},
+		{"uninitialized", Uninitialized, 0, false, true},
+		{"negative target", 0, -1, false, true},
+		{"max version", 0, MaxVersion, true, false},
+		{"above max version", 0, MaxVersion + 1, false, true},
+		{"lock key overflow", 0, math.MaxInt64 - baseLockID + 1, false, true},
+		{"max int", 0, math.MaxInt64, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ShouldUpgrade(tt.current, tt.target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ShouldUpgrade(%d, %d) error = %v, want error %v", tt.current, tt.target, err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidVersion) {
+				t.Errorf("ShouldUpgrade(%d, %d) error = %v, want ErrInvalidVersion", tt.current, tt.target, err)
+			}
+			if got != tt.want {
+				t.Errorf("ShouldUpgrade(%d, %d) = %v, want %v", tt.current, tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionReached(t *testing.T) {
+	tests := []struct {
+		current, target int
+		want            bool
+	}{
+		{0, 0, true},
+		{0, 1, false},
+		{1, 1, true},
+		{2, 1, true},
+		{Uninitialized, 0, false},
+		{-5, -5, true},
+		{math.MaxInt64, MaxVersion, true},
+		{MaxVersion, math.MaxInt64, false},
+	}
+	for _, tt := range tests {
+		if got := VersionReached(tt.current, tt.target); got != tt.want {
+			t.Errorf("VersionReached(%d, %d) = %v, want %v", tt.current, tt.target, got, tt.want)
+		}
+	}
+}
+
+func FuzzShouldUpgrade(f *testing.F) {
+	f.Add(0, 1)
+	f.Add(1, 1)
+	f.Add(-1, 0)
+	f.Add(0, MaxVersion+1)
+	f.Add(0, math.MaxInt64)
+	f.Fuzz(func(t *testing.T, current, target int) {
+		needed, err := ShouldUpgrade(current, target)
+		valid := current >= 0 && target >= 0 && target <= MaxVersion
+		if valid != (err == nil) {
+			t.Fatalf("ShouldUpgrade(%d, %d) error = %v, want valid %v", current, target, err, valid)
+		}
+		if err != nil {
+			if !errors.Is(err, ErrInvalidVersion) {
+				t.Fatalf("ShouldUpgrade(%d, %d) error = %v, want ErrInvalidVersion", current, target, err)
+			}
+			if needed {
+				t.Fatalf("ShouldUpgrade(%d, %d) = true with an error", current, target)
+			}
+			return
+		}
+		if needed == VersionReached(current, target) {
+			t.Fatalf("ShouldUpgrade(%d, %d) = %v, VersionReached = %v", current, target, needed, !needed)
+		}
+	})
+}
+
+func TestMajorMinor(t *testing.T) {
+	tests := []struct {
+		major, minor int
+		want         int
+		wantErr      bool
+	}{
+		{0, 0, 0, false},
+		{3, 2, 3_000_002, false},
+		{3, 10, 3_000_010, false},
+		{2146, 999_999, 2_146_999_999, false},
+		{2147, 483_647, MaxVersion, false},
+		{2147, 483_648, 0, true},
+		{2148, 0, 0, true},
+		{-1, 0, 0, true},
+		{1, -1, 0, true},
+		{1, minorRange, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := MajorMinor(tt.major, tt.minor)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("MajorMinor(%d, %d) error = %v, want error %v", tt.major, tt.minor, err, tt.wantErr)
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrInvalidVersion) {
+			t.Errorf("MajorMinor(%d, %d) error = %v, want ErrInvalidVersion", tt.major, tt.minor, err)
+		}
+		if got != tt.want {
+			t.Errorf("MajorMinor(%d, %d) = %d, want %d", tt.major, tt.minor, got, tt.want)
+		}
+	}
+}
+
+func TestShouldUpgradeRejectsVersionsAboveMaxVersion(t *testing.T) {
+	if _, err := ShouldUpgrade(0, MaxVersion); err != nil {
+		t.Errorf("ShouldUpgrade(0, MaxVersion): %v", err)
+	}
+	if _, err := ShouldUpgrade(0, 20240101120000); !errors.Is(err, ErrInvalidVersion) {
+		t.Errorf("ShouldUpgrade(0, 20240101120000) error = %v, want ErrInvalidVersion", err)
+	}
+}
+
+func TestSortedRejectsVersionsAboveMaxVersion(t *testing.T) {
+	_, err := Migrations{{Version: 1}, {Version: MaxVersion + 1}}.sorted(1)
+	if !errors.Is(err, ErrInvalidVersion) {
+		t.Errorf("sorted error = %v, want ErrInvalidVersion", err)
+	}
+}
+
+func TestVersionError(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", &VersionError{Op: "upgrade", Current: 3, Target: 5, Err: ErrTimeout})
+	if got, want := err.Error(), "wrapped: upgrade from 3 to 5 failed: timed out"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	if !errors.Is(err, ErrTimeout) {
+		t.Error("errors.Is(err, ErrTimeout) = false")
+	}
+	var verr *VersionError
+	if !errors.As(err, &verr) || verr.Current != 3 || verr.Target != 5 {
+		t.Errorf("errors.As = %+v", verr)
+	}
+	for _, tc := range []struct {
+		target *VersionError
+		want   bool
+	}{
+		{&VersionError{}, true},
+		{&VersionError{Op: "upgrade"}, true},
+		{&VersionError{Op: "upgrade", Target: 5}, true},
+		{&VersionError{Op: "upgrade", Current: 3, Target: 5}, true},
+		{&VersionError{Op: "verify"}, false},
+		{&VersionError{Target: 4}, false},
+		{&VersionError{Current: 2}, false},
+	} {
+		if got := errors.Is(err, tc.target); got != tc.want {
+			t.Errorf("errors.Is(err, %+v) = %v, want %v", *tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestShouldUpgradeHook(t *testing.T) {
+	errFlag := errors.New("flag service down")
+	var calls int
+	m := New(nil, Config{Silent: true, ShouldUpgrade: func(current, target int) (bool, error) {
+		calls++
+		switch {
+		case target == 7:
+			return true, nil
+		case target == 8:
+			return false, errFlag
+		}
+		return false, nil
+	}})
+	for _, tc := range []struct {
+		current, target int
+		want            bool
+		wantErr         error
+	}{
+		{7, 7, true, nil},
+		{1, 5, false, nil},
+		{1, 8, false, errFlag},
+		{-1, 7, false, ErrInvalidVersion},
+	} {
+		got, err := m.shouldUpgrade(tc.current, tc.target)
+		if got != tc.want || !errors.Is(err, tc.wantErr) {
+			t.Errorf("shouldUpgrade(%d, %d) = %v, %v, want %v, %v", tc.current, tc.target, got, err, tc.want, tc.wantErr)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("hook called %d times, want 3: not for invalid versions", calls)
+	}
+}
+
+func TestMajorMinorOrdering(t *testing.T) {
+	parse := func(s string) int {
+		v, err := ParseMajorMinor(s)
+		if err != nil {
+			t.Fatalf("ParseMajorMinor(%q): %v", s, err)
+		}
+		return v
+	}
+	ordered := []string{"1", "1.1", "2.0", "3.2", "3.10", "3.100", "10.0"}
+	for i := 1; i < len(ordered); i++ {
+		if lo, hi := parse(ordered[i-1]), parse(ordered[i]); lo >= hi {
+			t.Errorf("%s (%d) not below %s (%d)", ordered[i-1], lo, ordered[i], hi)
+		}
+	}
+	if major, minor := SplitMajorMinor(parse("3.10")); major != 3 || minor != 10 {
+		t.Errorf("SplitMajorMinor = %d.%d, want 3.10", major, minor)
+	}
+	for _, s := range []string{"", "x", "3.x", "3.", "-1.0", "3.1000000"} {
+		if _, err := ParseMajorMinor(s); !errors.Is(err, ErrInvalidVersion) {
+			t.Errorf("ParseMajorMinor(%q) error = %v, want ErrInvalidVersion", s, err)
+		}
+	}
+
+	// Steps sort by major, then minor.
+	sorted, err := Migrations{{Version: parse("3.10")}, {Version: parse("3.2")}, {Version: parse("2.5")}}.sorted(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, mig := range sorted {
+		major, minor := SplitMajorMinor(mig.Version)
+		got = append(got, fmt.Sprintf("%d.%d", major, minor))
+	}
+	if fmt.Sprint(got) != "[2.5 3.2 3.10]" {
+		t.Errorf("sorted %v, want [2.5 3.2 3.10]", got)
+	}
+}
@@ -0,0 +1,106 @@
+package dblock
+
+import "strings"
+
+const (
+	defaultVersionTable  = "schema_version"
+	defaultVersionColumn = "version"
+)
+
+// versionSQL binds a Dialect to the configured version table. It is the
+// single place statements are built, so GeneratedSQL always matches what
+// actually runs.
+type versionSQL struct {
+	dialect Dialect
+	// schema is the version table's schema if it is qualified with one.
+	schema          string
+	table           string
+	column          string
+	historyTable    string
+	appliedTable    string
+	failureTable    string
+	intentTable     string
+	runTable        string
+	checkpointTable string
+	onceTable       string
+	initialVersion  int
+}
+
+func newVersionSQL(cfg Config) versionSQL {
+	d := cfg.Dialect
+	if d == nil {
+		d = Postgres
+	}
+	table, column := cfg.VersionTable, cfg.VersionColumn
+	if table == "" {
+		table = defaultVersionTable
+	}
+	if column == "" {
+		column = defaultVersionColumn
+	}
+
+	var schema string
+	if i := strings.LastIndex(table, "."); i >= 0 {
+		schema = table[:i]
+	}
+
+	return versionSQL{
+		dialect:         d,
+		schema:          schema,
+		table:           quoteQualified(d, table),
+		column:          d.QuoteIdentifier(column),
+		historyTable:    quoteQualified(d, table+"_history"),
+		appliedTable:    quoteQualified(d, table+"_applied"),
+		failureTable:    quoteQualified(d, table+"_failure"),
+		intentTable:     quoteQualified(d, table+"_intent"),
+		runTable:        quoteQualified(d, table+"_run"),
+		checkpointTable: quoteQualified(d, table+"_checkpoint"),
+		onceTable:       quoteQualified(d, table+"_once"),
+		initialVersion:  cfg.InitialVersion,
+	}
+}
+
+func (s versionSQL) createTable() string {
+	return s.dialect.CreateVersionTableSQL(s.table, s.column)
+}
+
+func (s versionSQL) seed() string {
+	return s.dialect.SeedSQL(s.table, s.column, s.initialVersion)
+}
+
+func (s versionSQL) selectVersion() string {
+	return s.dialect.SelectVersionSQL(s.table, s.column)
+}
+
+func (s versionSQL) updateVersion() string {
+	return s.dialect.UpdateVersionSQL(s.table, s.column)
+}
+
+func (s versionSQL) insertVersion() string {
+	return s.dialect.InsertVersionSQL(s.table, s.column)
+}
+
+// ownTables lists every table dblock may create, for telling them apart
+// from the application's.
+func (s versionSQL) ownTables() []string {
+	return []string{
+		s.table, s.historyTable, s.appliedTable, s.failureTable, s.intentTable, s.runTable,
+		s.checkpointTable, s.onceTable,
+	}
+}
+
+// quoteQualified quotes each part of a possibly schema-qualified name.
+func quoteQualified(d Dialect, name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = d.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// GeneratedSQL returns the statements dblock itself runs against the version
+// table for cfg, in the order they are first used, for review by DBAs.
+func GeneratedSQL(cfg Config) []string {
+	s := newVersionSQL(cfg)
+	return []string{s.createTable(), s.seed(), s.selectVersion(), s.updateVersion(), s.insertVersion()}
+}
@@ -0,0 +1,117 @@
+package dblock
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVersionSQLTableNames(t *testing.T) {
+	tests := []struct {
+		versionTable string
+		want         versionSQL
+	}{
+		{"", versionSQL{
+			table:        `"schema_version"`,
+			historyTable: `"schema_version_history"`,
+			appliedTable: `"schema_version_applied"`,
+			failureTable: `"schema_version_failure"`,
+			intentTable:  `"schema_version_intent"`,
+			runTable:     `"schema_version_run"`,
+		}},
+		{"app.versions", versionSQL{
+			table:        `"app"."versions"`,
+			historyTable: `"app"."versions_history"`,
+			appliedTable: `"app"."versions_applied"`,
+			failureTable: `"app"."versions_failure"`,
+			intentTable:  `"app"."versions_intent"`,
+			runTable:     `"app"."versions_run"`,
+		}},
+	}
+	for _, tt := range tests {
+		s := newVersionSQL(Config{VersionTable: tt.versionTable})
+		got := []string{s.table, s.historyTable, s.appliedTable, s.failureTable, s.intentTable, s.runTable}
+		want := []string{tt.want.table, tt.want.historyTable, tt.want.appliedTable, tt.want.failureTable, tt.want.intentTable, tt.want.runTable}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("VersionTable %q: got %s, want %s", tt.versionTable, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestPeerFailureWithoutCutoff(t *testing.T) {
+	// A nil db would panic if queried: without a cutoff nothing is looked up.
+	if _, failed := New(nil, Config{Silent: true}).peerFailure(context.Background(), 1, time.Time{}); failed {
+		t.Error("peerFailure reported a failure without a cutoff")
+	}
+}
+
+func TestVersionSQLSchema(t *testing.T) {
+	for table, want := range map[string]string{"": "", "schema_version": "", "app.schema_version": "app"} {
+		if got := newVersionSQL(Config{VersionTable: table}).schema; got != want {
+			t.Errorf("VersionTable %q: schema = %q, want %q", table, got, want)
+		}
+	}
+}
+
+func TestGeneratedSQLMatchesWhatRuns(t *testing.T) {
+	cfg := Config{VersionTable: "app.versions", VersionColumn: "v", InitialVersion: 7, Silent: true}
+	generated := GeneratedSQL(cfg)
+	if len(generated) != 5 {
+		t.Fatalf("GeneratedSQL returned %d statements, want 5: %q", len(generated), generated)
+	}
+	for _, stmt := range generated {
+		if !strings.Contains(stmt, `"app"."versions"`) {
+			t.Errorf("statement not on the configured table: %s", stmt)
+		}
+	}
+
+	fake := &fakeDB{query: versionRows(7)}
+	db := fake.open(t)
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m := New(db, cfg)
+	if _, err := m.getSchemaVersion(ctx, conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.upgradeSchema(ctx, conn, Migration{Version: 8}); err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range fake.recorded() {
+		if !slices.Contains(generated, stmt) {
+			t.Errorf("ran %q, which GeneratedSQL doesn't list", stmt)
+		}
+	}
+}
+
+func TestInitWithoutMultiStatementQueries(t *testing.T) {
+	fake := &fakeDB{
+		query: versionRows(0),
+		exec: func(query string, _ []driver.NamedValue) (driver.Result, error) {
+			if strings.Contains(strings.TrimRight(strings.TrimSpace(query), ";"), ";") {
+				return nil, errors.New("cannot insert multiple commands into a prepared statement")
+			}
+			return driver.RowsAffected(1), nil
+		},
+	}
+	m := New(fake.open(t), Config{Silent: true})
+	created, err := m.EnsureVersionTable(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Error("created = false for a freshly seeded table")
+	}
+	if got, want := fake.recorded(), []string{m.sql.createTable(), m.sql.seed()}; !slices.Equal(got, want) {
+		t.Errorf("ran %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,34 @@
+package dblock
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestOnWaitFiresEveryPoll(t *testing.T) {
+	// Every reading of the clock moves it on by a minute.
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}
+	var elapsed, remaining []time.Duration
+	cfg := Config{Silent: true, Now: clock, OnWait: func(e, r time.Duration) {
+		elapsed = append(elapsed, e)
+		remaining = append(remaining, r)
+	}}
+	fake := &fakeDB{query: versionRows(0)}
+	err := New(fake.open(t), cfg).WaitForSchemaVersion(context.Background(), 1, 5*time.Minute)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("WaitForSchemaVersion = %v, want ErrTimeout", err)
+	}
+	if want := []time.Duration{2 * time.Minute, 4 * time.Minute}; !slices.Equal(elapsed, want) {
+		t.Errorf("elapsed %v, want %v", elapsed, want)
+	}
+	if want := []time.Duration{3 * time.Minute, time.Minute}; !slices.Equal(remaining, want) {
+		t.Errorf("remaining %v, want %v", remaining, want)
+	}
+}
@@ -0,0 +1,44 @@
+package dblock
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrOutsideMaintenanceWindow = errors.New("outside the maintenance window")
+
+// DailyWindow returns an AllowedWindow that is open every day from start
+// to end, given as offsets from midnight in loc. A window whose end is
+// before its start spans midnight, e.g. 22:00 to 04:00.
+func DailyWindow(start, end time.Duration, loc *time.Location) func(time.Time) bool {
+	return func(now time.Time) bool {
+		now = now.In(loc)
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+		offset := now.Sub(midnight)
+		if start <= end {
+			return offset >= start && offset < end
+		}
+		return offset >= start || offset < end
+	}
+}
+
+// checkWindow fails if AllowedWindow is set and closed. It only runs once an
+// upgrade is known to be needed, so version checks and no-ops work anytime.
+func (m *Migrator) checkWindow(current, target int) error {
+	if m.cfg.AllowedWindow == nil {
+		return nil
+	}
+	now := m.now()
+	if m.cfg.AllowedWindow(now) {
+		return nil
+	}
+	m.infof("Not upgrading to %d at %s, outside the maintenance window.", target, now.Format(time.RFC3339))
+	return &VersionError{Op: "upgrade", Current: current, Target: target, Err: ErrOutsideMaintenanceWindow}
+}
+
+func (m *Migrator) now() time.Time {
+	if m.cfg.Now != nil {
+		return m.cfg.Now()
+	}
+	return time.Now()
+}
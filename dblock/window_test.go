@@ -0,0 +1,68 @@
+package dblock
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDailyWindow(t *testing.T) {
+	at := func(hour, minute int) time.Time { return time.Date(2024, 3, 1, hour, minute, 0, 0, time.UTC) }
+	for _, tc := range []struct {
+		name       string
+		start, end time.Duration
+		now        time.Time
+		want       bool
+	}{
+		{"inside", 2 * time.Hour, 4 * time.Hour, at(3, 0), true},
+		{"at start", 2 * time.Hour, 4 * time.Hour, at(2, 0), true},
+		{"at end", 2 * time.Hour, 4 * time.Hour, at(4, 0), false},
+		{"before", 2 * time.Hour, 4 * time.Hour, at(1, 59), false},
+		{"over midnight, late", 22 * time.Hour, 4 * time.Hour, at(23, 30), true},
+		{"over midnight, early", 22 * time.Hour, 4 * time.Hour, at(3, 59), true},
+		{"over midnight, day", 22 * time.Hour, 4 * time.Hour, at(12, 0), false},
+	} {
+		if got := DailyWindow(tc.start, tc.end, time.UTC)(tc.now); got != tc.want {
+			t.Errorf("%s: open at %s = %v, want %v", tc.name, tc.now.Format("15:04"), got, tc.want)
+		}
+	}
+
+	// 03:00 in Berlin is 02:00 UTC in winter.
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	if !DailyWindow(3*time.Hour, 4*time.Hour, berlin)(at(2, 30)) {
+		t.Error("window not evaluated in its location")
+	}
+}
+
+func TestCheckWindow(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	cfg := Config{Silent: true, Now: func() time.Time { return now }, AllowedWindow: DailyWindow(2*time.Hour, 4*time.Hour, time.UTC)}
+	err := New(nil, cfg).checkWindow(1, 2)
+	if !errors.Is(err, ErrOutsideMaintenanceWindow) || !errors.Is(err, &VersionError{Current: 1, Target: 2}) {
+		t.Errorf("at noon: %v, want ErrOutsideMaintenanceWindow", err)
+	}
+	now = time.Date(2024, 3, 1, 3, 0, 0, 0, time.UTC)
+	if err := New(nil, cfg).checkWindow(1, 2); err != nil {
+		t.Errorf("at 03:00: %v", err)
+	}
+}
+
+func TestUpgradeOutsideWindow(t *testing.T) {
+	fake := &fakeDB{query: versionRows(2)}
+	closed := func(time.Time) bool { return false }
+	m := New(fake.open(t), Config{AllowedWindow: closed, NoLock: true, SkipEngineCheck: true, Silent: true})
+	if _, err := m.Upgrade(context.Background(), 2, nil, time.Minute); err != nil {
+		t.Errorf("no-op outside the window: %v", err)
+	}
+	if _, err := m.Upgrade(context.Background(), 3, nil, time.Minute); !errors.Is(err, ErrOutsideMaintenanceWindow) {
+		t.Errorf("upgrade outside the window: %v, want ErrOutsideMaintenanceWindow", err)
+	}
+	if slices.Contains(fake.recorded(), m.sql.updateVersion()) {
+		t.Error("version bumped outside the window")
+	}
+}
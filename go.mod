@@ -2,4 +2,7 @@ module dblock
 
 go 1.23.4
 
-require github.com/lib/pq v1.10.9
+require (
+	github.com/golang-migrate/migrate/v4 v4.18.3
+	github.com/lib/pq v1.10.9
+)
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"database/sql"
 	"dblock/dblock"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -20,32 +27,214 @@ const (
 	timeout = 5 * time.Minute
 )
 
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [flags] <command> [args]
+
+Commands:
+  up <version>     upgrade the schema to version
+  up               apply all migrations in -manifest
+  status           print the schema version and running upgrades
+  force <version>  set the schema version without upgrading
+  version          print the schema version
+  verify <version> fail unless the schema is exactly at version
+  cancel <pid>     terminate the backend running an upgrade, after asking
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
 func main() {
-	if len(os.Args) < 2 {
-		log.Fatalf("Usage: %s <schema_version>", os.Args[0])
+	defaultDSN := os.Getenv("DATABASE_URL")
+	if defaultDSN == "" {
+		defaultDSN = fmt.Sprintf("postgres://%s:%s@%s:%s?sslmode=disable", dbUser, dbPass, dbHost, dbPort)
 	}
+	dsn := flag.String("dsn", defaultDSN, "database connection string (default $DATABASE_URL)")
+	waitTimeout := flag.Duration("timeout", timeout, "how long to wait for another instance's upgrade")
+	manifest := flag.String("manifest", "", "JSON migration manifest to apply with up")
+	yes := flag.Bool("yes", false, "don't ask before applying migrations or canceling an upgrade")
+	flag.Usage = usage
+	flag.Parse()
 
-	targetVersion, err := strconv.Atoi(os.Args[1])
-	if err != nil {
-		log.Fatalf("Invalid schema version: %v", err)
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
 	}
 
-	connStr := fmt.Sprintf("postgres://%s:%s@%s:%s?sslmode=disable", dbUser, dbPass, dbHost, dbPort)
-	db, err := sql.Open("postgres", connStr)
+	db, err := dblock.Connect("postgres", *dsn)
 	if err != nil {
-		log.Fatalf("Failed to initialize database connection handle: %v", err)
+		log.Fatalf("Failed to connect to DB: %v", err)
 	}
 	defer db.Close()
 
-	if err = db.Ping(); err != nil {
-		log.Fatalf("Failed to connect to DB: %v", err)
+	c := &cli{
+		m:           dblock.New(db, dblock.Config{}),
+		timeout:     *waitTimeout,
+		manifest:    *manifest,
+		yes:         *yes,
+		in:          os.Stdin,
+		interactive: isTerminal(os.Stdin),
 	}
+	if err := c.run(context.Background(), flag.Args()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+type cli struct {
+	m        *dblock.Migrator
+	timeout  time.Duration
+	manifest string
+
+	// Unless yes is set, up shows its plan and asks on in, which must then
+	// be interactive, and so does cancel.
+	yes         bool
+	in          io.Reader
+	interactive bool
+}
+
+var errAborted = errors.New("aborted")
 
-	if err := dblock.UpgradeIfNeeded(db, targetVersion, exampleUpgrade, timeout); err != nil {
-		log.Fatalf("Upgrade failed: %v", err)
-	} else {
+func (c *cli) run(ctx context.Context, args []string) error {
+	m := c.m
+	switch cmd := args[0]; cmd {
+	case "up":
+		if err := c.up(ctx, args); err != nil {
+			return fmt.Errorf("upgrade failed: %w", err)
+		}
 		log.Println("Schema is up to date!")
+
+	case "status":
+		status, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("version: %d\n", status.Version)
+		for _, l := range status.Locks {
+			fmt.Printf("upgrading %s to %d: pid %d (%s), since %s\n",
+				l.Database, l.TargetVersion, l.Holder.PID, l.Holder.ApplicationName, l.Holder.QueryStart.Format(time.RFC3339))
+		}
+
+	case "force":
+		version, err := versionArg(args)
+		if err != nil {
+			return err
+		}
+		return m.ForceVersion(ctx, version)
+
+	case "version":
+		version, err := m.CurrentVersion(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Println(version)
+
+	case "verify":
+		version, err := versionArg(args)
+		if err != nil {
+			return err
+		}
+		return m.Verify(ctx, version)
+
+	case "cancel":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: %s cancel <pid>", os.Args[0])
+		}
+		pid, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid pid: %w", err)
+		}
+		if err := c.ask(fmt.Sprintf("Terminate backend %d?", pid), "pass -yes to terminate it"); err != nil {
+			return err
+		}
+		return m.Cancel(ctx, pid, true)
+
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	return nil
+}
+
+func (c *cli) up(ctx context.Context, args []string) error {
+	if c.manifest != "" {
+		migrations, err := dblock.LoadManifest(os.DirFS(filepath.Dir(c.manifest)), filepath.Base(c.manifest))
+		if err != nil {
+			return err
+		}
+		if err := c.confirm(ctx, migrations); err != nil {
+			return err
+		}
+		_, err = c.m.UpgradeSteps(ctx, migrations, c.timeout)
+		return err
+	}
+
+	targetVersion, err := versionArg(args)
+	if err != nil {
+		return err
+	}
+	if err := c.confirm(ctx, dblock.Migrations{{Version: targetVersion, Up: exampleUpgrade}}); err != nil {
+		return err
+	}
+	_, err = c.m.Upgrade(ctx, targetVersion, exampleUpgrade, c.timeout)
+	return err
+}
+
+// confirm prints the plan for migrations and asks before going ahead.
+func (c *cli) confirm(ctx context.Context, migrations dblock.Migrations) error {
+	if c.yes {
+		return nil
+	}
+	pending, err := c.m.Plan(ctx, migrations)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	if !c.interactive {
+		return fmt.Errorf("%w: not a terminal, pass -yes to apply %d migrations", errAborted, len(pending))
+	}
+
+	fmt.Println("Migrations to apply:")
+	for _, v := range pending {
+		fmt.Printf("  %d\n", v)
+	}
+	return c.ask("Apply?", "")
+}
+
+// ask asks question on in unless yes is set. hint tells how to go ahead
+// when in isn't interactive.
+func (c *cli) ask(question, hint string) error {
+	if c.yes {
+		return nil
+	}
+	if !c.interactive {
+		return fmt.Errorf("%w: not a terminal, %s", errAborted, hint)
+	}
+	fmt.Print(question + " [y/N] ")
+	answer, err := bufio.NewReader(c.in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+		return errAborted
+	}
+	return nil
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func versionArg(args []string) (int, error) {
+	if len(args) != 2 {
+		return 0, fmt.Errorf("usage: %s %s <schema_version>", os.Args[0], args[0])
+	}
+	version, err := strconv.Atoi(args[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version: %w", err)
 	}
+	return version, nil
 }
 
 func exampleUpgrade(tx *sql.Tx) error {
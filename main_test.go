@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"dblock/dblock"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var errFakeExec = errors.New("fake database: exec")
+
+// fakeDB answers every query with a single version row and fails every
+// statement and transaction, so a test sees whether the CLI got past its
+// confirmation.
+type fakeDB struct {
+	version int
+
+	mu    sync.Mutex
+	execs int
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return nil }
+
+func (f *fakeDB) executed() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.execs
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (c fakeConn) Close() error                        { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)           { return nil, c.fail() }
+
+func (c fakeConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	return nil, c.fail()
+}
+
+func (c fakeConn) fail() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.execs++
+	return errFakeExec
+}
+
+func (c fakeConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	return &versionRows{version: c.db.version}, nil
+}
+
+type versionRows struct {
+	version int
+	done    bool
+}
+
+func (r *versionRows) Columns() []string { return []string{"version"} }
+func (r *versionRows) Close() error      { return nil }
+
+func (r *versionRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = int64(r.version)
+	return nil
+}
+
+// newCLI returns a cli on a database at version that reads answers from
+// stdin.
+func newCLI(t *testing.T, version int, stdin string, interactive bool) (*cli, *fakeDB) {
+	t.Helper()
+	fake := &fakeDB{version: version}
+	db := sql.OpenDB(fake)
+	t.Cleanup(func() { _ = db.Close() })
+	return &cli{
+		m:           dblock.New(db, dblock.Config{Silent: true, SkipEngineCheck: true}),
+		in:          strings.NewReader(stdin),
+		interactive: interactive,
+	}, fake
+}
+
+func TestUpAsksBeforeApplying(t *testing.T) {
+	tests := []struct {
+		name        string
+		stdin       string
+		interactive bool
+		yes         bool
+		wantAborted bool
+	}{
+		{"yes", "y\n", true, false, false},
+		{"long yes", "YES\n", true, false, false},
+		{"no", "n\n", true, false, true},
+		{"empty answer", "\n", true, false, true},
+		{"closed stdin", "", true, false, true},
+		{"not a terminal", "y\n", false, false, true},
+		{"-yes without a terminal", "", false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, fake := newCLI(t, 1, tt.stdin, tt.interactive)
+			c.yes = tt.yes
+			err := c.run(context.Background(), []string{"up", "2"})
+			if tt.wantAborted {
+				if !errors.Is(err, errAborted) {
+					t.Errorf("error = %v, want %v", err, errAborted)
+				}
+				if n := fake.executed(); n > 0 {
+					t.Errorf("ran %d statements after aborting", n)
+				}
+				return
+			}
+			if errors.Is(err, errAborted) {
+				t.Errorf("aborted, want the upgrade to be attempted")
+			}
+			if fake.executed() == 0 {
+				t.Errorf("upgrade never touched the database: %v", err)
+			}
+		})
+	}
+}
+
+func TestUpDoesntAskWithNothingPending(t *testing.T) {
+	c, _ := newCLI(t, 2, "", false)
+	if err := c.run(context.Background(), []string{"up", "2"}); errors.Is(err, errAborted) {
+		t.Errorf("asked with nothing pending: %v", err)
+	}
+}
+
+func TestUpManifestAsksBeforeApplying(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"manifest.json": `{"migrations": [{"version": 1, "up": "0001.up.sql"}, {"version": 2, "up": "0002.up.sql"}]}`,
+		"0001.up.sql":   "CREATE TABLE a (id INTEGER)",
+		"0002.up.sql":   "CREATE TABLE b (id INTEGER)",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, fake := newCLI(t, 1, "n\n", true)
+	c.manifest = filepath.Join(dir, "manifest.json")
+	if err := c.run(context.Background(), []string{"up"}); !errors.Is(err, errAborted) {
+		t.Errorf("error = %v, want %v", err, errAborted)
+	}
+	if n := fake.executed(); n > 0 {
+		t.Errorf("ran %d statements after aborting", n)
+	}
+}
+
+func TestCancelAsksFirst(t *testing.T) {
+	tests := []struct {
+		name        string
+		interactive bool
+		answer      string
+	}{
+		{"not a terminal", false, ""},
+		{"declined", true, "n\n"},
+		{"no answer", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newCLI(t, 1, tt.answer, tt.interactive)
+			if err := c.run(context.Background(), []string{"cancel", "1234"}); !errors.Is(err, errAborted) {
+				t.Errorf("run(cancel) error = %v, want %v", err, errAborted)
+			}
+		})
+	}
+}
+
+func TestRunRejectsBadArguments(t *testing.T) {
+	for _, args := range [][]string{
+		{"frobnicate"},
+		{"force"},
+		{"force", "two"},
+		{"verify", "1", "2"},
+		{"cancel"},
+		{"cancel", "pid"},
+	} {
+		c, fake := newCLI(t, 1, "", false)
+		if err := c.run(context.Background(), args); err == nil {
+			t.Errorf("run(%q) succeeded", args)
+		}
+		if n := fake.executed(); n > 0 {
+			t.Errorf("run(%q) ran %d statements", args, n)
+		}
+	}
+}
+
+// captureStdout returns what fn prints.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	fn()
+	_ = w.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestUpPrintsPlanBeforeAsking(t *testing.T) {
+	c, _ := newCLI(t, 1, "n\n", true)
+	var err error
+	out := captureStdout(t, func() { err = c.run(context.Background(), []string{"up", "3"}) })
+	if !errors.Is(err, errAborted) {
+		t.Errorf("error = %v, want %v", err, errAborted)
+	}
+	if want := "Migrations to apply:\n  3\nApply? [y/N] "; out != want {
+		t.Errorf("printed %q, want %q", out, want)
+	}
+}